@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	dynamicPath = "api/report/dynamic"
+	batchPath   = "api/report/batch"
+
+	// seqBlock 为每次预留并写入磁盘的序号数量
+	seqBlock = 1000
+	// batchRetryAfter 为服务端不支持批量上报时，改回逐条上报后再次尝试批量上报的间隔
+	batchRetryAfter = time.Hour
+)
+
+var (
+	seqMu       sync.Mutex
+	seqPath     string
+	nextSeq     uint64
+	reservedSeq uint64
+)
+
+// initSeq 从状态目录 dir 读取上一次预留的序号，dir 为空时只使用时钟。
+// 起始序号不小于当前的微秒时间戳，即使状态目录丢失也不会与之前用过的序号重复
+func initSeq(dir string) {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	nextSeq = uint64(time.Now().UnixMicro())
+	if dir == "" {
+		reservedSeq = ^uint64(0)
+		return
+	}
+	seqPath = filepath.Join(dir, "seq")
+	if data, err := os.ReadFile(seqPath); err == nil {
+		if saved, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil && saved > nextSeq {
+			nextSeq = saved
+		}
+	}
+	reservedSeq = nextSeq
+}
+
+// newSeq 返回下一个序号，用完预留的序号时先把新的预留上限写入磁盘
+func newSeq() uint64 {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	if nextSeq >= reservedSeq {
+		reservedSeq = nextSeq + seqBlock
+		if err := writeFileAtomic(seqPath, []byte(strconv.FormatUint(reservedSeq, 10)), 0o600); err != nil {
+			Warnf("Error saving report sequence: %v", err)
+		}
+	}
+	nextSeq++
+	return nextSeq
+}
+
+var batchQueue = make(chan ServerDynamicData, 64)
+
+// runBatcher 把动态数据攒成一批上报，达到 maxSamples 条或第一条数据等待超过 maxDelay 时发送
+func runBatcher() {
+	var batch []ServerDynamicData
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case d := <-batchQueue:
+			batch = append(batch, d)
+			if len(batch) == 1 {
+				timer.Reset(conf().Batch.MaxDelay.D())
+			}
+			if len(batch) < conf().Batch.MaxSamples {
+				continue
+			}
+		case <-timer.C:
+		}
+		timer.Stop()
+		if len(batch) > 0 {
+			reportSpooled(batchPath, batch)
+			batch = nil
+		}
+	}
+}
+
+// batchUnsupportedAt 为发现服务端不支持批量上报的时间 (Unix 秒)
+var batchUnsupportedAt atomic.Int64
+
+func batchSupported() bool {
+	return time.Since(time.Unix(batchUnsupportedAt.Load(), 0)) >= batchRetryAfter
+}
+
+// sendBatch 批量上报，服务端是旧版本 (批量接口返回 404) 时逐条上报
+func sendBatch(jsonData []byte) error {
+	if batchSupported() {
+		err := sendTo(batchPath, jsonData)
+		var rejected *rejectedError
+		if !errors.As(err, &rejected) || rejected.status != http.StatusNotFound {
+			return err
+		}
+		Warnf("Server does not support batch reports, sending samples one by one")
+		batchUnsupportedAt.Store(time.Now().Unix())
+	}
+
+	var samples []json.RawMessage
+	if err := json.Unmarshal(jsonData, &samples); err != nil {
+		return err
+	}
+	// 中途失败时整批重试，已经保存的数据由服务端按序号去重
+	for _, sample := range samples {
+		if err := sendTo(dynamicPath, sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compress 按配置压缩批量上报的请求体，返回压缩后的数据和 Content-Encoding
+func compress(data []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch conf().Batch.Compression {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "gzip", nil
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "zstd", nil
+	}
+	return data, "", nil
+}
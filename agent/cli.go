@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	checkPath = "api/report/check"
+	// collectWait 为 collect 命令等待所有采集项都有结果的最长时间
+	collectWait = 15 * time.Second
+)
+
+// printJSON 以缩进的 JSON 格式输出 v
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
+
+// runCollect 采集数据并输出到标准输出，不发送到服务端。once 为 true 时输出一次静态数据
+// 和动态数据后退出，否则此后按上报间隔输出动态数据，直到被中断
+func runCollect(once bool) int {
+	startCollectors()
+	static, _, err := collectWithTimeout("static", getServerStaticData)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error collecting static data:", err)
+		return 1
+	}
+	// CPU 使用率和网络速度需要两次采样
+	latest.wait(collectWait)
+	dynamic, err := getServerDynamicData()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error collecting dynamic data:", err)
+		return 1
+	}
+	sample := struct {
+		Static  ServerStaticData  `json:"static"`
+		Dynamic ServerDynamicData `json:"dynamic"`
+	}{static, dynamic}
+	if err := printJSON(sample); err != nil || once {
+		return 0
+	}
+
+	for {
+		time.Sleep(conf().Interval.D())
+		dynamic, err := getServerDynamicData()
+		if err != nil {
+			Errorf("Error collecting dynamic data: %v", err)
+			continue
+		}
+		printJSON(dynamic)
+	}
+}
+
+// testConnection 依次检查每个服务端的地址、连接、TLS 和节点凭据并输出诊断，有服务端不可用时返回 1
+func testConnection() int {
+	switch {
+	case conf().Token != "":
+		fmt.Println("Credential: node token")
+	case identity != nil:
+		fmt.Println("Credential: agent identity", identity.ID)
+	default:
+		fmt.Println("Credential: none")
+	}
+	if conf().Proxy != "" {
+		fmt.Println("Proxy:", conf().Proxy)
+	}
+
+	failed := false
+	for _, server := range conf().Servers {
+		fmt.Println()
+		fmt.Println("Server", server)
+		if !checkServer(server) {
+			failed = true
+		}
+	}
+	fmt.Println()
+	if failed {
+		fmt.Println("Connection test failed")
+		return 1
+	}
+	fmt.Println("Connection test passed")
+	return 0
+}
+
+func printCheck(status, name, msg string) {
+	fmt.Printf("  %-6s %-12s %s\n", "["+status+"]", name, msg)
+}
+
+// checkServer 检查一个服务端，返回 agent 能否向它上报
+func checkServer(server string) bool {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		printCheck("FAIL", "URL", "not an http or https URL")
+		return false
+	}
+	if u.Scheme == "http" {
+		printCheck("WARN", "URL", "the connection is not encrypted, use https in production")
+	} else {
+		printCheck("OK", "URL", u.Host)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ApiPath(server, checkPath), nil)
+	if err != nil {
+		printCheck("FAIL", "URL", err.Error())
+		return false
+	}
+	req.Header = streamHeaders()
+	start := time.Now()
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		printCheck("FAIL", "Connection", diagnose(err))
+		return false
+	}
+	defer resp.Body.Close()
+	printCheck("OK", "Connection", fmt.Sprintf("responded in %s", time.Since(start).Round(time.Millisecond)))
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		msg := fmt.Sprintf("%s, certificate issued by %q, expires %s", tls.VersionName(resp.TLS.Version), cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+		if conf().TLS.InsecureSkipVerify {
+			printCheck("WARN", "TLS", msg+", verification is disabled by tls.insecureSkipVerify")
+		} else if time.Until(cert.NotAfter) < 14*24*time.Hour {
+			printCheck("WARN", "TLS", msg+", the certificate expires soon")
+		} else {
+			printCheck("OK", "TLS", msg)
+		}
+	}
+
+	var body struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	json.Unmarshal(data, &body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		printCheck("OK", "Credentials", "accepted")
+		return true
+	case http.StatusUnauthorized:
+		hint := "check the token in the install command"
+		if conf().Token == "" {
+			hint = "this agent has no token, the server only accepts its identity after the node was added with it"
+		}
+		printCheck("FAIL", "Credentials", fmt.Sprintf("rejected: %s; %s", body.Error, hint))
+	case http.StatusForbidden:
+		printCheck("FAIL", "Credentials", "the server requires a client certificate, set tls.certFile and tls.keyFile")
+	case http.StatusNotFound:
+		// 旧版本服务端没有凭据检查接口，上报本身不受影响
+		printCheck("WARN", "Credentials", "not checked, the server does not support credential checks")
+		return true
+	default:
+		printCheck("FAIL", "Credentials", fmt.Sprintf("server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(data))))
+	}
+	return false
+}
+
+// diagnose 把请求失败的原因转换为可以据此处理的说明
+func diagnose(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("cannot resolve %s: %v", dnsErr.Name, dnsErr.Err)
+	case errors.As(err, &unknownAuthority):
+		return "TLS: the certificate is signed by an unknown authority, set tls.caFile to the CA certificate"
+	case errors.As(err, &hostnameErr):
+		return "TLS: " + hostnameErr.Error()
+	case errors.As(err, &invalidCert):
+		return "TLS: " + invalidCert.Error()
+	case errors.As(err, &recordErr):
+		return "TLS: the server did not answer with TLS, use http:// or check the port"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused, the server is not listening on this port or a firewall rejects the connection"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timed out, the server is unreachable or a firewall drops the traffic"
+	}
+	return err.Error()
+}
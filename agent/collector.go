@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Collector 为一个动态数据的采集项。调度器按采集项各自的间隔在独立的 goroutine 中调用 Collect，
+// 结果保存在共享的快照中，上报时从快照读取，慢的采集项不会阻塞上报和其他采集项
+type Collector interface {
+	// Name 为采集项的名称，与配置中 collectors 下的键相同
+	Name() string
+	// Collect 采集一次，返回把结果写入动态数据的函数。ctx 在超过采集项的超时时间后取消
+	Collect(ctx context.Context) (func(*ServerDynamicData), error)
+}
+
+// errWarmingUp 表示采集项需要两次采样才能计算结果 (如 CPU 使用率、网络速度)，第一次采样没有结果
+var errWarmingUp = errors.New("collecting the first sample")
+
+// collectors 为所有动态数据的采集项，按写入动态数据的顺序排列
+var collectors = []Collector{
+	&cpuCollector{},
+	collectorFunc{"load", collectLoad},
+	collectorFunc{"memory", collectMemory},
+	collectorFunc{"disk", collectDisk},
+	&networkCollector{},
+	collectorFunc{"connections", collectConnections},
+	collectorFunc{"processes", collectProcesses},
+	collectorFunc{"probes", collectProbes},
+}
+
+// collectorFunc 把函数适配为 Collector
+type collectorFunc struct {
+	name string
+	fn   func(ctx context.Context) (func(*ServerDynamicData), error)
+}
+
+func (c collectorFunc) Name() string { return c.name }
+
+func (c collectorFunc) Collect(ctx context.Context) (func(*ServerDynamicData), error) {
+	return c.fn(ctx)
+}
+
+// collectInterval 返回采集项的采集间隔，未设置时与上报间隔相同
+func collectInterval(name string) time.Duration {
+	if d := conf().Collectors.Get(name).Interval.D(); d > 0 {
+		return d
+	}
+	return conf().Interval.D()
+}
+
+// collectTimeout 返回采集项单次采集的超时时间，未设置时为采集间隔
+func collectTimeout(name string) time.Duration {
+	if d := conf().Collectors.Get(name).Timeout.D(); d > 0 {
+		return d
+	}
+	return collectInterval(name)
+}
+
+// sample 为采集项最近一次的结果
+type sample struct {
+	apply func(*ServerDynamicData)
+	at    time.Time
+	// err 为最近一次采集的错误，失败时保留上一次成功的结果
+	err error
+}
+
+// snapshot 为所有采集项最近一次的结果，上报时由此生成动态数据
+type snapshot struct {
+	mu      sync.Mutex
+	samples map[string]*sample
+	// updated 在任意采集项完成一次采集后关闭并替换，供等待结果的调用方使用
+	updated chan struct{}
+}
+
+// latest 为采集项的结果，由调度的 goroutine 写入
+var latest = newSnapshot()
+
+func newSnapshot() *snapshot {
+	return &snapshot{samples: map[string]*sample{}, updated: make(chan struct{})}
+}
+
+// record 保存采集项的一次结果，返回错误状态是否变化
+func (s *snapshot) record(name string, apply func(*ServerDynamicData), err error) (changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sm := s.samples[name]
+	if sm == nil {
+		sm = &sample{}
+		s.samples[name] = sm
+	}
+	changed = (sm.err == nil) != (err == nil)
+	sm.err = err
+	if err == nil {
+		sm.apply, sm.at = apply, time.Now()
+	}
+	close(s.updated)
+	s.updated = make(chan struct{})
+	return changed
+}
+
+// dynamic 由各采集项最近一次的结果生成动态数据。没有开启的采集项和结果过期
+// (超过三个采集间隔没有成功采集) 的采集项对应的字段为零值
+func (s *snapshot) dynamic() ServerDynamicData {
+	var d ServerDynamicData
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range collectors {
+		name := c.Name()
+		sm := s.samples[name]
+		if sm == nil || sm.apply == nil || !conf().Collectors.Get(name).Enabled {
+			continue
+		}
+		if now.Sub(sm.at) > 3*collectInterval(name)+collectTimeout(name) {
+			continue
+		}
+		sm.apply(&d)
+	}
+	return d
+}
+
+// ready 表示每个开启的采集项是否都完成了一次采集 (成功或失败)
+func (s *snapshot) ready() (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range collectors {
+		if !conf().Collectors.Get(c.Name()).Enabled {
+			continue
+		}
+		if s.samples[c.Name()] == nil {
+			return false, s.updated
+		}
+	}
+	return true, s.updated
+}
+
+// wait 等待每个开启的采集项都有结果，最多等待 timeout
+func (s *snapshot) wait(timeout time.Duration) {
+	deadline := time.After(timeout)
+	for {
+		ok, updated := s.ready()
+		if ok {
+			return
+		}
+		select {
+		case <-updated:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// startCollectors 为每个采集项启动调度的 goroutine
+func startCollectors() {
+	for _, c := range collectors {
+		go schedule(c)
+	}
+}
+
+// schedule 按采集间隔运行采集项。采集时间按固定的节拍计算，不受每次采集耗时的影响；
+// 上一次采集超时后仍未返回时跳过本次，避免堆积
+func schedule(c Collector) {
+	name := c.Name()
+	var running sync.Mutex
+	next := time.Now()
+	for {
+		time.Sleep(time.Until(next))
+		interval := collectInterval(name)
+		if conf().Collectors.Get(name).Enabled {
+			if running.TryLock() {
+				go func() {
+					defer running.Unlock()
+					runCollector(c)
+				}()
+			} else {
+				Debugf("Collector %s is still running, skipping this round", name)
+			}
+		}
+		next = next.Add(interval)
+		if now := time.Now(); next.Before(now) {
+			// 系统休眠或间隔变小时不补采错过的节拍
+			next = now.Add(interval)
+		}
+	}
+}
+
+// runCollector 运行一次采集项并保存结果，超时后不再等待，采集项返回后才能开始下一次
+func runCollector(c Collector) {
+	name := c.Name()
+	apply, wait, err := collectWithTimeout(name, c.Collect)
+	// 超时的采集返回之前不开始下一次采集
+	defer wait()
+	if errors.Is(err, errWarmingUp) {
+		return
+	}
+	if latest.record(name, apply, err) {
+		if err != nil {
+			Warnf("Collector %s failed: %v", name, err)
+		} else {
+			Infof("Collector %s recovered", name)
+		}
+	} else if err != nil {
+		Debugf("Collector %s failed: %v", name, err)
+	}
+}
+
+// collectWithTimeout 以采集项 name 的超时时间运行 fn，fn 中的 panic 作为错误返回。
+// 超时后不等待 fn 返回，直接返回超时错误；返回的 wait 等待 fn 返回，调用方在开始下一次采集前调用
+func collectWithTimeout[T any](name string, fn func(ctx context.Context) (T, error)) (T, func(), error) {
+	timeout := collectTimeout(name)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+		v, err := fn(ctx)
+		done <- result{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		cancel()
+		return r.v, func() {}, r.err
+	case <-ctx.Done():
+		wait := func() {
+			<-done
+			cancel()
+		}
+		var zero T
+		return zero, wait, fmt.Errorf("timed out after %s", timeout)
+	}
+}
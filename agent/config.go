@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration 在 YAML 中以 "1s"、"5m" 这样的字符串表示
+type Duration time.Duration
+
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	v, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", value.Value, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Size 在 YAML 中以 "64MB"、"512KiB" 这样的字符串或字节数表示，单位按 1024 进位
+type Size int64
+
+func (s Size) MarshalYAML() (interface{}, error) {
+	return int64(s), nil
+}
+
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	v := strings.TrimSpace(value.Value)
+	units := []struct {
+		suffix string
+		mult   int64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value.Value)
+	}
+	*s = Size(n * mult)
+	return nil
+}
+
+type Config struct {
+	// Servers 为服务端地址，上报失败时依次尝试下一个
+	Servers []string `yaml:"servers"`
+	// Token 为安装命令生成的节点凭据，同时作为节点 ID，为空时使用 agent 身份的 ID
+	Token string `yaml:"token"`
+	// StateDir 为保存 agent 身份等状态的目录，空表示平台默认目录
+	StateDir string `yaml:"stateDir"`
+	// Interval 为动态数据的上报间隔
+	Interval Duration `yaml:"interval"`
+	LogLevel string   `yaml:"logLevel"`
+	// Proxy 为访问服务端使用的代理，如 http://proxy:3128，空表示使用 HTTPS_PROXY 等环境变量
+	Proxy      string           `yaml:"proxy"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Collectors CollectorsConfig `yaml:"collectors"`
+	// Disks 按挂载点或设备名过滤参与统计的磁盘
+	Disks Filter `yaml:"disks"`
+	// Interfaces 按网卡名过滤参与统计的网卡
+	Interfaces Filter      `yaml:"interfaces"`
+	Spool      SpoolConfig `yaml:"spool"`
+	Batch      BatchConfig `yaml:"batch"`
+	// Stream 开启时与服务端保持 WebSocket 连接，上报和服务端下发的命令都通过这个连接，
+	// 连接不可用时上报改用 HTTP
+	Stream StreamConfig `yaml:"stream"`
+	// Probes 为定期进行 TCP 连接测试的目标，测试间隔为 collectors.probes.interval
+	Probes []ProbeConfig `yaml:"probes"`
+	Update UpdateConfig  `yaml:"update"`
+
+	// remoteVersion 为已经合并到配置中的服务端配置版本，为空表示只使用本地配置
+	remoteVersion string
+}
+
+type ProbeConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Address 为 host:port
+	Address string `yaml:"address" json:"address"`
+}
+
+// UpdateConfig 为自动更新的设置，服务端推送新版本时下载、校验并替换 agent 程序
+type UpdateConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CheckInterval 为检查新版本的间隔
+	CheckInterval Duration `yaml:"checkInterval"`
+	// PublicKey 为校验构建签名的 ed25519 公钥 (base64)，设置后只接受带有有效签名的构建
+	PublicKey string `yaml:"publicKey"`
+	// RollbackTimeout 内新版本没有上报成功时换回原来的版本
+	RollbackTimeout Duration `yaml:"rollbackTimeout"`
+}
+
+type StreamConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// BatchConfig 为动态数据的批量上报设置，关闭时每次采集后立即上报
+type BatchConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxSamples 为一批的最大条数，MaxDelay 为第一条数据最长的等待时间，先达到哪个就发送
+	MaxSamples int      `yaml:"maxSamples"`
+	MaxDelay   Duration `yaml:"maxDelay"`
+	// Compression 为请求体的压缩方式: zstd、gzip 或 none
+	Compression string `yaml:"compression"`
+}
+
+// SpoolConfig 为服务端不可达时暂存动态数据的磁盘队列，保存在状态目录的 spool 子目录中
+type SpoolConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxSize 为队列占用的最大磁盘空间，超过时丢弃最旧的数据
+	MaxSize Size `yaml:"maxSize"`
+	// MaxAge 为数据的最长保留时间，更早的数据不再补报
+	MaxAge Duration `yaml:"maxAge"`
+}
+
+type TLSConfig struct {
+	// CAFile 不为空时用该 CA 校验服务端证书
+	CAFile string `yaml:"caFile"`
+	// CertFile 和 KeyFile 为服务端要求客户端证书时使用的证书
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// CollectorConfig 为一个采集项的开关和采集间隔
+type CollectorConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval 为采集间隔，0 表示与上报间隔相同，两次采集之间上报上一次的结果
+	Interval Duration `yaml:"interval"`
+	// Timeout 为单次采集的超时时间，0 表示与采集间隔相同。超时后上报上一次的结果
+	Timeout Duration `yaml:"timeout"`
+}
+
+type CollectorsConfig struct {
+	// Static 为主机名、系统版本、公网 IP 等静态数据，Interval 即静态数据的上报间隔
+	Static      CollectorConfig `yaml:"static"`
+	CPU         CollectorConfig `yaml:"cpu"`
+	Load        CollectorConfig `yaml:"load"`
+	Memory      CollectorConfig `yaml:"memory"`
+	Disk        CollectorConfig `yaml:"disk"`
+	Network     CollectorConfig `yaml:"network"`
+	Connections CollectorConfig `yaml:"connections"`
+	Processes   CollectorConfig `yaml:"processes"`
+	Probes      CollectorConfig `yaml:"probes"`
+}
+
+// Get 按名称返回采集项的配置
+func (c CollectorsConfig) Get(name string) CollectorConfig {
+	if p := c.ref(name); p != nil {
+		return *p
+	}
+	return CollectorConfig{}
+}
+
+func (c *CollectorsConfig) ref(name string) *CollectorConfig {
+	switch name {
+	case "static":
+		return &c.Static
+	case "cpu":
+		return &c.CPU
+	case "load":
+		return &c.Load
+	case "memory":
+		return &c.Memory
+	case "disk":
+		return &c.Disk
+	case "network":
+		return &c.Network
+	case "connections":
+		return &c.Connections
+	case "processes":
+		return &c.Processes
+	case "probes":
+		return &c.Probes
+	}
+	return nil
+}
+
+// collectorNames 为所有采集项的名称
+var collectorNames = []string{"static", "cpu", "load", "memory", "disk", "network", "connections", "processes", "probes"}
+
+// Filter 为 shell 风格的通配符列表，Include 为空表示包含全部，Exclude 优先
+type Filter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Match 表示 names 中任意一个名称是否通过过滤
+func (f Filter) Match(names ...string) bool {
+	for _, pattern := range f.Exclude {
+		for _, name := range names {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return false
+			}
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		for _, name := range names {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f Filter) validate() error {
+	for _, pattern := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func DefaultConfig() *Config {
+	enabled := CollectorConfig{Enabled: true}
+	return &Config{
+		Servers:  []string{"http://127.0.0.1:8080"},
+		Interval: Duration(time.Second),
+		LogLevel: "info",
+		Collectors: CollectorsConfig{
+			Static:      CollectorConfig{Enabled: true, Interval: Duration(time.Minute)},
+			CPU:         enabled,
+			Load:        enabled,
+			Memory:      enabled,
+			Disk:        CollectorConfig{Enabled: true, Interval: Duration(10 * time.Second)},
+			Network:     enabled,
+			Connections: enabled,
+			Processes:   CollectorConfig{Enabled: true, Interval: Duration(5 * time.Second)},
+			Probes:      CollectorConfig{Enabled: true, Interval: Duration(30 * time.Second)},
+		},
+		Interfaces: Filter{Exclude: []string{"lo", "lo0", "docker*", "veth*"}},
+		Spool:      SpoolConfig{Enabled: true, MaxSize: 64 << 20, MaxAge: Duration(24 * time.Hour)},
+		Batch:      BatchConfig{Enabled: true, MaxSamples: 30, MaxDelay: Duration(5 * time.Second), Compression: "zstd"},
+		Update:     UpdateConfig{Enabled: false, CheckInterval: Duration(time.Hour), RollbackTimeout: Duration(5 * time.Minute)},
+	}
+}
+
+// options 为命令行参数，重新加载配置文件时再次覆盖到文件内容之上
+type options struct {
+	// command 为子命令: collect、test-connection，为空时正常运行
+	command  string
+	once     bool
+	path     string
+	check    bool
+	version  bool
+	interval time.Duration
+	logLevel string
+	server   string
+	token    string
+}
+
+// commands 为支持的子命令及其说明
+var commands = map[string]string{
+	"collect":         "print collected data as JSON without sending it",
+	"test-connection": "check the server URL, TLS and credentials",
+}
+
+func parseOptions(args []string) (options, error) {
+	var o options
+	name := "xprobe_agent"
+	if len(args) > 0 && commands[args[0]] != "" {
+		o.command, args = args[0], args[1:]
+		name += " " + o.command
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&o.path, "config", os.Getenv("XPROBE_AGENT_CONFIG"), "path to YAML config file")
+	if o.command == "" {
+		fs.BoolVar(&o.check, "check-config", false, "validate the configuration and exit")
+		fs.BoolVar(&o.version, "version", false, "print the version and exit")
+	}
+	if o.command == "collect" {
+		fs.BoolVar(&o.once, "once", false, "print one sample and exit")
+	}
+	fs.DurationVar(&o.interval, "i", 0, "report interval")
+	fs.StringVar(&o.logLevel, "log-level", "", "log level: debug, info, warn, error")
+	verbose := fs.Bool("v", false, "verbose logging, including report payloads (same as -log-level debug)")
+	fs.Usage = func() {
+		if o.command != "" {
+			fmt.Fprintf(fs.Output(), "Usage: %s [flags] [server-url] [token]\n\n%s\n\n", name, commands[o.command])
+			fs.PrintDefaults()
+			return
+		}
+		fmt.Fprintln(fs.Output(), "Usage: xprobe_agent [command] [flags] [server-url] [token]")
+		fmt.Fprintln(fs.Output(), "\nCommands:")
+		for _, c := range []string{"collect", "test-connection"} {
+			fmt.Fprintf(fs.Output(), "  %-16s %s\n", c, commands[c])
+		}
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	if *verbose && o.logLevel == "" {
+		o.logLevel = "debug"
+	}
+
+	// 兼容安装脚本使用的位置参数
+	if fs.NArg() >= 1 {
+		o.server = fs.Arg(0)
+	}
+	if fs.NArg() >= 2 {
+		o.token = fs.Arg(1)
+	}
+	return o, nil
+}
+
+// loadConfig 依次应用默认值、配置文件和命令行参数
+// startupStateDirs 返回启动失败时可能的状态目录: 配置的目录、平台默认目录和当前用户的配置目录。
+// 配置无效时 cfg 为 nil，从配置文件中只读取 stateDir
+func startupStateDirs(o options, cfg *Config) []string {
+	var dirs []string
+	if cfg != nil {
+		dirs = append(dirs, cfg.StateDir)
+	} else if data, err := os.ReadFile(o.path); o.path != "" && err == nil {
+		var partial struct {
+			StateDir string `yaml:"stateDir"`
+		}
+		yaml.Unmarshal(data, &partial)
+		dirs = append(dirs, partial.StateDir)
+	}
+	dirs = append(dirs, defaultStateDir())
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "xprobe"))
+	}
+	return dirs
+}
+
+func loadConfig(o options) (*Config, error) {
+	cfg := DefaultConfig()
+	if o.path != "" {
+		data, err := os.ReadFile(o.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %v", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing config file %s: %v", o.path, err)
+		}
+	}
+
+	if o.server != "" {
+		cfg.Servers = []string{o.server}
+	}
+	if o.token != "" {
+		cfg.Token = o.token
+	}
+	if o.interval > 0 {
+		cfg.Interval = Duration(o.interval)
+	}
+	if o.logLevel != "" {
+		cfg.LogLevel = o.logLevel
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate 检查配置，返回所有错误
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.Servers) == 0 {
+		errs = append(errs, errors.New("servers must not be empty"))
+	}
+	for _, s := range c.Servers {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("servers: %q is not an http or https URL", s))
+		}
+	}
+	if c.Interval < Duration(100*time.Millisecond) {
+		errs = append(errs, errors.New("interval must be at least 100ms"))
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("logLevel: unknown level %q", c.LogLevel))
+	}
+	if c.Proxy != "" {
+		if u, err := url.Parse(c.Proxy); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("proxy: invalid URL %q", c.Proxy))
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.certFile and tls.keyFile must be set together"))
+	}
+	for _, name := range collectorNames {
+		if c.Collectors.Get(name).Interval < 0 {
+			errs = append(errs, fmt.Errorf("collectors.%s.interval must not be negative", name))
+		}
+		if c.Collectors.Get(name).Timeout < 0 {
+			errs = append(errs, fmt.Errorf("collectors.%s.timeout must not be negative", name))
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range c.Probes {
+		if p.Name == "" || seen[p.Name] {
+			errs = append(errs, fmt.Errorf("probes: name %q is empty or duplicated", p.Name))
+		}
+		seen[p.Name] = true
+		if _, port, err := net.SplitHostPort(p.Address); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("probes: %q is not a host:port address", p.Address))
+		}
+	}
+	if err := c.Disks.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("disks: %v", err))
+	}
+	if err := c.Interfaces.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("interfaces: %v", err))
+	}
+	if c.Spool.Enabled {
+		if c.Spool.MaxSize < 64<<10 {
+			errs = append(errs, errors.New("spool.maxSize must be at least 64KiB"))
+		}
+		if c.Spool.MaxAge <= 0 {
+			errs = append(errs, errors.New("spool.maxAge must be positive"))
+		}
+	}
+	if c.Batch.Enabled {
+		if c.Batch.MaxSamples < 1 || c.Batch.MaxSamples > 10000 {
+			errs = append(errs, errors.New("batch.maxSamples must be between 1 and 10000"))
+		}
+		if c.Batch.MaxDelay <= 0 {
+			errs = append(errs, errors.New("batch.maxDelay must be positive"))
+		}
+	}
+	switch c.Batch.Compression {
+	case "zstd", "gzip", "none":
+	default:
+		errs = append(errs, fmt.Errorf("batch.compression: unknown compression %q", c.Batch.Compression))
+	}
+	if c.Update.Enabled {
+		if c.Update.CheckInterval < Duration(time.Minute) {
+			errs = append(errs, errors.New("update.checkInterval must be at least 1m"))
+		}
+		if c.Update.RollbackTimeout < Duration(30*time.Second) {
+			errs = append(errs, errors.New("update.rollbackTimeout must be at least 30s"))
+		}
+		// 没有签名校验时构建的校验和来自服务端，只有 https 才能保证它没有被篡改
+		if c.Update.PublicKey == "" {
+			for _, server := range c.Servers {
+				if !strings.HasPrefix(server, "https://") {
+					errs = append(errs, fmt.Errorf("update.enabled requires update.publicKey when server %s does not use https", server))
+				}
+			}
+		}
+	}
+	if c.Update.PublicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.Update.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, errors.New("update.publicKey must be a base64 encoded ed25519 public key"))
+		}
+	}
+	if len(errs) == 0 {
+		if _, err := c.newHTTPClient(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newHTTPClient 按代理和 TLS 设置创建访问服务端的 HTTP 客户端
+func (c *Config) newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.TLS.InsecureSkipVerify}
+	if c.TLS.CAFile != "" {
+		pem, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.caFile: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls.caFile: no certificates found in %s", c.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.certFile: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// active 为当前生效的配置和对应的 HTTP 客户端，重新加载时整体替换
+type active struct {
+	cfg    *Config
+	client *http.Client
+}
+
+var (
+	current atomic.Pointer[active]
+	// reportStaticNow 通知静态数据的上报循环立即上报一次
+	reportStaticNow = make(chan struct{}, 1)
+)
+
+// conf 返回当前生效的配置，调用方不能修改
+func conf() *Config {
+	return current.Load().cfg
+}
+
+func httpClient() *http.Client {
+	return current.Load().client
+}
+
+func applyConfig(cfg *Config) error {
+	// 身份没有加载成功的 agent 以节点密钥作为节点 ID，重新加载时不能去掉密钥
+	if cfg.Token == "" && identity == nil && current.Load() != nil {
+		return errors.New("token cannot be empty, the agent has no identity to use as node ID")
+	}
+	client, err := cfg.newHTTPClient()
+	if err != nil {
+		return err
+	}
+	SetLogLevel(cfg.LogLevel)
+	prev := current.Swap(&active{cfg: cfg, client: client})
+	// 采集项变化后立即上报静态数据，服务端随之显示或隐藏对应的字段
+	if prev != nil && !slices.Equal(capabilities(prev.cfg), capabilities(cfg)) {
+		select {
+		case reportStaticNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// watchConfig 在收到 SIGHUP 或配置文件修改时间变化时重新加载配置，
+// 加载失败时继续使用原来的配置
+func watchConfig(o options) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var modTime time.Time
+	if info, err := os.Stat(o.path); err == nil {
+		modTime = info.ModTime()
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if o.path == "" {
+				continue
+			}
+			info, err := os.Stat(o.path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+		}
+
+		cfg, err := loadConfig(o)
+		if err == nil {
+			err = applyConfig(withRemote(cfg))
+		}
+		if err != nil {
+			Errorf("Error reloading configuration, keeping the previous one: %v", err)
+			continue
+		}
+		Infof("Reloaded configuration from %s", o.path)
+	}
+}
@@ -3,8 +3,11 @@ module xprobe_agent
 go 1.23.2
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.13.6
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/shirou/gopsutil/v3 v3.24.5
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+// Identity 为 agent 第一次运行时在状态目录生成的身份，重新安装 agent 后保持不变
+type Identity struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+	// Fingerprint 为生成身份时的机器指纹
+	Fingerprint string `json:"fingerprint"`
+	// FingerprintVersion 为计算 Fingerprint 的方式，旧版本的指纹包含网卡 MAC 地址
+	FingerprintVersion int       `json:"fingerprintVersion,omitempty"`
+	CreatedAt          time.Time `json:"createdAt"`
+
+	key ed25519.PrivateKey
+}
+
+// IdentityReport 为随静态数据上报的身份信息
+type IdentityReport struct {
+	AgentID   string `json:"agentId"`
+	PublicKey string `json:"publicKey"`
+	// Fingerprint 为当前的机器指纹
+	Fingerprint string `json:"fingerprint"`
+	// StateFingerprint 为生成身份时的机器指纹，与 Fingerprint 不同说明状态目录是从其他机器复制过来的
+	StateFingerprint string `json:"stateFingerprint"`
+}
+
+const (
+	identityFile = "identity.json"
+	keyFile      = "identity.key"
+	// fingerprintVersion 为当前计算机器指纹的方式
+	fingerprintVersion = 2
+)
+
+var (
+	identity           *Identity
+	currentFingerprint string
+)
+
+// defaultStateDir 返回各平台保存 agent 状态的默认目录
+func defaultStateDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, "xprobe")
+		}
+		return `C:\ProgramData\xprobe`
+	case "darwin":
+		return "/Library/Application Support/xprobe"
+	}
+	return "/var/lib/xprobe"
+}
+
+// stateDir 创建并返回状态目录，没有权限时使用当前用户的配置目录
+func stateDir() (string, error) {
+	dir := conf().StateDir
+	if dir == "" {
+		dir = defaultStateDir()
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err == nil {
+		return dir, nil
+	}
+	if conf().StateDir != "" || !errors.Is(err, fs.ErrPermission) {
+		return "", fmt.Errorf("creating state directory: %v", err)
+	}
+
+	userDir, uerr := os.UserConfigDir()
+	if uerr != nil {
+		return "", err
+	}
+	Warnf("Cannot create state directory %s, using the user config directory instead: %v", dir, err)
+	dir = filepath.Join(userDir, "xprobe")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("creating state directory: %v", err)
+	}
+	return dir, nil
+}
+
+// loadIdentity 读取状态目录 dir 中的身份，不存在时生成新的身份。
+// 机器指纹与生成时不同时保留原来的身份，由服务端判断是否为克隆的机器
+func loadIdentity(dir string) (*Identity, string, error) {
+	fingerprint := machineFingerprint()
+
+	id, err := readIdentity(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		id, err = newIdentity(fingerprint)
+		if err == nil {
+			err = writeIdentity(dir, id)
+		}
+		if err == nil {
+			Infof("Generated agent identity %s in %s", id.ID, dir)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if id.FingerprintVersion < fingerprintVersion {
+		// 计算方式变化后在原来的机器上重新记录指纹，否则所有升级的 agent 都会被判断为克隆
+		id.Fingerprint, id.FingerprintVersion = fingerprint, fingerprintVersion
+		if err := writeIdentity(dir, id); err != nil {
+			return nil, "", err
+		}
+	}
+	if id.Fingerprint != fingerprint {
+		Warnf("Machine fingerprint differs from the one recorded in %s, this machine may be a clone", dir)
+	}
+	return id, fingerprint, nil
+}
+
+func readIdentity(dir string) (*Identity, error) {
+	data, err := os.ReadFile(filepath.Join(dir, identityFile))
+	if err != nil {
+		return nil, err
+	}
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", identityFile, err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, keyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("parsing %s: no PEM data", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", keyFile, err)
+	}
+	var ok bool
+	if id.key, ok = key.(ed25519.PrivateKey); !ok {
+		return nil, fmt.Errorf("parsing %s: not an ed25519 key", keyFile)
+	}
+	if base64.StdEncoding.EncodeToString(id.key.Public().(ed25519.PublicKey)) != id.PublicKey {
+		return nil, fmt.Errorf("%s does not match the public key in %s", keyFile, identityFile)
+	}
+	return &id, nil
+}
+
+func newIdentity(fingerprint string) (*Identity, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		ID:                 uuid,
+		PublicKey:          base64.StdEncoding.EncodeToString(pub),
+		Fingerprint:        fingerprint,
+		FingerprintVersion: fingerprintVersion,
+		CreatedAt:          time.Now().UTC(),
+		key:                key,
+	}, nil
+}
+
+func writeIdentity(dir string, id *Identity) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, keyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, identityFile), data, 0o644)
+}
+
+// writeFileAtomic 先写入临时文件再重命名，避免中途退出留下不完整的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newUUID 生成随机的 UUID v4
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], nil
+}
+
+// machineFingerprint 根据硬件 UUID 和系统的 machine-id 计算机器指纹。克隆的虚拟机通常会得到新的
+// 硬件 UUID，但会带上原来的状态目录。不使用网卡 MAC 地址，它会随网卡增减、容器和虚拟网络变化
+func machineFingerprint() string {
+	sum := sha256.Sum256([]byte(strings.Join(machineIDs(), "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// machineIDs 返回硬件 UUID 和系统的 machine-id。
+// Linux 上不使用 gopsutil 的 HostID，因为它在读不到这两个文件时会返回每次开机都会变化的 boot_id
+func machineIDs() []string {
+	if runtime.GOOS != "linux" {
+		id, _ := host.HostID()
+		return []string{id}
+	}
+	var ids []string
+	for _, path := range []string{"/sys/class/dmi/id/product_uuid", "/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if id := strings.ToLower(strings.TrimSpace(string(data))); id != "" {
+			ids = append(ids, id)
+		}
+		// 两个 machine-id 文件通常是同一个
+		if strings.HasSuffix(path, "machine-id") {
+			break
+		}
+	}
+	return ids
+}
+
+// identityReport 返回随静态数据上报的身份信息
+func identityReport() *IdentityReport {
+	if identity == nil {
+		return nil
+	}
+	return &IdentityReport{
+		AgentID:          identity.ID,
+		PublicKey:        identity.PublicKey,
+		Fingerprint:      currentFingerprint,
+		StateFingerprint: identity.Fingerprint,
+	}
+}
+
+// sign 用身份私钥对请求体签名
+func sign(body []byte) string {
+	if identity == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(identity.key, body))
+}
+
+// nodeID 返回上报使用的节点 ID：配置了节点密钥时为密钥，否则为 agent 身份的 ID
+func nodeID() string {
+	if t := conf().Token; t != "" {
+		return t
+	}
+	return identity.ID
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LevelDebug int32 = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(LevelInfo)
+}
+
+// SetLogLevel 设置日志级别，可选 debug、info、warn、error
+func SetLogLevel(level string) {
+	switch strings.ToLower(level) {
+	case "debug":
+		logLevel.Store(LevelDebug)
+	case "warn":
+		logLevel.Store(LevelWarn)
+	case "error":
+		logLevel.Store(LevelError)
+	default:
+		logLevel.Store(LevelInfo)
+	}
+}
+
+func DebugEnabled() bool {
+	return logLevel.Load() <= LevelDebug
+}
+
+func logf(level int32, prefix, format string, args ...interface{}) {
+	if logLevel.Load() > level {
+		return
+	}
+	log.Printf(prefix+format, args...)
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, "[DEBUG] ", format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, "[INFO] ", format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, "[WARN] ", format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, "[ERROR] ", format, args...)
+}
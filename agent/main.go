@@ -2,16 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/load"
@@ -23,54 +30,6 @@ import (
 	"github.com/shirou/gopsutil/v3/process"
 )
 
-type NetworkSpeed struct {
-	Download uint64
-	Upload   uint64
-}
-
-var (
-	currentSpeed NetworkSpeed
-	speedMutex   sync.RWMutex
-)
-
-func init() {
-	go maintainNetworkSpeed()
-}
-
-func maintainNetworkSpeed() {
-	for {
-		downloadSpeed, uploadSpeed, err := getCurrentNetworkSpeed()
-		if err == nil {
-			speedMutex.Lock()
-			currentSpeed = NetworkSpeed{
-				Download: downloadSpeed,
-				Upload:   uploadSpeed,
-			}
-			speedMutex.Unlock()
-		}
-		time.Sleep(time.Second)
-	}
-}
-
-func getCurrentNetworkSpeed() (uint64, uint64, error) {
-	initialStats, err := psnet.IOCounters(false)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	time.Sleep(time.Second)
-
-	finalStats, err := psnet.IOCounters(false)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	downloadSpeed := finalStats[0].BytesRecv - initialStats[0].BytesRecv
-	uploadSpeed := finalStats[0].BytesSent - initialStats[0].BytesSent
-
-	return downloadSpeed, uploadSpeed, nil
-}
-
 type ServerStaticData struct {
 	ID             string `json:"id"`
 	HostName       string `json:"hostName"`
@@ -90,6 +49,10 @@ type ServerStaticData struct {
 	MemoryTotal    string `json:"memoryTotal"`
 	DiskTotal      string `json:"diskTotal"`
 	UpDateTime     string `json:"upDateTime"`
+	// Identity 为 agent 的持久身份，服务端据此发现共用状态目录的克隆机器
+	Identity *IdentityReport `json:"identity,omitempty"`
+	// Agent 为 agent 的版本和能采集的数据
+	Agent *AgentInfo `json:"agent,omitempty"`
 }
 
 func getLocalIPs() (string, string, string) {
@@ -113,25 +76,26 @@ func getLocalIPs() (string, string, string) {
 	return strings.Join(ips, ","), strings.Join(ipv4, ","), strings.Join(ipv6, ",")
 }
 
-func getServerStaticData() (ServerStaticData, error) {
-	hostInfo, err := host.Info()
+// getServerStaticData 采集静态数据，ctx 在超过 collectors.static.timeout 后取消
+func getServerStaticData(ctx context.Context) (ServerStaticData, error) {
+	hostInfo, err := host.InfoWithContext(ctx)
 	if err != nil {
 		return ServerStaticData{}, err
 	}
 
-	memInfo, err := mem.VirtualMemory()
+	memInfo, err := mem.VirtualMemoryWithContext(ctx)
 	if err != nil {
 		return ServerStaticData{}, err
 	}
 
-	diskInfo, err := getDiskInfo()
+	diskInfo, err := getDiskInfo(ctx)
 	if err != nil {
 		return ServerStaticData{}, err
 	}
 
 	ipv4Supported, ipv6Supported := checkIPSupport()
 
-	publicIpv4, publicIpv6, err := getPublicIP()
+	publicIpv4, publicIpv6, err := getPublicIP(ctx)
 	if err != nil {
 		publicIpv4 = "Unknown"
 		publicIpv6 = "Unknown"
@@ -140,7 +104,7 @@ func getServerStaticData() (ServerStaticData, error) {
 	isNAT := checkNAT(publicIpv4, ipv4)
 
 	data := ServerStaticData{
-		ID:             NodeId,
+		ID:             nodeID(),
 		HostName:       hostInfo.Hostname,
 		OSName:         hostInfo.OS,
 		OSVersion:      hostInfo.PlatformVersion,
@@ -157,6 +121,8 @@ func getServerStaticData() (ServerStaticData, error) {
 		MemoryTotal:    fmt.Sprint(memInfo.Total),
 		DiskTotal:      fmt.Sprint(diskInfo.Total),
 		UpDateTime:     time.Now().Format(time.RFC3339),
+		Identity:       identityReport(),
+		Agent:          agentInfo(),
 	}
 
 	return data, nil
@@ -177,9 +143,11 @@ func checkNAT(publicIP, localIPs string) bool {
 }
 
 func ReportStatic() {
-	staticData, err := getServerStaticData()
+	staticData, wait, err := collectWithTimeout("static", getServerStaticData)
+	// 超时的采集返回之前不开始下一次上报
+	defer wait()
 	if err != nil {
-		fmt.Println("Error getting server static info", err)
+		Errorf("Error getting server static info: %v", err)
 		return
 	}
 	Report("api/report/static", staticData)
@@ -188,16 +156,30 @@ func ReportStatic() {
 func ReportDynamic() {
 	dynamicData, err := getServerDynamicData()
 	if err != nil {
-		fmt.Println("Error getting server dynamic info", err)
+		Errorf("Error getting server dynamic info: %v", err)
 		return
 	}
-	Report("api/report/dynamic", dynamicData)
+	dynamicData.Seq = newSeq()
+	if conf().Batch.Enabled {
+		batchQueue <- dynamicData
+		return
+	}
+	reportSpooled(dynamicPath, dynamicData)
 }
 
+// SafeReportDynamic 按上报间隔上报动态数据。上报时间按固定的节拍计算，不受每次上报耗时的影响
 func SafeReportDynamic() {
+	// 等待 CPU 使用率和网络速度等需要两次采样的采集项，避免第一次上报的数据为零
+	latest.wait(2 * conf().Interval.D())
+	next := time.Now()
 	for {
+		time.Sleep(time.Until(next))
 		ReportDynamic()
-		time.Sleep(1 * time.Second)
+		interval := conf().Interval.D()
+		next = next.Add(interval)
+		if now := time.Now(); next.Before(now) {
+			next = now.Add(interval)
+		}
 	}
 }
 
@@ -215,92 +197,181 @@ type ServerDynamicData struct {
 	UDPCount        int        `json:"udpCount"`
 	ProcessCount    int        `json:"processCount"`
 	ThreadCount     int        `json:"threadCount"`
+	// Timestamp 为采集时间，补报的数据按这个时间保存
+	Timestamp time.Time `json:"timestamp"`
+	// Seq 为递增的序号，服务端据此对重试的数据去重
+	Seq    uint64        `json:"seq"`
+	Probes []ProbeResult `json:"probes,omitempty"`
+	// ConfigVersion 为正在使用的服务端配置版本
+	ConfigVersion string `json:"configVersion,omitempty"`
+	// BootTime 为开机时间 (Unix 秒)，服务端据此区分重启和计数器变小
+	BootTime int64 `json:"bootTime,omitempty"`
+	// TrafficScope 为参与统计累计流量的网卡集合的摘要，网卡增减或过滤条件变化时改变
+	TrafficScope string `json:"trafficScope,omitempty"`
 }
 
+// getServerDynamicData 从采集项最近一次的结果生成动态数据，不等待采集
 func getServerDynamicData() (ServerDynamicData, error) {
-	loadAvg, err := load.Avg()
-	if err != nil {
-		return ServerDynamicData{}, err
-	}
+	data := latest.dynamic()
+	data.ID = nodeID()
+	data.Timestamp = time.Now()
+	data.ConfigVersion = conf().remoteVersion
+	return data, nil
+}
 
-	cpuUsage, err := getCPUUsage()
-	if err != nil {
-		return ServerDynamicData{}, err
-	}
+func ReportDetail() {
 
-	memInfo, err := mem.VirtualMemory()
-	if err != nil {
-		return ServerDynamicData{}, err
-	}
+}
 
-	diskInfo, err := getDiskInfo()
+// activeServer 为最近一次上报成功的服务端在 Servers 中的下标
+var activeServer atomic.Int32
+
+func ApiPath(server, path string) string {
+	ret, _ := url.JoinPath(server, path)
+	return ret
+}
+
+// rejectedError 为服务端返回的错误状态
+type rejectedError struct {
+	status int
+	body   string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("server rejected report with status %d: %s", e.status, e.body)
+}
+
+// encodeReport 把上报数据编码为 JSON
+func encodeReport(path string, data interface{}) ([]byte, error) {
+	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return ServerDynamicData{}, err
+		Errorf("Error marshalling JSON: %v", err)
+		return nil, err
 	}
+	Debugf("Report %s: %s", path, jsonData)
+	return jsonData, nil
+}
 
-	networkInfo, err := getNetworkInfo()
+// Report 上报数据，失败时不重试
+func Report(path string, data interface{}) error {
+	jsonData, err := encodeReport(path, data)
 	if err != nil {
-		return ServerDynamicData{}, err
+		return err
 	}
-
-	tcpCount, udpCount, err := getConnectionCounts()
+	err = send(path, jsonData)
 	if err != nil {
-		return ServerDynamicData{}, err
+		Errorf("Error reporting %s: %v", path, err)
 	}
+	return err
+}
 
-	processCount, threadCount, err := getProcessAndThreadCounts()
+// reportSpooled 上报数据，服务端不可达时写入 spool 稍后补报。
+// spool 中还有没有补报的数据时直接追加到末尾，保证服务端按时间顺序收到
+func reportSpooled(path string, data interface{}) {
+	jsonData, err := encodeReport(path, data)
 	if err != nil {
-		return ServerDynamicData{}, err
+		return
 	}
-
-	speedMutex.RLock()
-	speed := currentSpeed
-	speedMutex.RUnlock()
-
-	data := ServerDynamicData{
-		ID:              NodeId,
-		Load:            [3]float64{loadAvg.Load1, loadAvg.Load5, loadAvg.Load15},
-		CPUUsage:        cpuUsage,
-		MemoryUsed:      memInfo.Used,
-		DiskUsed:        diskInfo.Used,
-		NetworkDownload: speed.Download,
-		NetworkUpload:   speed.Upload,
-		TrafficUpload:   networkInfo.BytesSent,
-		TrafficDownload: networkInfo.BytesRecv,
-		TCPCount:        tcpCount,
-		UDPCount:        udpCount,
-		ProcessCount:    processCount,
-		ThreadCount:     threadCount,
+	spooling := outbox != nil && conf().Spool.Enabled
+	if spooling && outbox.pending() {
+		err = outbox.append(path, jsonData)
+		if err != nil {
+			Errorf("Error writing report to spool: %v", err)
+		}
+		return
 	}
 
-	return data, nil
+	err = send(path, jsonData)
+	if err == nil {
+		return
+	}
+	if !spooling || !retryable(err) {
+		Errorf("Error reporting %s: %v", path, err)
+		return
+	}
+	Warnf("Server unreachable, spooling reports until it recovers: %v", err)
+	if err := outbox.append(path, jsonData); err != nil {
+		Errorf("Error writing report to spool: %v", err)
+	}
 }
 
-func ReportDetail() {
+// retryable 表示上报失败的原因是否是暂时的: 连接失败、5xx、408 和 429
+func retryable(err error) bool {
+	var rejected *rejectedError
+	if !errors.As(err, &rejected) {
+		return true
+	}
+	return rejected.status >= 500 || rejected.status == http.StatusRequestTimeout || rejected.status == http.StatusTooManyRequests
+}
 
+// send 上报 JSON 编码后的数据，批量数据由 sendBatch 处理
+func send(path string, jsonData []byte) error {
+	if path == batchPath {
+		return sendBatch(jsonData)
+	}
+	return sendTo(path, jsonData)
 }
 
-var (
-	reportInterval = 1 * time.Second
-	Host           = "http://127.0.0.1:8080" // 替换为实际的报告地址
-	NodeId         = "default_test"
-)
+// sendTo 优先通过 WebSocket 连接上报，连接不可用时从最近一次成功的服务端开始
+// 依次尝试 HTTP 上报，直到有一个服务端接受，遇到不能重试的错误时直接返回
+func sendTo(path string, jsonData []byte) error {
+	if ok, err := streamSend(path, jsonData); ok {
+		if err == nil {
+			confirmUpdate()
+		}
+		return err
+	}
 
-func ApiPath(path string) string {
-	ret, _ := url.JoinPath(Host, path)
-	return ret
+	var err error
+	servers := conf().Servers
+	start := int(activeServer.Load())
+	for i := range servers {
+		n := (start + i) % len(servers)
+		err = post(servers[n], path, jsonData)
+		if err == nil {
+			activeServer.Store(int32(n))
+			confirmUpdate()
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+		Debugf("Error reporting to %s: %v", servers[n], err)
+	}
+	return err
 }
 
-func Report(path string, data interface{}) error {
-	jsonData, err := json.Marshal(data)
+func post(server, path string, jsonData []byte) error {
+	body, encoding := jsonData, ""
+	if path == batchPath {
+		var err error
+		if body, encoding, err = compress(jsonData); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, ApiPath(server, path), bytes.NewReader(body))
 	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
 		return err
 	}
-	fmt.Println("report", path, "with", string(jsonData))
-	url := ApiPath(path)
-	_, err = http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	return err
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	// 签名针对压缩前的数据
+	req.Header.Set("X-Agent-Signature", sign(jsonData))
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	// 读完剩余的响应体，连接才能复用
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &rejectedError{status: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	checkConfigVersion(msg)
+	return nil
 }
 
 func SafeRun(call func()) (err error) {
@@ -315,54 +386,238 @@ func SafeRun(call func()) (err error) {
 
 func SafeReportStatic() {
 	for {
+		if !conf().Collectors.Static.Enabled {
+			time.Sleep(staticInterval())
+			continue
+		}
 		err := SafeRun(func() {
 			ReportStatic()
 		})
 		if err != nil {
-			fmt.Println("Reporting static data with err", err)
+			Errorf("Reporting static data with err: %v", err)
+		}
+		select {
+		case <-time.After(staticInterval()):
+		case <-reportStaticNow:
 		}
-		time.Sleep(1 * time.Second)
 	}
 }
 
-func main() {
-	flag.DurationVar(&reportInterval, "i", 1*time.Second, "Report interval")
-	flag.Parse()
+// staticInterval 返回静态数据的上报间隔，未开启时每分钟检查一次配置是否变化
+func staticInterval() time.Duration {
+	c := conf().Collectors.Static
+	if !c.Enabled || c.Interval <= 0 {
+		return time.Minute
+	}
+	return c.Interval.D()
+}
 
-	args := flag.Args()
-	if len(args) >= 1 {
-		Host = args[0]
+// exitStartup 在启动失败时退出，刚更新到这个版本时先换回原来的版本
+func exitStartup(code int, reason string, dirs []string) {
+	rollbackOnFatal(fmt.Sprintf("version %s failed to start: %s", version, reason), dirs...)
+	os.Exit(code)
+}
+
+func main() {
+	o, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
 	}
-	if len(args) >= 2 {
-		NodeId = args[1]
+	if err != nil {
+		// 新版本不再支持原来的参数
+		exitStartup(2, err.Error(), startupStateDirs(o, nil))
+	}
+	if o.version {
+		fmt.Println(version)
+		return
+	}
+	cfg, err := loadConfig(o)
+	if o.check {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		exitStartup(2, err.Error(), startupStateDirs(o, cfg))
 	}
+	// 没有配置节点密钥时用身份的 ID 作为节点 ID，此时身份是必需的
+	dir, err := stateDir()
+	if err == nil {
+		identity, currentFingerprint, err = loadIdentity(dir)
+	}
+	if err != nil {
+		if conf().Token == "" {
+			fmt.Fprintln(os.Stderr, "Error loading agent identity:", err)
+			exitStartup(1, err.Error(), append([]string{dir}, startupStateDirs(o, cfg)...))
+		}
+		Errorf("Error loading agent identity, reporting without it: %v", err)
+	}
+	// 连上服务端之前先使用上一次保存的服务端配置
+	loadRemote(dir)
+	if err := applyConfig(withRemote(cfg)); err != nil {
+		Errorf("Error applying saved server config: %v", err)
+	}
+	switch o.command {
+	case "collect":
+		os.Exit(runCollect(o.once))
+	case "test-connection":
+		os.Exit(testConnection())
+	}
+	initUpdate(dir)
+	initSeq(dir)
+	if dir != "" {
+		if outbox, err = openSpool(filepath.Join(dir, "spool")); err != nil {
+			Errorf("Error opening spool, reports will be lost while the server is unreachable: %v", err)
+		} else {
+			go outbox.replay()
+		}
+	}
+	go watchConfig(o)
+	go runRemoteConfig(o)
+	go runUpdater()
+	startCollectors()
 
 	go SafeReportStatic()
+	go runBatcher()
+	go runStream()
 	go SafeReportDynamic()
 	select {}
 }
 
-func getCPUUsage() (float64, error) {
-	percentage, err := cpu.Percent(time.Second, false)
+// cpuCollector 由两次采样之间的 CPU 时间计算使用率
+type cpuCollector struct {
+	prev *cpu.TimesStat
+}
+
+func (c *cpuCollector) Name() string { return "cpu" }
+
+func (c *cpuCollector) Collect(ctx context.Context) (func(*ServerDynamicData), error) {
+	times, err := cpu.TimesWithContext(ctx, false)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if len(percentage) > 0 {
-		return percentage[0], nil
+	if len(times) == 0 {
+		return nil, fmt.Errorf("no CPU usage data available")
 	}
-	return 0, fmt.Errorf("no CPU usage data available")
+	cur := times[0]
+	prev := c.prev
+	c.prev = &cur
+	if prev == nil {
+		return nil, errWarmingUp
+	}
+
+	busy := func(t *cpu.TimesStat) float64 { return t.Total() - t.Idle - t.Iowait }
+	total := cur.Total() - prev.Total()
+	var usage float64
+	if total > 0 {
+		usage = math.Min(100, math.Max(0, (busy(&cur)-busy(prev))/total*100))
+	}
+	return func(d *ServerDynamicData) { d.CPUUsage = usage }, nil
+}
+
+func collectLoad(ctx context.Context) (func(*ServerDynamicData), error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(d *ServerDynamicData) { d.Load = [3]float64{avg.Load1, avg.Load5, avg.Load15} }, nil
+}
+
+func collectMemory(ctx context.Context) (func(*ServerDynamicData), error) {
+	m, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(d *ServerDynamicData) { d.MemoryUsed = m.Used }, nil
+}
+
+func collectDisk(ctx context.Context) (func(*ServerDynamicData), error) {
+	info, err := getDiskInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(d *ServerDynamicData) { d.DiskUsed = info.Used }, nil
+}
+
+// networkCollector 采集累计流量，并由两次采样之间的流量计算速度 (字节/秒)
+type networkCollector struct {
+	prev      psnet.IOCountersStat
+	prevScope string
+	prevAt    time.Time
 }
 
-func getDiskInfo() (struct{ Used, Total uint64 }, error) {
-	partitions, err := disk.Partitions(false)
+func (c *networkCollector) Name() string { return "network" }
+
+func (c *networkCollector) Collect(ctx context.Context) (func(*ServerDynamicData), error) {
+	cur, scope, err := getNetworkInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 读不到开机时间时不上报，服务端按旧版本 agent 处理
+	boot, _ := host.BootTimeWithContext(ctx)
+	now := time.Now()
+	prev, elapsed := c.prev, now.Sub(c.prevAt).Seconds()
+	first, sameScope := c.prevAt.IsZero(), scope == c.prevScope
+	c.prev, c.prevScope, c.prevAt = cur, scope, now
+	if first {
+		return nil, errWarmingUp
+	}
+
+	var download, upload uint64
+	// 网卡增减或过滤条件变化时计数器不连续，这一次不计算速度
+	if elapsed > 0 && sameScope && cur.BytesRecv >= prev.BytesRecv && cur.BytesSent >= prev.BytesSent {
+		download = uint64(float64(cur.BytesRecv-prev.BytesRecv) / elapsed)
+		upload = uint64(float64(cur.BytesSent-prev.BytesSent) / elapsed)
+	}
+	return func(d *ServerDynamicData) {
+		d.NetworkDownload, d.NetworkUpload = download, upload
+		d.TrafficDownload, d.TrafficUpload = cur.BytesRecv, cur.BytesSent
+		d.BootTime, d.TrafficScope = int64(boot), scope
+	}, nil
+}
+
+func collectConnections(ctx context.Context) (func(*ServerDynamicData), error) {
+	tcp, udp, err := getConnectionCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(d *ServerDynamicData) { d.TCPCount, d.UDPCount = tcp, udp }, nil
+}
+
+func collectProcesses(ctx context.Context) (func(*ServerDynamicData), error) {
+	processCount, threadCount, err := getProcessAndThreadCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(d *ServerDynamicData) { d.ProcessCount, d.ThreadCount = processCount, threadCount }, nil
+}
+
+func collectProbes(ctx context.Context) (func(*ServerDynamicData), error) {
+	results := runProbes(ctx)
+	return func(d *ServerDynamicData) { d.Probes = results }, nil
+}
+
+func getDiskInfo(ctx context.Context) (struct{ Used, Total uint64 }, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, false)
 	if err != nil {
 		return struct{ Used, Total uint64 }{}, err
 	}
 
 	var totalUsed, totalSpace uint64
 
+	filter := conf().Disks
 	for _, partition := range partitions {
-		usage, err := disk.Usage(partition.Mountpoint)
+		if !filter.Match(partition.Mountpoint, partition.Device) {
+			continue
+		}
+		usage, err := disk.UsageWithContext(ctx, partition.Mountpoint)
 		if err != nil {
 			continue
 		}
@@ -374,17 +629,32 @@ func getDiskInfo() (struct{ Used, Total uint64 }, error) {
 	return struct{ Used, Total uint64 }{totalUsed, totalSpace}, nil
 }
 
-func getNetworkInfo() (psnet.IOCountersStat, error) {
-	ioCounters, err := psnet.IOCounters(false)
+// getNetworkInfo 返回通过网卡过滤的所有网卡的累计流量，以及这些网卡名的摘要
+func getNetworkInfo(ctx context.Context) (psnet.IOCountersStat, string, error) {
+	ioCounters, err := psnet.IOCountersWithContext(ctx, true)
 	if err != nil {
-		return psnet.IOCountersStat{}, err
+		return psnet.IOCountersStat{}, "", err
 	}
-
-	if len(ioCounters) > 0 {
-		return ioCounters[0], nil
+	if len(ioCounters) == 0 {
+		return psnet.IOCountersStat{}, "", fmt.Errorf("no network data available")
 	}
 
-	return psnet.IOCountersStat{}, fmt.Errorf("no network data available")
+	filter := conf().Interfaces
+	total := psnet.IOCountersStat{Name: "all"}
+	var names []string
+	for _, c := range ioCounters {
+		if !filter.Match(c.Name) {
+			continue
+		}
+		names = append(names, c.Name)
+		total.BytesRecv += c.BytesRecv
+		total.BytesSent += c.BytesSent
+		total.PacketsRecv += c.PacketsRecv
+		total.PacketsSent += c.PacketsSent
+	}
+	sort.Strings(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return total, hex.EncodeToString(sum[:8]), nil
 }
 
 const (
@@ -392,8 +662,8 @@ const (
 	UDP uint32 = 2
 )
 
-func getConnectionCounts() (int, int, error) {
-	conns, err := psnet.Connections("all")
+func getConnectionCounts(ctx context.Context) (int, int, error) {
+	conns, err := psnet.ConnectionsWithContext(ctx, "all")
 	if err != nil {
 		return 0, 0, err
 	}
@@ -412,8 +682,8 @@ func getConnectionCounts() (int, int, error) {
 	return tcpCount, udpCount, nil
 }
 
-func getProcessAndThreadCounts() (int, int, error) {
-	processes, err := process.Processes()
+func getProcessAndThreadCounts(ctx context.Context) (int, int, error) {
+	processes, err := process.ProcessesWithContext(ctx)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -422,7 +692,10 @@ func getProcessAndThreadCounts() (int, int, error) {
 	threadCount := 0
 
 	for _, p := range processes {
-		numThreads, err := p.NumThreads()
+		if ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+		numThreads, err := p.NumThreadsWithContext(ctx)
 		if err == nil {
 			threadCount += int(numThreads)
 		}
@@ -473,28 +746,36 @@ func formatDuration(d time.Duration) string {
 	return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
 }
 
-func getIP(url string) (string, error) {
-	resp, err := http.Get(url)
+// getIP 通过 url 查询本机的公网 IP，使用与上报相同的代理和 TLS 设置
+func getIP(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
 
-	ip, err := io.ReadAll(resp.Body)
+	ip, err := io.ReadAll(io.LimitReader(resp.Body, 256))
 	if err != nil {
 		return "", err
 	}
 
-	return string(ip), nil
+	return strings.TrimSpace(string(ip)), nil
 }
 
-func getPublicIP() (string, string, error) {
-	ipv4, err := getIP("https://api.ipify.org")
+func getPublicIP(ctx context.Context) (string, string, error) {
+	ipv4, err := getIP(ctx, "https://api.ipify.org")
 	if err != nil {
 		ipv4 = "Unknown"
 	}
 
-	ipv6, err := getIP("https://api6.ipify.org")
+	ipv6, err := getIP(ctx, "https://api6.ipify.org")
 	if err != nil {
 		ipv6 = "Unknown"
 	}
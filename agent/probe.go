@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// probeTimeout 为一次 TCP 连接测试的超时时间
+const probeTimeout = 5 * time.Second
+
+type ProbeResult struct {
+	Name string `json:"name"`
+	// Latency 为建立连接的耗时 (毫秒)，失败时为 0
+	Latency float64 `json:"latency"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// runProbes 并发地对所有探测目标建立 TCP 连接，返回每个目标的耗时或错误
+func runProbes(ctx context.Context) []ProbeResult {
+	probes := conf().Probes
+	if len(probes) == 0 {
+		return nil
+	}
+	results := make([]ProbeResult, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p ProbeConfig) {
+			defer wg.Done()
+			results[i].Name = p.Name
+			start := time.Now()
+			dialer := net.Dialer{Timeout: probeTimeout}
+			conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].Latency = float64(time.Since(start).Microseconds()) / 1000
+			conn.Close()
+		}(i, p)
+	}
+	wg.Wait()
+	return results
+}
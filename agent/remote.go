@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const remoteConfigPath = "api/report/config"
+
+// remoteConfig 为服务端下发的配置，覆盖本地配置文件中的对应项，格式与服务端 agentconf.Settings 相同
+type remoteConfig struct {
+	Version string `json:"version"`
+	Config  struct {
+		Interval   string `json:"interval,omitempty"`
+		Collectors map[string]struct {
+			Enabled  *bool  `json:"enabled,omitempty"`
+			Interval string `json:"interval,omitempty"`
+		} `json:"collectors,omitempty"`
+		Probes []ProbeConfig `json:"probes,omitempty"`
+	} `json:"config"`
+}
+
+var (
+	// remote 为最近一次获取的服务端配置，为 nil 表示没有
+	remote atomic.Pointer[remoteConfig]
+	// remoteFile 为保存服务端配置的文件，重启后在连上服务端之前也使用这份配置
+	remoteFile string
+	// rejectedVersion 为合并后无效的服务端配置版本，服务端修改之前不再获取
+	rejectedVersion atomic.Value
+	fetchConfig     = make(chan struct{}, 1)
+)
+
+// loadRemote 读取状态目录 dir 中保存的服务端配置
+func loadRemote(dir string) {
+	if dir == "" {
+		return
+	}
+	remoteFile = filepath.Join(dir, "remote-config.json")
+	data, err := os.ReadFile(remoteFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			Warnf("Error reading saved server config: %v", err)
+		}
+		return
+	}
+	var r remoteConfig
+	if err := json.Unmarshal(data, &r); err != nil {
+		Warnf("Ignoring corrupted server config %s: %v", remoteFile, err)
+		return
+	}
+	remote.Store(&r)
+}
+
+// apply 把服务端配置覆盖到本地配置 local 上，返回新的配置，合并后无效时返回错误
+func (r *remoteConfig) apply(local *Config) (*Config, error) {
+	cfg := *local
+	cfg.remoteVersion = r.Version
+	c := r.Config
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("interval: %v", err)
+		}
+		cfg.Interval = Duration(d)
+	}
+	for name, rc := range c.Collectors {
+		p := cfg.Collectors.ref(name)
+		if p == nil {
+			// 新版本服务端支持而本 agent 不支持的采集项
+			Debugf("Ignoring unknown collector %q in server config", name)
+			continue
+		}
+		if rc.Enabled != nil {
+			p.Enabled = *rc.Enabled
+		}
+		if rc.Interval != "" {
+			d, err := time.ParseDuration(rc.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("collectors.%s.interval: %v", name, err)
+			}
+			p.Interval = Duration(d)
+		}
+	}
+	if len(c.Probes) > 0 {
+		cfg.Probes = c.Probes
+	}
+	return &cfg, cfg.Validate()
+}
+
+// withRemote 返回合并了服务端配置的配置，服务端配置无效时只使用本地配置
+func withRemote(local *Config) *Config {
+	r := remote.Load()
+	if r == nil || r.Version == "" {
+		return local
+	}
+	cfg, err := r.apply(local)
+	if err != nil {
+		Errorf("Ignoring invalid server config %s: %v", r.Version, err)
+		return local
+	}
+	return cfg
+}
+
+// checkConfigVersion 处理上报响应，响应中的 configVersion 与正在使用的版本不同时获取新的配置。
+// 旧版本服务端的响应中没有 configVersion
+func checkConfigVersion(body []byte) {
+	var resp struct {
+		ConfigVersion *string `json:"configVersion"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.ConfigVersion == nil {
+		return
+	}
+	v := *resp.ConfigVersion
+	if v == conf().remoteVersion || v == rejectedVersion.Load() {
+		return
+	}
+	select {
+	case fetchConfig <- struct{}{}:
+	default:
+	}
+}
+
+// runRemoteConfig 在服务端配置版本变化时获取并应用新的配置
+func runRemoteConfig(o options) {
+	for range fetchConfig {
+		if err := syncRemote(o); err != nil {
+			Warnf("Error fetching server config: %v", err)
+			// 避免服务端持续出错时每次上报都请求一次
+			time.Sleep(jitter(time.Minute))
+		}
+	}
+}
+
+func syncRemote(o options) error {
+	r, err := getRemote()
+	if err != nil {
+		return err
+	}
+	if r.Version == conf().remoteVersion {
+		return nil
+	}
+	local, err := loadConfig(o)
+	if err != nil {
+		return fmt.Errorf("local configuration is invalid: %v", err)
+	}
+
+	cfg := local
+	if r.Version != "" {
+		if cfg, err = r.apply(local); err != nil {
+			rejectedVersion.Store(r.Version)
+			Errorf("Server config %s is invalid, keeping the current configuration: %v", r.Version, err)
+			return nil
+		}
+	}
+	if err := applyConfig(cfg); err != nil {
+		rejectedVersion.Store(r.Version)
+		return err
+	}
+	remote.Store(r)
+	saveRemote(r)
+	if r.Version == "" {
+		Infof("Server config removed, using the local configuration")
+	} else {
+		Infof("Applied server config version %s", r.Version)
+	}
+	return nil
+}
+
+// getRemote 从最近一次上报成功的服务端获取节点的配置
+func getRemote() (*remoteConfig, error) {
+	resp, err := httpClient().Get(ApiPath(currentServer(), remoteConfigPath) + "?id=" + url.QueryEscape(nodeID()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var r remoteConfig
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func saveRemote(r *remoteConfig) {
+	if remoteFile == "" {
+		return
+	}
+	if r.Version == "" {
+		os.Remove(remoteFile)
+		return
+	}
+	data, _ := json.Marshal(r)
+	if err := writeFileAtomic(remoteFile, data, 0o600); err != nil {
+		Warnf("Error saving server config: %v", err)
+	}
+}
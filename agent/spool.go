@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool 为服务端不可达时保存上报数据的磁盘队列。记录按顺序追加到若干个段文件中，每行一条；
+// 补报时从最旧的段开始依次发送，发送到的位置保存在 cursor 文件中，重启后继续补报
+type spool struct {
+	mu       sync.Mutex
+	dir      string
+	segments []segment // 从旧到新
+	w        *os.File  // 最新一个段的写入句柄，为 nil 时下一次写入新建一个段
+	// offset 为 segments[0] 中下一条要发送的记录的位置
+	offset int64
+	wake   chan struct{}
+}
+
+type segment struct {
+	seq  int64
+	size int64
+}
+
+type spoolRecord struct {
+	Path string          `json:"path"`
+	At   time.Time       `json:"at"`
+	Data json.RawMessage `json:"data"`
+}
+
+const (
+	cursorFile    = "cursor"
+	segmentSuffix = ".spool"
+	// 段文件大小的上限，实际取 maxSize 的 1/8 和它中较小的一个，保证超出时可以按段丢弃
+	maxSegmentSize = 4 << 20
+
+	minReplayBackoff = time.Second
+	maxReplayBackoff = 5 * time.Minute
+)
+
+// outbox 为 nil 表示没有可用的状态目录，失败的上报直接丢弃
+var outbox *spool
+
+// openSpool 打开 dir 中的队列，不存在时创建
+func openSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, wake: make(chan struct{}, 1)}
+	for _, e := range entries {
+		name := e.Name()
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if !strings.HasSuffix(name, segmentSuffix) || err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	// cursor 之前的段已经发送完，只是没来得及删除
+	if seq, offset, err := s.readCursor(); err == nil {
+		for len(s.segments) > 0 && s.segments[0].seq < seq {
+			s.removeOldest()
+		}
+		if len(s.segments) > 0 && s.segments[0].seq == seq {
+			s.offset = offset
+		}
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (s *spool) readCursor() (seq, offset int64, err error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = fmt.Sscan(string(data), &seq, &offset)
+	return seq, offset, err
+}
+
+// saveCursor 记录发送位置，调用方需持有 s.mu。写入失败时重启后最多重复补报一个段
+func (s *spool) saveCursor() {
+	if len(s.segments) == 0 {
+		os.Remove(filepath.Join(s.dir, cursorFile))
+		return
+	}
+	data := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.offset)
+	if err := os.WriteFile(filepath.Join(s.dir, cursorFile), []byte(data), 0o600); err != nil {
+		Warnf("Error saving spool cursor: %v", err)
+	}
+}
+
+// removeOldest 删除最旧的段，调用方需持有 s.mu
+func (s *spool) removeOldest() {
+	if len(s.segments) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	if err := os.Remove(s.segmentPath(s.segments[0].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		Warnf("Error removing spool segment: %v", err)
+	}
+	s.segments = s.segments[1:]
+	s.offset = 0
+}
+
+// append 把一次上报追加到队列末尾，超过 maxSize 时丢弃最旧的段
+func (s *spool) append(path string, data []byte) error {
+	line, err := json.Marshal(spoolRecord{Path: path, At: time.Now(), Data: data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	cfg := conf().Spool
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segmentSize := min(int64(cfg.MaxSize)/8, maxSegmentSize)
+	if s.w == nil || s.segments[len(s.segments)-1].size >= segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.w.Write(line)
+	s.segments[len(s.segments)-1].size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	dropped := 0
+	for total > int64(cfg.MaxSize) && len(s.segments) > 1 {
+		total -= s.segments[0].size
+		s.removeOldest()
+		dropped++
+	}
+	if dropped > 0 {
+		Warnf("Spool is larger than %s, dropped %d oldest segments", formatBytes(uint64(cfg.MaxSize)), dropped)
+		s.saveCursor()
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate 关闭当前的段并新建一个段，调用方需持有 s.mu
+func (s *spool) rotate() error {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	seq := time.Now().UnixNano()
+	if n := len(s.segments); n > 0 && seq <= s.segments[n-1].seq {
+		seq = s.segments[n-1].seq + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.w = f
+	s.segments = append(s.segments, segment{seq: seq})
+	return nil
+}
+
+// pending 表示队列中是否还有没有发送的记录
+func (s *spool) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) > 1 || (len(s.segments) == 1 && s.offset < s.segments[0].size)
+}
+
+// peek 返回下一条要发送的记录、记录所在段的序号及其占用的字节数，已经发送完的段在这里删除
+func (s *spool) peek() (rec spoolRecord, seq, n int64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.offset >= seg.size {
+			// 最新的段发送完后也删除，下一次写入新建一个段
+			s.removeOldest()
+			s.saveCursor()
+			continue
+		}
+
+		line, err := s.readLine(seg)
+		if err != nil {
+			// 段的末尾是意外退出时没有写完的记录，或者文件已经损坏，跳过这个段剩下的内容
+			Warnf("Skipping unreadable spool data: %v", err)
+			s.offset = seg.size
+			continue
+		}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			Warnf("Skipping corrupted spool record: %v", err)
+			s.offset += int64(len(line))
+			continue
+		}
+		return rec, seg.seq, int64(len(line)), true
+	}
+	return rec, 0, 0, false
+}
+
+func (s *spool) readLine(seg segment) ([]byte, error) {
+	f, err := os.Open(s.segmentPath(seg.seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(io.NewSectionReader(f, s.offset, seg.size-s.offset)).ReadBytes('\n')
+	if err == io.EOF {
+		return nil, errors.New("truncated record")
+	}
+	return line, err
+}
+
+// advance 在 peek 返回的记录发送完成 (或放弃) 后移动发送位置。seq 为记录所在段的序号，
+// 发送期间 append 超过大小上限丢弃了这个段时，发送位置已经指向新的最旧段，不再移动
+func (s *spool) advance(seq, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 || s.segments[0].seq != seq {
+		return
+	}
+	s.offset += n
+	s.saveCursor()
+}
+
+// replay 按顺序补报队列中的记录，失败时指数退避
+func (s *spool) replay() {
+	backoff := minReplayBackoff
+	expired := 0
+	for {
+		rec, seq, n, ok := s.peek()
+		if !ok {
+			<-s.wake
+			continue
+		}
+		if time.Since(rec.At) > conf().Spool.MaxAge.D() {
+			expired++
+			s.advance(seq, n)
+			continue
+		}
+		if expired > 0 {
+			Warnf("Dropped %d spooled reports older than %s", expired, conf().Spool.MaxAge.D())
+			expired = 0
+		}
+
+		err := send(rec.Path, rec.Data)
+		if err == nil || !retryable(err) {
+			if err != nil {
+				Warnf("Dropping spooled report: %v", err)
+			}
+			s.advance(seq, n)
+			backoff = minReplayBackoff
+			continue
+		}
+
+		Debugf("Replaying spooled reports failed, retrying in %s: %v", backoff, err)
+		time.Sleep(jitter(backoff))
+		backoff = min(backoff*2, maxReplayBackoff)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// useSpoolConfig 使用 maxSize 作为队列大小上限，测试结束后恢复原来的配置
+func useSpoolConfig(t *testing.T, maxSize Size) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Spool.MaxSize = maxSize
+	prev := current.Swap(&active{cfg: cfg})
+	t.Cleanup(func() {
+		if prev == nil {
+			current.Store(&active{cfg: DefaultConfig()})
+			return
+		}
+		current.Store(prev)
+	})
+}
+
+func appendRecords(t *testing.T, s *spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.append("api/report/dynamic", []byte(fmt.Sprintf(`{"i":%d}`, i))); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+// consume 依次发送 n 条记录，返回记录的序号
+func consume(t *testing.T, s *spool, n int) []int {
+	t.Helper()
+	var got []int
+	for len(got) < n {
+		rec, seq, size, ok := s.peek()
+		if !ok {
+			break
+		}
+		var v struct{ I int }
+		if err := json.Unmarshal(rec.Data, &v); err != nil {
+			t.Fatalf("decoding record: %v", err)
+		}
+		got = append(got, v.I)
+		s.advance(seq, size)
+	}
+	return got
+}
+
+func TestSpoolReplayAcrossReopen(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize Size
+		records int
+		// sent 为重新打开之前已经发送的记录数
+		sent int
+		// dropped 为 true 时最旧的记录会因为超过大小上限被丢弃
+		dropped bool
+		// rotated 为 true 时记录应写入多个段
+		rotated bool
+	}{
+		{name: "single segment", maxSize: 64 << 10, records: 10, sent: 4},
+		{name: "rotated segments", maxSize: 64 << 10, records: 400, sent: 150, rotated: true},
+		{name: "all sent", maxSize: 64 << 10, records: 5, sent: 5},
+		{name: "oldest dropped", maxSize: 800, records: 30, dropped: true, rotated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSpoolConfig(t, tt.maxSize)
+			dir := t.TempDir()
+			s, err := openSpool(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendRecords(t, s, 0, tt.records)
+			if got := consume(t, s, tt.sent); len(got) != tt.sent || (tt.sent > 0 && got[0] != 0) {
+				t.Fatalf("sent %v before reopening, want 0..%d", got, tt.sent-1)
+			}
+			if rotated := len(s.segments) > 1; rotated != tt.rotated {
+				t.Errorf("got %d segments, rotated = %v, want %v", len(s.segments), rotated, tt.rotated)
+			}
+
+			s, err = openSpool(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := consume(t, s, tt.records)
+			if s.pending() {
+				t.Error("spool still has pending records after replaying everything")
+			}
+
+			if !tt.dropped {
+				if len(got) != tt.records-tt.sent {
+					t.Fatalf("replayed %d records after reopening, want %d", len(got), tt.records-tt.sent)
+				}
+				for i, v := range got {
+					if v != tt.sent+i {
+						t.Fatalf("replayed %v, want %d..%d in order", got, tt.sent, tt.records-1)
+					}
+				}
+				return
+			}
+			// 丢弃最旧的段后剩下的是最新的一段连续记录
+			if len(got) == 0 || len(got) >= tt.records {
+				t.Fatalf("replayed %d of %d records, want the oldest dropped", len(got), tt.records)
+			}
+			for i, v := range got {
+				if v != tt.records-len(got)+i {
+					t.Fatalf("replayed %v, want the newest records in order", got)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolAdvanceAfterDrop(t *testing.T) {
+	// 每个段只放得下一条记录，超过大小上限时按段丢弃
+	useSpoolConfig(t, 800)
+	s, err := openSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 2)
+
+	// 发送第一条记录期间写入的记录把它所在的段挤出了队列
+	_, seq, n, ok := s.peek()
+	if !ok {
+		t.Fatal("spool is empty")
+	}
+	appendRecords(t, s, 2, 30)
+	if s.segments[0].seq == seq {
+		t.Fatal("the segment being sent was not dropped")
+	}
+	first := s.segments[0].seq
+	s.advance(seq, n)
+	if s.segments[0].seq != first || s.offset != 0 {
+		t.Fatalf("stale advance moved the cursor to segment %d offset %d", s.segments[0].seq, s.offset)
+	}
+
+	got := consume(t, s, 30)
+	if len(got) == 0 || got[len(got)-1] != 29 {
+		t.Fatalf("replayed %v, want records up to 29", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] != got[i-1]+1 {
+			t.Fatalf("replayed %v, records were skipped", got)
+		}
+	}
+}
+
+func TestSpoolSkipsTruncatedRecord(t *testing.T) {
+	useSpoolConfig(t, 64<<10)
+	dir := t.TempDir()
+	s, err := openSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 3)
+
+	// 模拟写入最后一条记录时意外退出
+	path := s.segmentPath(s.segments[0].seq)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := consume(t, s, 3); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("replayed %v, want [0 1]", got)
+	}
+	if s.pending() {
+		t.Error("truncated record is still pending")
+	}
+}
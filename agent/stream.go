@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamMessage 为 WebSocket 连接上的一条消息，格式与服务端 stream.Message 相同
+type streamMessage struct {
+	Type      string          `json:"type"`
+	ID        uint64          `json:"id"`
+	Path      string          `json:"path,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Status    int             `json:"status,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+const (
+	streamPath = "api/report/stream"
+	// ackTimeout 内没有收到服务端的确认时断开连接，改用 HTTP 重发
+	ackTimeout          = 30 * time.Second
+	streamWriteTimeout  = 10 * time.Second
+	streamReadTimeout   = 2 * time.Minute
+	minStreamBackoff    = time.Second
+	maxStreamBackoff    = 5 * time.Minute
+	streamCheckInterval = 5 * time.Second
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// agentStream 为到服务端的 WebSocket 连接，上报和命令结果共用
+type agentStream struct {
+	server  string
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+	nextID  atomic.Uint64
+	mu      sync.Mutex
+	pending map[uint64]chan streamMessage
+	closed  chan struct{}
+}
+
+// activeStream 为当前可用的连接，为 nil 时上报使用 HTTP
+var activeStream atomic.Pointer[agentStream]
+
+// jitter 返回 [d/2, d) 之间的随机时长，避免服务端恢复时所有 agent 同时重试
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// runStream 在开启 stream 时维持到服务端的连接，断开后指数退避重连
+func runStream() {
+	backoff := minStreamBackoff
+	for {
+		if !conf().Stream.Enabled {
+			time.Sleep(streamCheckInterval)
+			continue
+		}
+		s, err := dialStream()
+		if err != nil {
+			Debugf("Error connecting stream, retrying in %s: %v", backoff, err)
+			time.Sleep(jitter(backoff))
+			backoff = min(backoff*2, maxStreamBackoff)
+			continue
+		}
+		backoff = minStreamBackoff
+		Infof("Connected stream to %s", s.server)
+
+		activeStream.Store(s)
+		err = s.serve()
+		activeStream.CompareAndSwap(s, nil)
+		s.close()
+		Warnf("Stream to %s disconnected, reporting over HTTP until it reconnects: %v", s.server, err)
+	}
+}
+
+// dialStream 从最近一次成功的服务端开始依次尝试建立连接
+func dialStream() (*agentStream, error) {
+	transport, _ := httpClient().Transport.(*http.Transport)
+	dialer := websocket.Dialer{
+		HandshakeTimeout:  10 * time.Second,
+		EnableCompression: true,
+	}
+	if transport != nil {
+		dialer.Proxy = transport.Proxy
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+
+	var err error
+	servers := conf().Servers
+	start := int(activeServer.Load())
+	for i := range servers {
+		server := servers[(start+i)%len(servers)]
+		var u *url.URL
+		u, err = url.Parse(ApiPath(server, streamPath))
+		if err != nil {
+			continue
+		}
+		u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+
+		var ws *websocket.Conn
+		var resp *http.Response
+		ws, resp, err = dialer.Dial(u.String(), streamHeaders())
+		if err == nil {
+			return &agentStream{server: server, ws: ws, pending: map[uint64]chan streamMessage{}, closed: make(chan struct{})}, nil
+		}
+		if resp != nil {
+			err = fmt.Errorf("%v (status %d)", err, resp.StatusCode)
+		}
+		Debugf("Error connecting stream to %s: %v", server, err)
+	}
+	return nil, err
+}
+
+// streamHeaders 返回连接认证的请求头: 节点密钥，以及身份私钥对节点 ID 和时间戳的签名
+func streamHeaders() http.Header {
+	h := http.Header{}
+	if token := conf().Token; token != "" {
+		h.Set("Authorization", "Bearer "+token)
+	}
+	if identity != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		h.Set("X-Agent-Node", nodeID())
+		h.Set("X-Agent-Timestamp", ts)
+		h.Set("X-Agent-Signature", sign([]byte(nodeID()+"\n"+ts)))
+	}
+	return h
+}
+
+// serve 读取服务端的消息直到连接断开，服务端每 30 秒发送一次 ping
+func (s *agentStream) serve() error {
+	s.ws.SetReadLimit(16 << 20)
+	s.ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	s.ws.SetPingHandler(func(data string) error {
+		s.ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		return s.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(streamWriteTimeout))
+	})
+
+	for {
+		if !conf().Stream.Enabled {
+			return errors.New("stream disabled")
+		}
+		var m streamMessage
+		if err := s.ws.ReadJSON(&m); err != nil {
+			return err
+		}
+		s.ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+
+		switch m.Type {
+		case "ack":
+			s.mu.Lock()
+			ch, ok := s.pending[m.ID]
+			delete(s.pending, m.ID)
+			s.mu.Unlock()
+			if ok {
+				ch <- m
+			}
+		case "command":
+			go s.handleCommand(m)
+		}
+	}
+}
+
+func (s *agentStream) write(m streamMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return s.ws.WriteJSON(m)
+}
+
+func (s *agentStream) close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	close(s.closed)
+	pending := s.pending
+	s.pending = map[uint64]chan streamMessage{}
+	s.mu.Unlock()
+
+	for _, ch := range pending {
+		close(ch)
+	}
+	s.ws.Close()
+}
+
+// report 通过连接上报并等待服务端确认
+func (s *agentStream) report(path string, jsonData []byte) error {
+	id := s.nextID.Add(1)
+	ch := make(chan streamMessage, 1)
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return errStreamClosed
+	default:
+	}
+	s.pending[id] = ch
+	s.mu.Unlock()
+
+	err := s.write(streamMessage{Type: "report", ID: id, Path: path, Data: jsonData, Signature: sign(jsonData)})
+	if err != nil {
+		s.close()
+		return errStreamClosed
+	}
+
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	select {
+	case ack, ok := <-ch:
+		if !ok {
+			return errStreamClosed
+		}
+		if ack.Status < 200 || ack.Status > 299 {
+			return &rejectedError{status: ack.Status, body: ack.Error}
+		}
+		checkConfigVersion(ack.Data)
+		return nil
+	case <-timer.C:
+		// 服务端可能已经保存了这次上报，改用 HTTP 重发时按序号去重
+		s.close()
+		return errStreamClosed
+	}
+}
+
+// streamSend 通过 WebSocket 连接上报，ok 为 false 表示连接不可用，调用方应改用 HTTP
+func streamSend(path string, jsonData []byte) (ok bool, err error) {
+	s := activeStream.Load()
+	if s == nil {
+		return false, nil
+	}
+	err = s.report(path, jsonData)
+	if errors.Is(err, errStreamClosed) {
+		return false, nil
+	}
+	return true, err
+}
+
+// handleCommand 执行服务端下发的命令并返回结果
+func (s *agentStream) handleCommand(m streamMessage) {
+	result := streamMessage{Type: "result", ID: m.ID}
+	data, err := runCommand(m.Name, m.Data)
+	if err != nil {
+		result.Error = err.Error()
+	} else if result.Data, err = json.Marshal(data); err != nil {
+		result.Error = err.Error()
+	}
+	if err := s.write(result); err != nil {
+		Debugf("Error sending command result: %v", err)
+	}
+}
+
+// runCommand 执行命令: ping 返回 agent 时间，collect 返回各采集项最近一次的结果，report-static 立即上报静态数据
+func runCommand(name string, args json.RawMessage) (interface{}, error) {
+	Infof("Received command %q from server", name)
+	switch name {
+	case "ping":
+		return map[string]interface{}{"time": time.Now()}, nil
+	case "collect":
+		return getServerDynamicData()
+	case "report-static":
+		go ReportStatic()
+		return map[string]string{"message": "static report scheduled"}, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", name)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	updatePath = "api/report/update"
+	// maxUpdateStarts 为新版本没有上报成功之前最多启动的次数，新版本反复崩溃时不等到超时就换回
+	maxUpdateStarts = 3
+	// downloadTimeout 为下载一个构建的最长时间
+	downloadTimeout = 10 * time.Minute
+)
+
+// updateInfo 为服务端推送的更新，格式与服务端 agentupdate.Update 相同
+type updateInfo struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// updateState 为进行中的更新，保存在状态目录的 update.json 中
+type updateState struct {
+	// From 为更新前的版本，To 为更新到的版本，没有进行中的更新时都为空
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Deadline 之前新版本没有上报成功时换回原来的版本
+	Deadline time.Time `json:"deadline"`
+	Starts   int       `json:"starts,omitempty"`
+	// Failed 为换回过的版本，服务端推送其他版本之前不再更新到这个版本
+	Failed string `json:"failed,omitempty"`
+	// Rejected 为无法运行或版本号不符的构建 (版本和 SHA-256)，服务端提供其他构建之前不再下载
+	Rejected string `json:"rejected,omitempty"`
+}
+
+var (
+	updateMu    sync.Mutex
+	updateFile  string
+	update      updateState
+	updateReady = make(chan struct{})
+)
+
+// executable 返回当前运行的 agent 程序的路径
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func saveUpdateState() {
+	data, _ := json.Marshal(update)
+	if err := writeFileAtomic(updateFile, data, 0o600); err != nil {
+		Warnf("Error saving update state: %v", err)
+	}
+}
+
+// initUpdate 读取状态目录 dir 中的更新状态。刚更新到这个版本时开始计时，
+// 超时前没有上报成功则换回原来的版本
+func initUpdate(dir string) {
+	if dir == "" {
+		return
+	}
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	updateFile = filepath.Join(dir, "update.json")
+	if data, err := os.ReadFile(updateFile); err == nil {
+		if err := json.Unmarshal(data, &update); err != nil {
+			Warnf("Ignoring corrupted update state: %v", err)
+			update = updateState{}
+		}
+	}
+	close(updateReady)
+	if update.To == "" {
+		return
+	}
+	if update.To != version {
+		// 程序被手动替换过
+		update.From, update.To, update.Starts = "", "", 0
+		saveUpdateState()
+		return
+	}
+
+	update.Starts++
+	saveUpdateState()
+	if update.Starts > maxUpdateStarts || time.Now().After(update.Deadline) {
+		rollback(fmt.Sprintf("version %s did not report successfully", version))
+		return
+	}
+	deadline := update.Deadline
+	Infof("Updated from %s to %s, waiting for a successful report until %s", update.From, version, deadline.Format(time.RFC3339))
+	go func() {
+		time.Sleep(time.Until(deadline))
+		updateMu.Lock()
+		defer updateMu.Unlock()
+		if update.To != "" {
+			rollback(fmt.Sprintf("no successful report within %s", conf().Update.RollbackTimeout.D()))
+		}
+	}()
+}
+
+// rollbackOnFatal 在刚更新的版本启动失败、即将退出时换回原来的版本，否则新版本会在 systemd 下反复崩溃，
+// 一直运行不到 initUpdate。这时配置可能无效，依次在可能的状态目录 dirs 中查找进行中的更新
+func rollbackOnFatal(reason string, dirs ...string) {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		file := filepath.Join(dir, "update.json")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var st updateState
+		if err := json.Unmarshal(data, &st); err != nil || st.To != version {
+			continue
+		}
+		updateMu.Lock()
+		updateFile, update = file, st
+		rollback(reason)
+		updateMu.Unlock()
+		return
+	}
+}
+
+// confirmUpdate 在上报成功后调用，结束进行中的更新
+func confirmUpdate() {
+	select {
+	case <-updateReady:
+	default:
+		return
+	}
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	if update.To == "" {
+		return
+	}
+	Infof("Update to %s confirmed", update.To)
+	update.From, update.To, update.Starts = "", "", 0
+	update.Deadline = time.Time{}
+	saveUpdateState()
+	if exe, err := executable(); err == nil {
+		os.Remove(exe + ".old")
+	}
+}
+
+// rollback 换回更新前的程序并重新启动，调用方需持有 updateMu
+func rollback(reason string) {
+	Errorf("Rolling back from %s to %s: %s", update.To, update.From, reason)
+	exe, err := executable()
+	if err == nil {
+		err = os.Rename(exe+".old", exe)
+	}
+	if err != nil {
+		Errorf("Error restoring the previous version, keeping %s: %v", version, err)
+		update.From, update.To, update.Starts = "", "", 0
+		saveUpdateState()
+		return
+	}
+	update = updateState{Failed: update.To, Rejected: update.Rejected}
+	saveUpdateState()
+	reexec(exe)
+}
+
+// runUpdater 定期向服务端检查新版本，没有状态目录时无法回滚，不自动更新
+func runUpdater() {
+	<-updateReady
+	for {
+		time.Sleep(jitter(conf().Update.CheckInterval.D()))
+		if !conf().Update.Enabled {
+			continue
+		}
+		if err := checkUpdate(); err != nil {
+			Warnf("Error updating agent: %v", err)
+		}
+	}
+}
+
+func checkUpdate() error {
+	updateMu.Lock()
+	pending, failed, rejected := update.To != "", update.Failed, update.Rejected
+	updateMu.Unlock()
+	if pending {
+		return nil
+	}
+
+	info, err := getUpdate()
+	if err != nil || info == nil {
+		return err
+	}
+	if info.Version == failed {
+		Debugf("Skipping update to %s, it was rolled back before", info.Version)
+		return nil
+	}
+	build := info.Version + "@" + strings.ToLower(info.SHA256)
+	if build == rejected {
+		Debugf("Skipping update to %s, the build failed verification before", info.Version)
+		return nil
+	}
+	Infof("Updating from %s to %s", version, info.Version)
+
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	if err := download(info, exe+".new"); err != nil {
+		os.Remove(exe + ".new")
+		return err
+	}
+	if err := checkBinary(exe+".new", info.Version); err != nil {
+		os.Remove(exe + ".new")
+		// 同一个构建再次下载结果也一样
+		updateMu.Lock()
+		update.Rejected = build
+		saveUpdateState()
+		updateMu.Unlock()
+		return err
+	}
+
+	// 先记录更新再替换程序，替换后任何时候退出，新版本启动时都会开始回滚计时
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	update = updateState{From: version, To: info.Version, Deadline: time.Now().Add(conf().Update.RollbackTimeout.D()), Failed: failed, Rejected: rejected}
+	saveUpdateState()
+	// 依次重命名，不会出现程序文件不存在或不完整的情况
+	err = os.Rename(exe, exe+".old")
+	if err == nil {
+		if err = os.Rename(exe+".new", exe); err != nil {
+			os.Rename(exe+".old", exe)
+		}
+	}
+	if err != nil {
+		os.Remove(exe + ".new")
+		update.From, update.To = "", ""
+		saveUpdateState()
+		return err
+	}
+	reexec(exe)
+	return errors.New("restarting the new version failed, it will be used after the agent restarts")
+}
+
+// getUpdate 从最近一次上报成功的服务端获取本平台的更新，没有更新时返回 nil
+func getUpdate() (*updateInfo, error) {
+	q := url.Values{"id": {nodeID()}, "os": {runtime.GOOS}, "arch": {runtime.GOARCH}, "version": {version}}
+	resp, err := httpClient().Get(ApiPath(currentServer(), updatePath) + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		// 没有更新，或者旧版本服务端不支持自动更新
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var info updateInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, err
+	}
+	if info.Version == "" || info.URL == "" || info.SHA256 == "" {
+		return nil, errors.New("incomplete update information")
+	}
+	return &info, nil
+}
+
+// download 下载构建到 path 并校验大小、SHA-256 和签名
+func download(info *updateInfo, path string) error {
+	client := *httpClient()
+	client.Timeout = downloadTimeout
+	resp, err := client.Get(ApiPath(currentServer(), info.URL))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: status %d", info.URL, resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, info.Size+1))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != info.Size {
+		return fmt.Errorf("downloaded %d bytes, expected %d", n, info.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, info.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %s, expected %s", sum, info.SHA256)
+	}
+	return verifySignature(path, info.Signature)
+}
+
+// verifySignature 在配置了 update.publicKey 时校验构建的 ed25519 签名
+func verifySignature(path, signature string) error {
+	key := conf().Update.PublicKey
+	if key == "" {
+		return nil
+	}
+	if signature == "" {
+		return errors.New("update is not signed")
+	}
+	pub, _ := base64.StdEncoding.DecodeString(key)
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// checkBinary 运行新的程序，确认可以在本机执行并且版本号正确
+func checkBinary(path, want string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("running new version: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != want {
+		return fmt.Errorf("new binary reports version %q, expected %q", got, want)
+	}
+	return nil
+}
+
+// reexec 以相同的参数启动 exe 替换当前进程。Windows 不支持 exec，启动新进程后退出
+func reexec(exe string) {
+	Infof("Restarting %s", exe)
+	if runtime.GOOS == "windows" {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			Errorf("Error restarting agent: %v", err)
+			return
+		}
+		os.Exit(0)
+	}
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		Errorf("Error restarting agent: %v", err)
+	}
+}
+
+// currentServer 返回最近一次上报成功的服务端
+func currentServer() string {
+	servers := conf().Servers
+	return servers[int(activeServer.Load())%len(servers)]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"slices"
+)
+
+var (
+	// version 为构建时通过 -ldflags "-X main.version=v1.2.3" 写入的版本号
+	version = "dev"
+	// commit 为构建时通过 -ldflags "-X main.commit=..." 写入的提交，没有写入时使用 go build 记录的 vcs.revision
+	commit = ""
+)
+
+func init() {
+	if commit != "" {
+		return
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				commit = s.Value
+			}
+		}
+	}
+}
+
+// AgentInfo 为 agent 的构建信息和能采集的数据，随静态数据上报，服务端据此隐藏节点不提供的字段
+type AgentInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goVersion"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	// Capabilities 为开启并且本平台支持的采集项
+	Capabilities []string `json:"capabilities"`
+}
+
+// unsupported 为各平台不支持的采集项
+var unsupported = map[string][]string{
+	"windows": {"load"},
+}
+
+func agentInfo() *AgentInfo {
+	return &AgentInfo{
+		Version:      version,
+		Commit:       commit,
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Capabilities: capabilities(conf()),
+	}
+}
+
+// capabilities 返回配置 cfg 下开启并且本平台支持的采集项
+func capabilities(cfg *Config) []string {
+	ret := []string{}
+	for _, name := range collectorNames {
+		if cfg.Collectors.Get(name).Enabled && !slices.Contains(unsupported[runtime.GOOS], name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,369 @@
+package agentconf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"server/db"
+	"server/health"
+	"server/util"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings 为服务端下发给 agent 的配置，覆盖 agent 本地配置文件中的对应项。
+// 节点的设置优先于所在分组 (节点标签) 的设置，都未设置的字段使用 agent 本地的配置
+type Settings struct {
+	// Interval 为动态数据的上报间隔，如 "5s"
+	Interval string `json:"interval,omitempty" bson:"interval,omitempty"`
+	// Collectors 以采集项名称为键，如 cpu、disk、probes
+	Collectors map[string]Collector `json:"collectors,omitempty" bson:"collectors,omitempty"`
+	// Probes 为 agent 定期进行 TCP 连接测试的目标，为空时继承分组或本地的设置
+	Probes []Probe `json:"probes,omitempty" bson:"probes,omitempty"`
+}
+
+type Collector struct {
+	Enabled  *bool  `json:"enabled,omitempty" bson:"enabled,omitempty"`
+	Interval string `json:"interval,omitempty" bson:"interval,omitempty"`
+}
+
+type Probe struct {
+	Name string `json:"name" bson:"name"`
+	// Address 为 host:port
+	Address string `json:"address" bson:"address"`
+}
+
+// collectorNames 为 agent 支持的采集项
+var collectorNames = map[string]bool{
+	"static": true, "cpu": true, "load": true, "memory": true, "disk": true,
+	"network": true, "connections": true, "processes": true, "probes": true,
+}
+
+// Validate 检查设置，返回所有错误
+func (s Settings) Validate() error {
+	var errs []error
+	if s.Interval != "" {
+		if d, err := time.ParseDuration(s.Interval); err != nil || d < 100*time.Millisecond {
+			errs = append(errs, errors.New("interval must be a duration of at least 100ms"))
+		}
+	}
+	for name, c := range s.Collectors {
+		if !collectorNames[name] {
+			errs = append(errs, fmt.Errorf("collectors: unknown collector %q", name))
+			continue
+		}
+		if c.Interval != "" {
+			if d, err := time.ParseDuration(c.Interval); err != nil || d < 0 {
+				errs = append(errs, fmt.Errorf("collectors.%s.interval must be a non-negative duration", name))
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range s.Probes {
+		if p.Name == "" || seen[p.Name] {
+			errs = append(errs, fmt.Errorf("probes: name %q is empty or duplicated", p.Name))
+		}
+		seen[p.Name] = true
+		if _, port, err := net.SplitHostPort(p.Address); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("probes: %q is not a host:port address", p.Address))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// IsZero 表示设置中没有任何一项
+func (s Settings) IsZero() bool {
+	return s.Interval == "" && len(s.Collectors) == 0 && len(s.Probes) == 0
+}
+
+// merge 把 o 中设置了的字段覆盖到 s 上
+func (s Settings) merge(o Settings) Settings {
+	if o.Interval != "" {
+		s.Interval = o.Interval
+	}
+	if len(o.Collectors) > 0 {
+		collectors := make(map[string]Collector, len(s.Collectors)+len(o.Collectors))
+		for name, c := range s.Collectors {
+			collectors[name] = c
+		}
+		for name, c := range o.Collectors {
+			prev := collectors[name]
+			if c.Enabled != nil {
+				prev.Enabled = c.Enabled
+			}
+			if c.Interval != "" {
+				prev.Interval = c.Interval
+			}
+			collectors[name] = prev
+		}
+		s.Collectors = collectors
+	}
+	if len(o.Probes) > 0 {
+		s.Probes = o.Probes
+	}
+	return s
+}
+
+// version 为设置的版本号，由内容计算，没有任何设置时为空
+func (s Settings) version() string {
+	if s.IsZero() {
+		return ""
+	}
+	// encoding/json 按键排序输出 map，相同的设置得到相同的版本号
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+type node struct {
+	tags     []string
+	settings Settings
+	// running 为 agent 上报的正在使用的版本
+	running string
+}
+
+const (
+	// reloadInterval 为重新读取设置的间隔，设置可能被其他实例修改
+	reloadInterval = 30 * time.Second
+)
+
+var (
+	mu     sync.Mutex
+	groups = map[string]Settings{}
+	nodes  = map[string]*node{}
+)
+
+// Start 读取分组和节点的设置并定期重新读取
+func Start(ctx context.Context, wg *sync.WaitGroup) error {
+	if err := load(ctx); err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run(ctx)
+	}()
+	return nil
+}
+
+// group 为一个分组的设置，保存在 prob.agent_config 中，_id 为节点标签
+type group struct {
+	Tag      string `bson:"_id"`
+	Settings `bson:",inline"`
+}
+
+func load(ctx context.Context) error {
+	cursor, err := db.Prob("agent_config").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var all []group
+	if err := cursor.All(ctx, &all); err != nil {
+		return err
+	}
+
+	opts := options.Find().SetProjection(bson.M{"token": 1, "tags": 1, "agentConfig": 1, "agentConfigVersion": 1})
+	cursor, err = db.Prob("node").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		Token   string   `bson:"token"`
+		Tags    []string `bson:"tags"`
+		Config  Settings `bson:"agentConfig"`
+		Running string   `bson:"agentConfigVersion"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+
+	loadedGroups := make(map[string]Settings, len(all))
+	for _, g := range all {
+		loadedGroups[g.Tag] = g.Settings
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	groups = loadedGroups
+	loaded := make(map[string]*node, len(docs))
+	for _, d := range docs {
+		n := &node{tags: d.Tags, settings: d.Config, running: d.Running}
+		// 本实例收到的上报比数据库中的新
+		if prev, ok := nodes[d.Token]; ok && prev.running != "" {
+			n.running = prev.running
+		}
+		loaded[d.Token] = n
+	}
+	nodes = loaded
+	return nil
+}
+
+func run(ctx context.Context) {
+	worker := health.Register("agentconf", 3*reloadInterval)
+	defer worker.Unregister()
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := load(ctx); err != nil {
+			worker.Fail(err)
+			util.Errorf("Error loading agent config: %v", err)
+			continue
+		}
+		worker.Beat()
+	}
+}
+
+// effective 返回节点生效的设置: 按节点标签的顺序合并分组的设置，再合并节点的设置。调用方需持有 mu
+func effective(nodeID string) Settings {
+	var s Settings
+	n, ok := nodes[nodeID]
+	if !ok {
+		return s
+	}
+	for _, tag := range n.tags {
+		s = s.merge(groups[tag])
+	}
+	return s.merge(n.settings)
+}
+
+// Effective 返回节点生效的设置及其版本号
+func Effective(nodeID string) (Settings, string) {
+	mu.Lock()
+	defer mu.Unlock()
+	s := effective(nodeID)
+	return s, s.version()
+}
+
+// Version 返回节点当前应使用的配置版本号，没有服务端配置时为空
+func Version(nodeID string) string {
+	_, v := Effective(nodeID)
+	return v
+}
+
+// SetRunning 记录 agent 上报的正在使用的配置版本，变化时写入 prob.node
+func SetRunning(nodeID, version string) {
+	mu.Lock()
+	n, ok := nodes[nodeID]
+	changed := ok && n.running != version
+	if changed {
+		n.running = version
+	}
+	mu.Unlock()
+	if !changed {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := db.Prob("node").UpdateOne(ctx, bson.M{"token": nodeID}, bson.M{"$set": bson.M{"agentConfigVersion": version}})
+		if err != nil {
+			util.Errorf("Error saving agent config version of %s: %v", nodeID, err)
+		}
+	}()
+}
+
+// SetNode 更新节点的设置，由修改设置的接口在写入数据库后调用
+func SetNode(nodeID string, s Settings) {
+	mu.Lock()
+	if n, ok := nodes[nodeID]; ok {
+		n.settings = s
+	} else {
+		nodes[nodeID] = &node{settings: s}
+	}
+	mu.Unlock()
+}
+
+// SetTags 更新节点的标签，节点所在的分组随之变化
+func SetTags(nodeID string, tags []string) {
+	mu.Lock()
+	if n, ok := nodes[nodeID]; ok {
+		n.tags = tags
+	} else {
+		nodes[nodeID] = &node{tags: tags}
+	}
+	mu.Unlock()
+}
+
+// SetGroup 保存分组的设置，设置为空时删除
+func SetGroup(ctx context.Context, tag string, s Settings) error {
+	cc := db.Prob("agent_config")
+	var err error
+	if s.IsZero() {
+		_, err = cc.DeleteOne(ctx, bson.M{"_id": tag})
+	} else {
+		_, err = cc.ReplaceOne(ctx, bson.M{"_id": tag}, group{Tag: tag, Settings: s}, options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	if s.IsZero() {
+		delete(groups, tag)
+	} else {
+		groups[tag] = s
+	}
+	mu.Unlock()
+	return nil
+}
+
+// Groups 返回所有分组的设置
+func Groups() map[string]Settings {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make(map[string]Settings, len(groups))
+	for tag, s := range groups {
+		ret[tag] = s
+	}
+	return ret
+}
+
+// NodeStatus 为节点的配置版本
+type NodeStatus struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags,omitempty"`
+	// Settings 为节点自己的设置，不包括分组的设置
+	Settings Settings `json:"settings"`
+	// Version 为节点应使用的版本，Running 为 agent 上报的正在使用的版本
+	Version  string `json:"version"`
+	Running  string `json:"running"`
+	UpToDate bool   `json:"upToDate"`
+}
+
+// Nodes 返回所有节点的配置版本，按节点 ID 排序
+func Nodes() []NodeStatus {
+	mu.Lock()
+	ret := make([]NodeStatus, 0, len(nodes))
+	for id, n := range nodes {
+		v := effective(id).version()
+		ret = append(ret, NodeStatus{ID: id, Tags: n.tags, Settings: n.settings, Version: v, Running: n.running, UpToDate: v == n.running})
+	}
+	mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// Tags 返回节点的标签
+func Tags(nodeID string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if n, ok := nodes[nodeID]; ok {
+		return append([]string(nil), n.tags...)
+	}
+	return nil
+}
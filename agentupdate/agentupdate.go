@@ -0,0 +1,220 @@
+package agentupdate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"server/agentconf"
+	"server/db"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Release 为推送给 agent 的版本和灰度比例，保存在 prob.agent_update 中
+type Release struct {
+	// Version 为 agent 构建时写入的版本号，为空时不推送更新
+	Version string `json:"version" bson:"version"`
+	// Rollout 为默认的灰度百分比 (0~100)
+	Rollout int `json:"rollout" bson:"rollout"`
+	// Groups 按节点标签设置灰度百分比，节点有多个标签时取最大值
+	Groups    map[string]int `json:"groups,omitempty" bson:"groups,omitempty"`
+	UpdatedAt time.Time      `json:"updatedAt" bson:"updatedAt"`
+}
+
+// Validate 检查版本号和灰度比例
+func (r Release) Validate() error {
+	var errs []error
+	if strings.ContainsAny(r.Version, " \t\r\n") {
+		errs = append(errs, errors.New("version must not contain whitespace"))
+	}
+	if r.Rollout < 0 || r.Rollout > 100 {
+		errs = append(errs, errors.New("rollout must be between 0 and 100"))
+	}
+	for tag, p := range r.Groups {
+		if p < 0 || p > 100 {
+			errs = append(errs, fmt.Errorf("groups.%s must be between 0 and 100", tag))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Build 为一个平台的 agent 构建
+type Build struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// URL 为相对于服务端地址的下载路径
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Signature 为 xprobe_agent.sig 中对构建的 ed25519 签名 (base64)，没有时为空
+	Signature string    `json:"signature,omitempty"`
+	ModTime   time.Time `json:"modTime"`
+}
+
+// Update 为推送给 agent 的更新
+type Update struct {
+	Version string `json:"version"`
+	Build
+}
+
+const binaryName = "xprobe_agent"
+
+var (
+	// dir 为存放 <os>/<arch>/xprobe_agent 的目录，即静态文件目录下的 agent
+	dir string
+
+	mu sync.Mutex
+	// builds 缓存构建的校验和，文件的大小和修改时间变化时重新计算
+	builds = map[string]Build{}
+
+	platformPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+)
+
+// SetDir 设置存放 agent 构建的目录
+func SetDir(d string) {
+	dir = d
+}
+
+// GetRelease 返回当前的版本和灰度比例，没有设置时 Version 为空
+func GetRelease(ctx context.Context) (Release, error) {
+	var r Release
+	err := db.Prob("agent_update").FindOne(ctx, bson.M{"_id": "release"}).Decode(&r)
+	if err == mongo.ErrNoDocuments {
+		return Release{}, nil
+	}
+	return r, err
+}
+
+// SetRelease 保存推送的版本和灰度比例
+func SetRelease(ctx context.Context, r Release) error {
+	r.UpdatedAt = time.Now()
+	_, err := db.Prob("agent_update").ReplaceOne(ctx, bson.M{"_id": "release"}, r, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Check 返回节点的 agent 应更新到的版本，不需要更新时返回 nil。
+// 节点按 ID 的哈希值落入 0~99 中的一个位置，小于节点的灰度百分比时更新，
+// 提高百分比时已经更新的节点仍在范围内
+func Check(ctx context.Context, nodeID, goos, arch, current string) (*Update, error) {
+	r, err := GetRelease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.Version == "" || r.Version == current || bucket(nodeID) >= r.rollout(agentconf.Tags(nodeID)) {
+		return nil, nil
+	}
+	b, err := build(goos, arch)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Update{Version: r.Version, Build: b}, nil
+}
+
+// rollout 返回带有 tags 标签的节点的灰度百分比
+func (r Release) rollout(tags []string) int {
+	percent := -1
+	for _, tag := range tags {
+		if p, ok := r.Groups[tag]; ok && p > percent {
+			percent = p
+		}
+	}
+	if percent < 0 {
+		return r.Rollout
+	}
+	return percent
+}
+
+func bucket(nodeID string) int {
+	sum := sha256.Sum256([]byte(nodeID))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// build 返回平台的构建，文件不存在时返回 os.ErrNotExist
+func build(goos, arch string) (Build, error) {
+	if !platformPattern.MatchString(goos) || !platformPattern.MatchString(arch) {
+		return Build{}, os.ErrNotExist
+	}
+	path := filepath.Join(dir, goos, arch, binaryName)
+	info, err := os.Stat(path)
+	if err != nil {
+		return Build{}, err
+	}
+
+	key := goos + "/" + arch
+	mu.Lock()
+	b, ok := builds[key]
+	mu.Unlock()
+	if ok && b.Size == info.Size() && b.ModTime.Equal(info.ModTime()) {
+		return b, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Build{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Build{}, err
+	}
+	b = Build{
+		OS:      goos,
+		Arch:    arch,
+		URL:     strings.Join([]string{"agent", goos, arch, binaryName}, "/"),
+		Size:    info.Size(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+		ModTime: info.ModTime(),
+	}
+	if sig, err := os.ReadFile(path + ".sig"); err == nil {
+		s := strings.TrimSpace(string(sig))
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return Build{}, fmt.Errorf("invalid signature file %s.sig: %v", path, err)
+		}
+		b.Signature = s
+	}
+
+	mu.Lock()
+	builds[key] = b
+	mu.Unlock()
+	return b, nil
+}
+
+// Builds 返回所有平台的构建，按平台排序
+func Builds() ([]Build, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "*", binaryName))
+	if err != nil {
+		return nil, err
+	}
+	ret := []Build{}
+	for _, m := range matches {
+		arch := filepath.Base(filepath.Dir(m))
+		goos := filepath.Base(filepath.Dir(filepath.Dir(m)))
+		b, err := build(goos, arch)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].URL < ret[j].URL })
+	return ret, nil
+}
@@ -0,0 +1,225 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/config"
+	"server/db"
+	"server/util"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LevelWarning  = "warning"
+	LevelCritical = "critical"
+)
+
+// Event 为一次告警，同一个 Key 在恢复之前只触发一次，保存在 prob.alerts 中
+type Event struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Key    string             `json:"key" bson:"key"`
+	NodeID string             `json:"nodeId" bson:"nodeId"`
+	// Kind 为告警类型，如 traffic_quota、traffic_forecast、capacity_disk、anomaly_tcpCount、identity_clone
+	Kind       string     `json:"kind" bson:"kind"`
+	Level      string     `json:"level" bson:"level"`
+	Message    string     `json:"message" bson:"message"`
+	Value      float64    `json:"value" bson:"value"`
+	Threshold  float64    `json:"threshold" bson:"threshold"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+}
+
+// op 为交给后台任务执行的写库和 webhook 操作
+type op struct {
+	event    Event
+	resolved bool
+}
+
+var (
+	mu     sync.Mutex
+	active = map[string]Event{}
+	ops    = make(chan op, 1024)
+	cfg    = config.Default().Alerts
+)
+
+// Start 加载未恢复的告警并启动后台任务，ctx 结束时处理完队列中剩余的操作
+func Start(ctx context.Context, c config.AlertsConfig, wg *sync.WaitGroup) error {
+	cursor, err := db.Prob("alerts").Find(ctx, bson.M{"resolvedAt": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	var events []Event
+	if err := cursor.All(ctx, &events); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	cfg = c
+	for _, e := range events {
+		active[e.Key] = e
+	}
+	mu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case o := <-ops:
+				handle(o)
+			case <-ctx.Done():
+				for {
+					select {
+					case o := <-ops:
+						handle(o)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Fire 触发告警，Key 相同的告警已经处于触发状态时忽略
+func Fire(e Event) {
+	mu.Lock()
+	if _, ok := active[e.Key]; ok {
+		mu.Unlock()
+		return
+	}
+	e.ID = primitive.NewObjectID()
+	e.CreatedAt = time.Now()
+	active[e.Key] = e
+	mu.Unlock()
+
+	util.Warnf("Alert [%s] %s: %s", e.Level, e.NodeID, e.Message)
+	enqueue(op{event: e})
+}
+
+// Resolve 在条件不再满足时恢复告警
+func Resolve(key string) {
+	mu.Lock()
+	e, ok := active[key]
+	if !ok {
+		mu.Unlock()
+		return
+	}
+	delete(active, key)
+	mu.Unlock()
+
+	now := time.Now()
+	e.ResolvedAt = &now
+	util.Infof("Alert resolved %s: %s", e.NodeID, e.Message)
+	enqueue(op{event: e, resolved: true})
+}
+
+// IsActive 表示 key 对应的告警是否处于触发状态
+func IsActive(key string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := active[key]
+	return ok
+}
+
+// Active 返回节点当前处于触发状态的告警，nodeID 为空时返回全部
+func Active(nodeID string) []Event {
+	mu.Lock()
+	ret := []Event{}
+	for _, e := range active {
+		if nodeID == "" || e.NodeID == nodeID {
+			ret = append(ret, e)
+		}
+	}
+	mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.After(ret[j].CreatedAt) })
+	return ret
+}
+
+// List 从 MongoDB 读取最近的告警记录，包括已经恢复的
+func List(ctx context.Context, nodeID string, limit int64) ([]Event, error) {
+	filter := bson.M{}
+	if nodeID != "" {
+		filter["nodeId"] = nodeID
+	}
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(limit)
+	cursor, err := db.Prob("alerts").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{}
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+func enqueue(o op) {
+	select {
+	case ops <- o:
+	default:
+		util.Errorf("Alert queue full, dropping event %s", o.event.Key)
+	}
+}
+
+func handle(o op) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var err error
+	if o.resolved {
+		_, err = db.Prob("alerts").UpdateOne(ctx, bson.M{"_id": o.event.ID}, bson.M{"$set": bson.M{"resolvedAt": o.event.ResolvedAt}})
+	} else {
+		_, err = db.Prob("alerts").InsertOne(ctx, o.event)
+	}
+	if err != nil {
+		util.Errorf("Error saving alert %s: %v", o.event.Key, err)
+	}
+
+	mu.Lock()
+	c := cfg
+	mu.Unlock()
+	if c.WebhookURL != "" {
+		if err := notify(c, o); err != nil {
+			util.Errorf("Error sending alert webhook: %v", err)
+		}
+	}
+}
+
+// notify 以 {"status": "firing"|"resolved", "alert": {...}} 的格式调用 webhook
+func notify(c config.AlertsConfig, o op) error {
+	status := "firing"
+	if o.resolved {
+		status = "resolved"
+	}
+	body, err := json.Marshal(map[string]interface{}{"status": status, "alert": o.event})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.WebhookTimeout.D())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
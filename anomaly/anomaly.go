@@ -0,0 +1,382 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"server/alert"
+	"server/client"
+	"server/config"
+	"server/db"
+	"server/health"
+	"server/util"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings 为节点单独设置的异常检测开关、灵敏度和指标，未设置的字段使用配置文件中的默认值
+type Settings struct {
+	Enabled     *bool    `json:"enabled,omitempty" bson:"enabled,omitempty"`
+	Sensitivity float64  `json:"sensitivity,omitempty" bson:"sensitivity,omitempty"`
+	Metrics     []string `json:"metrics,omitempty" bson:"metrics,omitempty"`
+}
+
+// model 为一个节点各指标的基线，保存在 prob.anomaly 中
+type model struct {
+	NodeID  string               `bson:"_id"`
+	Metrics map[string]*Baseline `bson:"metrics"`
+}
+
+const (
+	// flushInterval 为基线写入 MongoDB 的间隔
+	flushInterval = time.Minute
+	// maxHistory 为启动时每个节点最多读取的历史数据条数
+	maxHistory = 100000
+)
+
+var (
+	mu       sync.Mutex
+	defaults = config.Default().Anomaly
+	models   = map[string]*model{}
+	settings = map[string]Settings{}
+	dirty    = map[string]bool{}
+	// learning 为正在从历史数据学习基线的节点，学习完成之前不处理这些节点的新数据
+	learning = map[string]bool{}
+)
+
+// Start 加载保存的基线并开始检测新的上报，没有基线的节点在后台从历史数据学习，不阻塞服务启动。
+// 所有节点都会维护基线，开启检测后不需要重新学习
+func Start(ctx context.Context, cfg config.AnomalyConfig, wg *sync.WaitGroup) error {
+	mu.Lock()
+	defaults = cfg
+	mu.Unlock()
+
+	if err := loadModels(ctx); err != nil {
+		return err
+	}
+	if err := loadSettings(ctx); err != nil {
+		return err
+	}
+	pending, err := unlearned(ctx)
+	if err != nil {
+		return err
+	}
+	client.OnDynamic(record)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run(ctx, pending, time.Now().Add(-cfg.History.D()))
+	}()
+	return nil
+}
+
+func loadModels(ctx context.Context) error {
+	cursor, err := db.Prob("anomaly").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var all []*model
+	if err := cursor.All(ctx, &all); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range all {
+		if m.Metrics == nil {
+			m.Metrics = map[string]*Baseline{}
+		}
+		models[m.NodeID] = m
+	}
+	return nil
+}
+
+// loadSettings 读取 prob.node 中各节点的异常检测设置
+func loadSettings(ctx context.Context) error {
+	opts := options.Find().SetProjection(bson.M{"token": 1, "anomaly": 1})
+	cursor, err := db.Prob("node").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	var nodes []struct {
+		Token   string   `bson:"token"`
+		Anomaly Settings `bson:"anomaly"`
+	}
+	if err := cursor.All(ctx, &nodes); err != nil {
+		return err
+	}
+
+	loaded := make(map[string]Settings, len(nodes))
+	for _, n := range nodes {
+		loaded[n.Token] = n.Anomaly
+	}
+	mu.Lock()
+	settings = loaded
+	mu.Unlock()
+	return nil
+}
+
+// unlearned 返回还没有基线的节点并把它们标记为正在学习
+func unlearned(ctx context.Context) ([]string, error) {
+	ids, err := db.VPS("static").Distinct(ctx, "id", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var pending []string
+	for _, v := range ids {
+		id, _ := v.(string)
+		if _, ok := models[id]; id == "" || ok {
+			continue
+		}
+		learning[id] = true
+		pending = append(pending, id)
+	}
+	return pending, nil
+}
+
+// learn 用 since 之后的历史数据建立 ids 中节点的基线，出错时其余节点改为从新的上报开始学习
+func learn(ctx context.Context, ids []string, since time.Time) error {
+	mu.Lock()
+	halfLife := defaults.HalfLife.D()
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		learning = map[string]bool{}
+		mu.Unlock()
+	}()
+
+	for _, id := range ids {
+		opts := options.Find().SetSort(bson.M{"timestamp": 1}).SetLimit(maxHistory)
+		cursor, err := db.VPS("dynamic").Find(ctx, bson.M{"id": id, "timestamp": bson.M{"$gte": since}}, opts)
+		if err != nil {
+			return err
+		}
+		m := &model{NodeID: id, Metrics: map[string]*Baseline{}}
+		for cursor.Next(ctx) {
+			var d client.ServerDynamicData
+			if err := cursor.Decode(&d); err != nil {
+				continue
+			}
+			for _, name := range config.AnomalyMetrics {
+				m.baseline(name).observe(name, value(d, name), d.Timestamp, halfLife)
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		if len(m.Metrics) > 0 {
+			models[id] = m
+			dirty[id] = true
+		}
+		delete(learning, id)
+		mu.Unlock()
+	}
+	return nil
+}
+
+func (m *model) baseline(metric string) *Baseline {
+	b, ok := m.Metrics[metric]
+	if !ok {
+		b = &Baseline{}
+		m.Metrics[metric] = b
+	}
+	return b
+}
+
+func run(ctx context.Context, pending []string, since time.Time) {
+	worker := health.Register("anomaly", 3*flushInterval)
+	defer worker.Unregister()
+
+	worker.WarmUp()
+	if err := learn(ctx, pending, since); err != nil {
+		worker.Fail(err)
+		util.Errorf("Error learning anomaly baselines from history: %v", err)
+	} else {
+		worker.Beat()
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := flush(flushCtx); err != nil {
+				util.Errorf("Error saving anomaly baselines on shutdown: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+
+		err := flush(ctx)
+		if err == nil {
+			// 节点设置可能被其他实例修改，定期重新读取
+			err = loadSettings(ctx)
+		}
+		if err != nil {
+			worker.Fail(err)
+			util.Errorf("Error saving anomaly baselines: %v", err)
+			continue
+		}
+		worker.Beat()
+	}
+}
+
+// flush 把有变化的基线写入 MongoDB，失败的节点下次重试
+func flush(ctx context.Context) error {
+	mu.Lock()
+	pending := make([]model, 0, len(dirty))
+	for id := range dirty {
+		m := model{NodeID: id, Metrics: make(map[string]*Baseline, len(models[id].Metrics))}
+		for name, b := range models[id].Metrics {
+			copied := *b
+			m.Metrics[name] = &copied
+		}
+		pending = append(pending, m)
+	}
+	dirty = map[string]bool{}
+	mu.Unlock()
+
+	cc := db.Prob("anomaly")
+	for i, m := range pending {
+		_, err := cc.ReplaceOne(ctx, bson.M{"_id": m.NodeID}, m, options.Replace().SetUpsert(true))
+		if err != nil {
+			mu.Lock()
+			for _, m := range pending[i:] {
+				dirty[m.NodeID] = true
+			}
+			mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// resolved 为合并默认值之后的节点设置
+type resolved struct {
+	enabled     bool
+	sensitivity float64
+	metrics     map[string]bool
+}
+
+func effective(nodeID string) resolved {
+	r := resolved{enabled: defaults.Enabled, sensitivity: defaults.Sensitivity}
+	s := settings[nodeID]
+	if s.Enabled != nil {
+		r.enabled = *s.Enabled
+	}
+	if s.Sensitivity > 0 {
+		r.sensitivity = s.Sensitivity
+	}
+	metrics := defaults.Metrics
+	if len(s.Metrics) > 0 {
+		metrics = s.Metrics
+	}
+	r.metrics = make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		r.metrics[m] = true
+	}
+	return r
+}
+
+// record 更新节点的基线，开启检测的指标持续偏离基线超过 for 时告警
+func record(d client.ServerDynamicData) {
+	var fire []alert.Event
+	var resolve []string
+
+	mu.Lock()
+	if learning[d.ID] {
+		mu.Unlock()
+		return
+	}
+	s := effective(d.ID)
+	m, ok := models[d.ID]
+	if !ok {
+		m = &model{NodeID: d.ID, Metrics: map[string]*Baseline{}}
+		models[d.ID] = m
+	}
+	for _, name := range config.AnomalyMetrics {
+		b := m.baseline(name)
+		x := value(d, name)
+		mean, std, warm := b.Mean, b.std(name), b.N >= defaults.Warmup
+		z, ok := b.observe(name, x, d.Timestamp, defaults.HalfLife.D())
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("anomaly_%s:%s", name, d.ID)
+		if !s.enabled || !s.metrics[name] || !warm || math.Abs(z) < s.sensitivity {
+			b.abnormalSince = time.Time{}
+			if b.normalSince.IsZero() {
+				b.normalSince = d.Timestamp
+			}
+			if d.Timestamp.Sub(b.normalSince) >= defaults.For.D() || !s.enabled || !s.metrics[name] {
+				resolve = append(resolve, key)
+			}
+			continue
+		}
+
+		b.normalSince = time.Time{}
+		if b.abnormalSince.IsZero() {
+			b.abnormalSince = d.Timestamp
+		}
+		if d.Timestamp.Sub(b.abnormalSince) < defaults.For.D() {
+			continue
+		}
+		direction, bound := "above", mean+s.sensitivity*std
+		if z < 0 {
+			direction, bound = "below", mean-s.sensitivity*std
+		}
+		fire = append(fire, alert.Event{
+			Key:       key,
+			NodeID:    d.ID,
+			Kind:      "anomaly_" + name,
+			Level:     alert.LevelWarning,
+			Message:   fmt.Sprintf("%s %.4g is %.1f standard deviations %s baseline %.4g", name, x, math.Abs(z), direction, mean),
+			Value:     x,
+			Threshold: bound,
+		})
+	}
+	dirty[d.ID] = true
+	mu.Unlock()
+
+	for _, key := range resolve {
+		alert.Resolve(key)
+	}
+	for _, e := range fire {
+		alert.Fire(e)
+	}
+}
+
+// SetSettings 更新节点的异常检测设置，由设置接口在写入 MongoDB 之后调用
+func SetSettings(nodeID string, s Settings) {
+	mu.Lock()
+	settings[nodeID] = s
+	mu.Unlock()
+}
+
+// Baselines 返回节点各指标当前的基线
+func Baselines(nodeID string) map[string]Baseline {
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := models[nodeID]
+	if !ok {
+		return nil
+	}
+	ret := make(map[string]Baseline, len(m.Metrics))
+	for name, b := range m.Metrics {
+		ret[name] = *b
+	}
+	return ret
+}
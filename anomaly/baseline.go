@@ -0,0 +1,79 @@
+package anomaly
+
+import (
+	"math"
+	"server/client"
+	"time"
+)
+
+// Baseline 为一个指标按时间衰减的指数加权均值和方差
+type Baseline struct {
+	Mean float64   `json:"mean" bson:"mean"`
+	Var  float64   `json:"var" bson:"var"`
+	N    int       `json:"samples" bson:"n"`
+	At   time.Time `json:"at" bson:"at"`
+
+	// 持续异常或持续正常的开始时间，不保存
+	abnormalSince time.Time
+	normalSince   time.Time
+}
+
+// maxStep 为一次更新计入的最长时间，节点长时间离线后重新上报不会直接替换掉原来的基线
+const maxStep = time.Minute
+
+// observe 用 x 更新基线，返回更新前 x 的 z-score。
+// 时间不晚于上一次的样本 (如补报的旧数据) 不参与更新，ok 为 false
+func (b *Baseline) observe(metric string, x float64, at time.Time, halfLife time.Duration) (z float64, ok bool) {
+	if b.N == 0 {
+		b.Mean, b.Var, b.N, b.At = x, 0, 1, at
+		return 0, false
+	}
+	if !at.After(b.At) {
+		return 0, false
+	}
+	z = (x - b.Mean) / b.std(metric)
+
+	step := at.Sub(b.At)
+	if step > maxStep {
+		step = maxStep
+	}
+	alpha := 1 - math.Exp(-math.Ln2*step.Seconds()/halfLife.Seconds())
+	diff := x - b.Mean
+	incr := alpha * diff
+	b.Mean += incr
+	b.Var = (1 - alpha) * (b.Var + diff*incr)
+	b.N++
+	b.At = at
+	return z, true
+}
+
+// std 返回基线的标准差，不低于指标的最小波动和均值的 5%，避免平稳的指标稍有变化就被判为异常
+func (b *Baseline) std(metric string) float64 {
+	return math.Max(math.Sqrt(b.Var), math.Max(minStd[metric], 0.05*math.Abs(b.Mean)))
+}
+
+// minStd 为各指标标准差的下限
+var minStd = map[string]float64{
+	"cpuUsage":        2,
+	"networkDownload": 16 << 10,
+	"networkUpload":   16 << 10,
+	"tcpCount":        5,
+	"processCount":    5,
+}
+
+// value 返回动态数据中指标的值
+func value(d client.ServerDynamicData, metric string) float64 {
+	switch metric {
+	case "cpuUsage":
+		return d.CPUUsage
+	case "networkDownload":
+		return float64(d.NetworkDownload)
+	case "networkUpload":
+		return float64(d.NetworkUpload)
+	case "tcpCount":
+		return float64(d.TCPCount)
+	case "processCount":
+		return float64(d.ProcessCount)
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package capacity
+
+import (
+	"fmt"
+	"server/alert"
+	"time"
+)
+
+// checkAlerts 在预计 alertWithin 内用满且置信度足够时告警，
+// 已触发的告警在预计时间超过 alertWithin 的 1.25 倍后才恢复，避免在阈值附近反复触发
+func checkAlerts(now time.Time) {
+	mu.Lock()
+	within := cfg.AlertWithin.D()
+	minConfidence := cfg.MinConfidence
+	all := make(map[string]Report, len(reports))
+	for id, r := range reports {
+		all[id] = r
+	}
+	mu.Unlock()
+
+	for id, r := range all {
+		for _, item := range []struct {
+			name string
+			f    *Forecast
+		}{{"disk", r.Disk}, {"memory", r.Memory}} {
+			key := fmt.Sprintf("capacity_%s:%s", item.name, id)
+			f := item.f
+			if within == 0 || f == nil || f.HoursLeft == nil {
+				alert.Resolve(key)
+				continue
+			}
+			left := time.Duration(*f.HoursLeft * float64(time.Hour))
+			if alert.IsActive(key) {
+				if left > within*5/4 {
+					alert.Resolve(key)
+				}
+				continue
+			}
+			if left > within || f.Confidence < minConfidence {
+				continue
+			}
+
+			level := alert.LevelWarning
+			if left <= within/3 {
+				level = alert.LevelCritical
+			}
+			alert.Fire(alert.Event{
+				Key:       key,
+				NodeID:    id,
+				Kind:      "capacity_" + item.name,
+				Level:     level,
+				Message:   fmt.Sprintf("%s predicted full within %.0fh (at %s, confidence %.2f)", item.name, *f.HoursLeft, f.FullAt.Format(time.RFC3339), f.Confidence),
+				Value:     *f.HoursLeft,
+				Threshold: within.Hours(),
+			})
+		}
+	}
+}
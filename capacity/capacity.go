@@ -0,0 +1,292 @@
+package capacity
+
+import (
+	"context"
+	"server/client"
+	"server/config"
+	"server/db"
+	"server/health"
+	"server/util"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Forecast 为按最近的增长趋势对磁盘或内存用满时间的预测
+type Forecast struct {
+	Used  uint64 `json:"used"`
+	Total uint64 `json:"total"`
+	// GrowthPerHour 为拟合得到的每小时增长字节数，负数表示在减少
+	GrowthPerHour float64 `json:"growthPerHour"`
+	// FullAt 为按当前增长速度用满的时间，不在增长或一年内不会用满时为空
+	FullAt    *time.Time `json:"fullAt,omitempty"`
+	HoursLeft *float64   `json:"hoursLeft,omitempty"`
+	// Confidence 为拟合优度 (0~1)，用量越接近直线增长越接近 1
+	Confidence float64 `json:"confidence"`
+	// Samples 为参与拟合的数据点数，每个点为 15 分钟内的平均值
+	Samples int `json:"samples"`
+}
+
+// Report 为节点的磁盘和内存预测，总量未知的项为空
+type Report struct {
+	Disk      *Forecast `json:"disk,omitempty"`
+	Memory    *Forecast `json:"memory,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// bucket 为 bucketSize 内的用量之和
+type bucket struct {
+	Start     time.Time
+	Disk, Mem float64
+	N         int
+}
+
+const (
+	bucketSize = 15 * time.Minute
+	// minPoints 为给出预测需要的最少数据点，即 2 小时的数据
+	minPoints = 8
+	// horizon 为预测的最长时间
+	horizon = 365 * 24 * time.Hour
+)
+
+var (
+	mu      sync.Mutex
+	cfg     = config.Default().Capacity
+	series  = map[string][]bucket{}
+	totals  = map[string][2]uint64{}
+	reports = map[string]Report{}
+)
+
+// Start 开始统计新的上报，并在后台从 vps.dynamic 加载最近 window 内的用量，然后定期计算预测和检查告警。
+// 历史数据可能很多，加载期间不阻塞服务启动
+func Start(ctx context.Context, c config.CapacityConfig, wg *sync.WaitGroup) error {
+	mu.Lock()
+	cfg = c
+	mu.Unlock()
+
+	// 之后保存的数据由 record 统计，加载历史数据时跳过，避免重复计入
+	startedAt := time.Now()
+	client.OnDynamic(record)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run(ctx, c, startedAt)
+	}()
+	return nil
+}
+
+// load 按 bucketSize 聚合 since 之后、before 之前保存的历史数据，与已经统计的数据合并
+func load(ctx context.Context, since, before time.Time) error {
+	ts := bson.M{"$toLong": "$timestamp"}
+	ms := bucketSize.Milliseconds()
+	pipeline := mongo.Pipeline{
+		// _id 中包含写入时间，补报的旧数据按写入时间区分是否已经由 record 统计
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": since}, "_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(before)}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"id": "$id",
+				"t":  bson.M{"$toDate": bson.M{"$subtract": bson.A{ts, bson.M{"$mod": bson.A{ts, ms}}}}},
+			},
+			"disk": bson.M{"$sum": "$diskUsed"},
+			"mem":  bson.M{"$sum": "$memoryUsed"},
+			"n":    bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id.t": 1}}},
+	}
+	cursor, err := db.VPS("dynamic").Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		Key struct {
+			ID string    `bson:"id"`
+			T  time.Time `bson:"t"`
+		} `bson:"_id"`
+		Disk float64 `bson:"disk"`
+		Mem  float64 `bson:"mem"`
+		N    int     `bson:"n"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range rows {
+		series[r.Key.ID] = addBucket(series[r.Key.ID], bucket{Start: r.Key.T, Disk: r.Disk, Mem: r.Mem, N: r.N})
+	}
+	return nil
+}
+
+// loadTotals 从静态数据读取各节点的磁盘和内存总量
+func loadTotals(ctx context.Context) error {
+	opts := options.Find().SetProjection(bson.M{"id": 1, "diskTotal": 1, "memoryTotal": 1})
+	cursor, err := db.VPS("static").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	var all []client.ServerStaticData
+	if err := cursor.All(ctx, &all); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range all {
+		totals[s.ID] = [2]uint64{uint64(util.ParseSize(s.DiskTotal)), uint64(util.ParseSize(s.MemoryTotal))}
+	}
+	return nil
+}
+
+func run(ctx context.Context, c config.CapacityConfig, startedAt time.Time) {
+	interval := c.Interval.D()
+	worker := health.Register("capacity", 3*interval)
+	defer worker.Unregister()
+
+	// 加载失败时只用启动之后的数据预测
+	worker.WarmUp()
+	err := load(ctx, startedAt.Add(-c.Window.D()), startedAt)
+	if err == nil {
+		err = loadTotals(ctx)
+	}
+	now := time.Now()
+	compute(now)
+	checkAlerts(now)
+	if err != nil {
+		worker.Fail(err)
+		util.Errorf("Error loading capacity history: %v", err)
+	} else {
+		worker.Beat()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 读取总量失败时继续使用上一次的值
+		err := loadTotals(ctx)
+		now := time.Now()
+		compute(now)
+		checkAlerts(now)
+		if err != nil {
+			worker.Fail(err)
+			util.Errorf("Error loading node capacity: %v", err)
+			continue
+		}
+		worker.Beat()
+	}
+}
+
+// record 把一次上报计入所在的时间段，补报的旧数据插入到对应位置
+func record(d client.ServerDynamicData) {
+	b := bucket{Start: d.Timestamp.Truncate(bucketSize), Disk: float64(d.DiskUsed), Mem: float64(d.MemoryUsed), N: 1}
+
+	mu.Lock()
+	defer mu.Unlock()
+	series[d.ID] = addBucket(series[d.ID], b)
+}
+
+// addBucket 把 b 合并到按时间排序的 list 中，开始时间相同的时间段累加
+func addBucket(list []bucket, b bucket) []bucket {
+	i := sort.Search(len(list), func(i int) bool { return !list[i].Start.Before(b.Start) })
+	if i == len(list) || !list[i].Start.Equal(b.Start) {
+		list = append(list, bucket{})
+		copy(list[i+1:], list[i:])
+		list[i] = bucket{Start: b.Start}
+	}
+	list[i].Disk += b.Disk
+	list[i].Mem += b.Mem
+	list[i].N += b.N
+	return list
+}
+
+// compute 丢弃超出窗口的数据并重新计算所有节点的预测
+func compute(now time.Time) {
+	type input struct {
+		list   []bucket
+		totals [2]uint64
+	}
+
+	mu.Lock()
+	since := now.Add(-cfg.Window.D())
+	inputs := make(map[string]input, len(series))
+	for id, list := range series {
+		i := sort.Search(len(list), func(i int) bool { return !list[i].Start.Before(since) })
+		if i == len(list) {
+			delete(series, id)
+			continue
+		}
+		if i > 0 {
+			list = append([]bucket(nil), list[i:]...)
+			series[id] = list
+		}
+		inputs[id] = input{list: append([]bucket(nil), list...), totals: totals[id]}
+	}
+	mu.Unlock()
+
+	ret := make(map[string]Report, len(inputs))
+	for id, in := range inputs {
+		ret[id] = Report{
+			Disk:      forecast(in.list, func(b bucket) float64 { return b.Disk }, in.totals[0], now),
+			Memory:    forecast(in.list, func(b bucket) float64 { return b.Mem }, in.totals[1], now),
+			UpdatedAt: now,
+		}
+	}
+
+	mu.Lock()
+	reports = ret
+	mu.Unlock()
+}
+
+func forecast(list []bucket, sum func(bucket) float64, total uint64, now time.Time) *Forecast {
+	if total == 0 || len(list) == 0 {
+		return nil
+	}
+	last := list[len(list)-1]
+	f := &Forecast{Used: uint64(sum(last) / float64(last.N)), Total: total, Samples: len(list)}
+	// 已经用满时不需要拟合，置信度为 1，否则会被告警的置信度阈值过滤
+	if f.Used >= total {
+		hours := 0.0
+		f.FullAt, f.HoursLeft, f.Confidence = &now, &hours, 1
+		return f
+	}
+	if len(list) < minPoints {
+		return f
+	}
+
+	points := make([]point, len(list))
+	for i, b := range list {
+		points[i] = point{X: b.Start.Sub(list[0].Start).Hours(), Y: sum(b) / float64(b.N)}
+	}
+	f.GrowthPerHour, _, f.Confidence = fit(points)
+	if f.GrowthPerHour <= 0 {
+		return f
+	}
+	// 从当前用量开始按拟合的速度增长
+	hours := float64(total-f.Used) / f.GrowthPerHour
+	if hours > horizon.Hours() {
+		return f
+	}
+	at := now.Add(time.Duration(hours * float64(time.Hour)))
+	f.FullAt, f.HoursLeft = &at, &hours
+	return f
+}
+
+// Get 返回节点最近一次计算的预测
+func Get(nodeID string) (Report, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	r, ok := reports[nodeID]
+	return r, ok
+}
@@ -0,0 +1,72 @@
+package capacity
+
+import (
+	"math"
+	"sort"
+)
+
+// point 为一个时间段内的平均用量，X 为距离第一个点的小时数
+type point struct {
+	X, Y float64
+}
+
+// maxFitPoints 为 Theil-Sen 估计使用的最多点数，点数更多时等间隔抽样，避免两两斜率的数量过大
+const maxFitPoints = 200
+
+// fit 用 Theil-Sen 估计拟合直线 y = intercept + slope*x，返回斜率、截距和拟合优度 (0~1)。
+// 斜率取所有点对斜率的中位数，对偶尔的尖峰和清理文件造成的下跌不敏感
+func fit(points []point) (slope, intercept, confidence float64) {
+	if len(points) > maxFitPoints {
+		step := float64(len(points)-1) / float64(maxFitPoints-1)
+		sampled := make([]point, maxFitPoints)
+		for i := range sampled {
+			sampled[i] = points[int(float64(i)*step+0.5)]
+		}
+		points = sampled
+	}
+
+	slopes := make([]float64, 0, len(points)*(len(points)-1)/2)
+	for i := range points {
+		for j := i + 1; j < len(points); j++ {
+			if dx := points[j].X - points[i].X; dx > 0 {
+				slopes = append(slopes, (points[j].Y-points[i].Y)/dx)
+			}
+		}
+	}
+	if len(slopes) == 0 {
+		return 0, 0, 0
+	}
+	slope = median(slopes)
+
+	residuals := make([]float64, len(points))
+	for i, p := range points {
+		residuals[i] = p.Y - slope*p.X
+	}
+	intercept = median(residuals)
+
+	var mean, ssTot, ssRes float64
+	for _, p := range points {
+		mean += p.Y
+	}
+	mean /= float64(len(points))
+	for _, p := range points {
+		ssTot += (p.Y - mean) * (p.Y - mean)
+		r := p.Y - intercept - slope*p.X
+		ssRes += r * r
+	}
+	// 用量完全不变时无法判断趋势，置信度为 0
+	if ssTot == 0 {
+		return slope, intercept, 0
+	}
+	confidence = math.Max(0, math.Min(1, 1-ssRes/ssTot))
+	return slope, intercept, confidence
+}
+
+func median(v []float64) float64 {
+	sort.Float64s(v)
+	n := len(v)
+	if n%2 == 1 {
+		return v[n/2]
+	}
+	return (v[n/2-1] + v[n/2]) / 2
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"server/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrUnknownNode = errors.New("unknown node credential")
+
+// AuthenticateNode 校验节点凭据，即安装命令中生成的 token，首次使用时标记为已绑定。
+// 通过校验的 token 同时作为节点 ID。
+func AuthenticateNode(token string) error {
+	if token == "" {
+		return ErrUnknownNode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cc := db.Prob("node")
+	var node struct {
+		Bound bool `bson:"bound"`
+	}
+	err := cc.FindOne(ctx, bson.M{"token": token}).Decode(&node)
+	if err == mongo.ErrNoDocuments {
+		return ErrUnknownNode
+	}
+	if err != nil {
+		return err
+	}
+
+	if !node.Bound {
+		_, err = cc.UpdateOne(ctx, bson.M{"token": token, "bound": false}, bson.M{"$set": bson.M{"bound": true}})
+	}
+	return err
+}
+
+// PublicID 返回节点在公开页面中使用的 ID。节点 ID 就是节点密钥，知道它就可以替节点上报数据，
+// 状态页、节点详情、徽章和故障通知等不需要登录的接口只能使用由它派生、不能反推的公开 ID
+func PublicID(id string) string {
+	sum := sha256.Sum256([]byte("xprobe-public-id\n" + id))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// maxSignatureSkew 为签名认证时 agent 时间戳与服务端时间允许的误差
+const maxSignatureSkew = 5 * time.Minute
+
+// AuthenticateRequest 校验 agent 请求的凭据，返回节点 ID。
+// agent 用 Authorization: Bearer <节点密钥> 认证，没有节点密钥的 agent 用身份私钥对
+// "<节点ID>\n<时间戳>" 签名，放在 X-Agent-Node、X-Agent-Timestamp、X-Agent-Signature 中
+func AuthenticateRequest(r *http.Request) (string, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if err := AuthenticateNode(token); err == nil {
+			return token, nil
+		}
+	}
+
+	nodeID := r.Header.Get("X-Agent-Node")
+	ts, err := strconv.ParseInt(r.Header.Get("X-Agent-Timestamp"), 10, 64)
+	if nodeID == "" || err != nil {
+		return "", errors.New("missing node credential")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > maxSignatureSkew || d < -maxSignatureSkew {
+		return "", errors.New("timestamp is too far from server time")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	msg := []byte(nodeID + "\n" + r.Header.Get("X-Agent-Timestamp"))
+	if err := VerifyNodeSignature(ctx, nodeID, msg, r.Header.Get("X-Agent-Signature")); err != nil {
+		return "", err
+	}
+	return nodeID, nil
+}
+
+// HandleCheck 校验 agent 的凭据而不上报数据，供 agent 的 test-connection 命令诊断连接问题
+func HandleCheck(c *gin.Context) {
+	nodeID, err := AuthenticateRequest(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": nodeID, "message": "Credentials accepted"})
+}
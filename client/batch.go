@@ -0,0 +1,121 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"server/agentconf"
+	"server/db"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBatchSamples 为一批数据的条数上限
+const maxBatchSamples = 10000
+
+// HandleBatchReport 接收 agent 批量上报的动态数据，请求体为 JSON 数组，
+// 可以用 Content-Encoding: gzip 或 zstd 压缩。数据带有 agent 的采集时间和序号，
+// 重试时已经保存过的数据按节点 ID 和序号去重
+func HandleBatchReport(c *gin.Context) {
+	handleReport(c, "batch")
+}
+
+func ingestBatch(body []byte) (gin.H, error) {
+	var samples []ServerDynamicData
+	if err := json.Unmarshal(body, &samples); err != nil {
+		return nil, invalidReport(err)
+	}
+	if len(samples) > maxBatchSamples {
+		return nil, &ReportError{Status: http.StatusRequestEntityTooLarge, Reason: "invalid", Message: fmt.Sprintf("At most %d samples per batch", maxBatchSamples)}
+	}
+
+	now := time.Now()
+	for i := range samples {
+		samples[i].Timestamp = reportTimestamp(samples[i].Timestamp, now)
+	}
+	stored, err := StoreDynamicBatch(samples)
+	if err != nil {
+		return nil, &ReportError{Status: http.StatusInternalServerError, Reason: "storage", Message: "Failed to insert data"}
+	}
+	resp := gin.H{"message": "Data received and stored successfully", "stored": stored, "duplicates": len(samples) - stored}
+	if len(samples) > 0 {
+		last := samples[len(samples)-1]
+		agentconf.SetRunning(last.ID, last.ConfigVersion)
+		resp["configVersion"] = agentconf.Version(last.ID)
+	}
+	return resp, nil
+}
+
+// decodeBody 按 Content-Encoding 解压请求体
+func decodeBody(body io.Reader, encoding string) (io.Reader, func(), error) {
+	switch encoding {
+	case "", "identity":
+		return body, func() {}, nil
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, errors.New("invalid gzip body")
+		}
+		return gz, func() { gz.Close() }, nil
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxReportBody))
+		if err != nil {
+			return nil, nil, errors.New("invalid zstd body")
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
+
+// StoreDynamicBatch 保存一批动态数据，跳过已经保存过的 (节点 ID 和序号相同)，返回新保存的条数。
+// 部分数据写入失败时其余数据照常保存，返回错误由 agent 整批重试
+func StoreDynamicBatch(samples []ServerDynamicData) (int, error) {
+	if len(samples) == 0 {
+		return 0, nil
+	}
+	docs := make([]interface{}, len(samples))
+	for i := range samples {
+		docs[i] = samples[i]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := db.VPS("dynamic").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+
+	failed := map[int]bool{}
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		err = nil
+		for _, we := range bwe.WriteErrors {
+			failed[we.Index] = true
+			if !isDuplicateKey(we.Code) {
+				err = bwe
+			}
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	stored := 0
+	for i, d := range samples {
+		if failed[i] {
+			continue
+		}
+		storeLatest(d)
+		notifyDynamic(d)
+		stored++
+	}
+	return stored, err
+}
+
+func isDuplicateKey(code int) bool {
+	return code == 11000 || code == 11001 || code == 12582
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// externalState 保存 Telegraf、OTLP 等外部来源节点上一次的数据，
+// 用于补全一批数据中缺少的字段以及根据网卡计数器计算网速
+type externalState struct {
+	mu      sync.Mutex
+	dynamic ServerDynamicData
+	static  ServerStaticData
+	// 上一次的网卡累计字节数及对应时间
+	recv, sent uint64
+	counterAt  time.Time
+	// 上一次的 CPU 累计空闲时间和总时间
+	cpuIdle, cpuTotal float64
+	lastStatic        time.Time
+}
+
+// externalUpdate 为一次合并后需要保存的数据
+type externalUpdate struct {
+	dynamic    ServerDynamicData
+	static     ServerStaticData
+	hasDynamic bool
+	hasStatic  bool
+}
+
+var (
+	externalMu    sync.Mutex
+	externalNodes = map[string]*externalState{}
+)
+
+func externalNode(nodeID string) *externalState {
+	externalMu.Lock()
+	defer externalMu.Unlock()
+
+	state, ok := externalNodes[nodeID]
+	if !ok {
+		state = &externalState{}
+		externalNodes[nodeID] = state
+	}
+	return state
+}
+
+// setNetworkCounters 记录网卡累计字节数并计算网速，调用方需持有 s.mu
+func (s *externalState) setNetworkCounters(d *ServerDynamicData, recv, sent uint64, ts time.Time) {
+	// 计数器变小说明节点重启，这一轮不计算网速
+	if !s.counterAt.IsZero() && ts.After(s.counterAt) && recv >= s.recv && sent >= s.sent {
+		elapsed := ts.Sub(s.counterAt).Seconds()
+		d.NetworkDownload = uint64(float64(recv-s.recv) / elapsed)
+		d.NetworkUpload = uint64(float64(sent-s.sent) / elapsed)
+	}
+	s.recv, s.sent, s.counterAt = recv, sent, ts
+	d.TrafficDownload = recv
+	d.TrafficUpload = sent
+}
+
+// commit 补全节点 ID 等字段并保存为最新状态，调用方需持有 s.mu
+func (s *externalState) commit(nodeID, source string, ts time.Time, d ServerDynamicData, st ServerStaticData, hasDynamic bool) externalUpdate {
+	d.ID = nodeID
+	d.Timestamp = ts
+	st.ID = nodeID
+	st.Source = source
+	st.OSName = defaultString(st.OSName, "Unknown")
+	st.VendorName = defaultString(st.VendorName, "Unknown")
+	st.CountryCode = defaultString(st.CountryCode, "Unknown")
+	st.LastReportTime = time.Now()
+
+	// 静态数据变化不频繁，每分钟更新一次即可
+	hasStatic := st.LastReportTime.Sub(s.lastStatic) >= time.Minute
+	if hasStatic {
+		s.lastStatic = st.LastReportTime
+	}
+
+	s.dynamic = d
+	s.static = st
+	return externalUpdate{dynamic: d, static: st, hasDynamic: hasDynamic, hasStatic: hasStatic}
+}
+
+func (s *externalState) store(u externalUpdate) error {
+	if u.hasDynamic {
+		if err := StoreDynamic(u.dynamic); err != nil {
+			return err
+		}
+	}
+	if u.hasStatic {
+		return StoreStatic(u.static)
+	}
+	return nil
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
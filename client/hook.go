@@ -0,0 +1,25 @@
+package client
+
+import "sync"
+
+var (
+	hooksMu      sync.RWMutex
+	dynamicHooks []func(ServerDynamicData)
+)
+
+// OnDynamic 注册动态数据保存成功后的回调，回调在上报请求中同步执行，不能阻塞
+func OnDynamic(fn func(ServerDynamicData)) {
+	hooksMu.Lock()
+	dynamicHooks = append(dynamicHooks, fn)
+	hooksMu.Unlock()
+}
+
+func notifyDynamic(data ServerDynamicData) {
+	hooksMu.RLock()
+	hooks := dynamicHooks
+	hooksMu.RUnlock()
+
+	for _, fn := range hooks {
+		fn(data)
+	}
+}
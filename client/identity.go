@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"server/alert"
+	"server/db"
+	"server/util"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AgentIdentity 为 agent 在状态目录中生成的持久身份
+type AgentIdentity struct {
+	AgentID   string `json:"agentId" bson:"agentId"`
+	PublicKey string `json:"publicKey" bson:"publicKey"`
+	// Fingerprint 为当前的机器指纹，StateFingerprint 为生成身份时的机器指纹
+	Fingerprint      string `json:"fingerprint" bson:"fingerprint"`
+	StateFingerprint string `json:"stateFingerprint" bson:"stateFingerprint"`
+}
+
+const (
+	// cloneWindow 内同一个节点交替出现不同的 agent 实例时判断为克隆
+	cloneWindow = 10 * time.Minute
+	// cloneClearAfter 为最后一次冲突之后恢复克隆告警的时间
+	cloneClearAfter = time.Hour
+)
+
+// ErrInvalidSignature 表示 agent 身份签名校验失败
+var ErrInvalidSignature = errors.New("invalid agent signature")
+
+// verifyIdentity 用上报中的公钥校验 X-Agent-Signature 对请求体的签名，
+// 确认上报来自持有该身份私钥的 agent
+func verifyIdentity(id *AgentIdentity, body []byte, signature string) error {
+	pub, err := base64.StdEncoding.DecodeString(id.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return ErrInvalidSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), body, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// instance 为一个 agent 实例，即 agent ID 和机器指纹的组合
+type instance struct {
+	agentID     string
+	fingerprint string
+}
+
+type identityState struct {
+	last instance
+	seen map[instance]time.Time
+	// conflict 为最后一次冲突的时间，服务端重启后从第一次上报开始计算
+	conflict time.Time
+}
+
+var (
+	identityMu     sync.Mutex
+	identityStates = map[string]*identityState{}
+)
+
+// checkClone 判断上报的节点是否为克隆的机器，返回是否处于克隆告警状态。
+// 以下情况视为克隆:
+//   - 机器指纹与生成身份时不同，说明状态目录是从其他机器复制过来的
+//   - 同一个节点 ID 在 cloneWindow 内交替出现不同的 agent 实例，说明多台机器共用节点密钥或身份。
+//     重新安装后换了新身份的 agent 不会再切换回旧实例，不会被误判
+func checkClone(nodeID string, id *AgentIdentity, now time.Time) bool {
+	cur := instance{agentID: id.AgentID, fingerprint: id.Fingerprint}
+
+	identityMu.Lock()
+	s, ok := identityStates[nodeID]
+	if !ok {
+		s = &identityState{last: cur, seen: map[instance]time.Time{}, conflict: now}
+		identityStates[nodeID] = s
+	}
+	for inst, at := range s.seen {
+		if now.Sub(at) > cloneWindow {
+			delete(s.seen, inst)
+		}
+	}
+	var reason string
+	if id.Fingerprint != id.StateFingerprint {
+		reason = "machine fingerprint differs from the one recorded in the agent state directory"
+	} else if _, seen := s.seen[cur]; seen && cur != s.last {
+		reason = fmt.Sprintf("agent %s alternates with agent %s on the same node", cur.agentID, s.last.agentID)
+	}
+	s.seen[cur] = now
+	s.last = cur
+	if reason != "" {
+		s.conflict = now
+	}
+	conflict := s.conflict
+	identityMu.Unlock()
+
+	key := "identity_clone:" + nodeID
+	if reason != "" {
+		alert.Fire(alert.Event{
+			Key:     key,
+			NodeID:  nodeID,
+			Kind:    "identity_clone",
+			Level:   alert.LevelWarning,
+			Message: "Possible cloned machine: " + reason,
+		})
+		return true
+	}
+	if now.Sub(conflict) >= cloneClearAfter {
+		alert.Resolve(key)
+	}
+	return alert.IsActive(key)
+}
+
+// ErrKeyChanged 表示上报的 agent 公钥与节点固定的公钥不同
+var ErrKeyChanged = errors.New("agent key differs from the key pinned for this node")
+
+// pinnedKey 返回节点固定的 agent 公钥，即静态数据中保存的公钥，没有时为空
+func pinnedKey(ctx context.Context, nodeID string) (string, error) {
+	var static struct {
+		Identity *AgentIdentity `bson:"identity"`
+	}
+	err := db.VPS("static").FindOne(ctx, bson.M{"_id": nodeID}).Decode(&static)
+	if err == mongo.ErrNoDocuments || (err == nil && static.Identity == nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return static.Identity.PublicKey, nil
+}
+
+// checkPinnedKey 按首次信任 (TOFU) 校验上报的 agent 公钥: 节点第一次上报的公钥固定下来，
+// 之后只接受同一个公钥签名的静态数据。id 为 nil 表示上报没有身份信息。
+// 公钥变化 (如删除状态目录后重新安装) 时，只有上报带有节点密钥或管理员重置了公钥后才接受新的公钥
+func checkPinnedKey(ctx context.Context, nodeID string, id *AgentIdentity) error {
+	pinned, err := pinnedKey(ctx, nodeID)
+	if err != nil {
+		return err
+	}
+	if pinned == "" || (id != nil && id.PublicKey == pinned) {
+		return nil
+	}
+	// 使用节点密钥的 agent 以密钥作为节点 ID
+	if err := AuthenticateNode(nodeID); err != nil {
+		return ErrKeyChanged
+	}
+	if id != nil {
+		util.Warnf("Agent key of node %s changed, pinning the new key", nodeID)
+	}
+	return nil
+}
+
+// ResetPinnedKey 删除节点固定的 agent 公钥，节点下一次上报的公钥会重新固定
+func ResetPinnedKey(ctx context.Context, nodeID string) (bool, error) {
+	result, err := db.VPS("static").UpdateOne(ctx, bson.M{"_id": nodeID}, bson.M{"$unset": bson.M{"identity": ""}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// VerifyNodeSignature 用节点固定的 agent 公钥校验对 msg 的签名，
+// 供 WebSocket 连接等没有节点密钥的认证使用
+func VerifyNodeSignature(ctx context.Context, nodeID string, msg []byte, signature string) error {
+	var static struct {
+		Identity *AgentIdentity `bson:"identity"`
+	}
+	err := db.VPS("static").FindOne(ctx, bson.M{"_id": nodeID}).Decode(&static)
+	if err == mongo.ErrNoDocuments || (err == nil && static.Identity == nil) {
+		return ErrInvalidSignature
+	}
+	if err != nil {
+		return err
+	}
+	return verifyIdentity(static.Identity, msg, signature)
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleInfluxWrite 接收 InfluxDB line protocol 格式的数据 (/write 和 /api/v2/write)，
+// 把 Telegraf 的 cpu、mem、swap、disk、net、netstat、system、processes 指标转换为节点数据
+func HandleInfluxWrite(c *gin.Context) {
+	start := time.Now()
+	defer func() {
+		reportDuration.Observe(time.Since(start).Seconds(), "influx")
+	}()
+	reportsReceived.Inc("influx")
+
+	nodeID := nodeCredential(c)
+	if err := AuthenticateNode(nodeID); err != nil {
+		reportErrors.Inc("influx", "unauthorized")
+		if err == ErrUnknownNode {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid node credential"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate node"})
+		}
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			reportErrors.Inc("influx", "invalid")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gzip body"})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	raw, err := io.ReadAll(io.LimitReader(body, maxReportBody+1))
+	if err != nil || len(raw) > maxReportBody {
+		reportErrors.Inc("influx", "invalid")
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+
+	precision := c.Query("precision")
+	points, err := ParseLineProtocol(bytes.NewReader(raw), precision, time.Now())
+	if err != nil {
+		reportErrors.Inc("influx", "invalid")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ingestPoints(nodeID, points); err != nil {
+		reportErrors.Inc("influx", "storage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store data"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// HandleInfluxQuery 响应 Telegraf 启动时发送的 CREATE DATABASE 等查询
+func HandleInfluxQuery(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"results": []gin.H{{"statement_id": 0}}})
+}
+
+// HandleInfluxPing 响应 /ping 健康检查
+func HandleInfluxPing(c *gin.Context) {
+	c.Header("X-Influxdb-Version", "1.8-xprobe")
+	c.Status(http.StatusNoContent)
+}
+
+// nodeCredential 从外部客户端支持的各种认证方式中取出节点凭据:
+// InfluxDB v1 的 p 参数或 Basic Auth 密码，v2 的 Authorization: Token，以及 Bearer token
+func nodeCredential(c *gin.Context) string {
+	if p := c.Query("p"); p != "" {
+		return p
+	}
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		return password
+	}
+	auth := c.GetHeader("Authorization")
+	for _, prefix := range []string{"Token ", "Bearer "} {
+		if strings.HasPrefix(auth, prefix) {
+			return strings.TrimSpace(auth[len(prefix):])
+		}
+	}
+	return ""
+}
+
+func ingestPoints(nodeID string, points []Point) error {
+	secs, groups := groupPoints(points, time.Now())
+	state := externalNode(nodeID)
+	for _, sec := range secs {
+		if err := state.store(applyTelegraf(state, nodeID, time.Unix(sec, 0), groups[sec])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupPoints 按秒对数据分组，返回排序后的各组时间 (Unix 秒) 和各组的数据。
+// Telegraf 同一轮采集的数据时间戳相同，每组生成一条动态数据；
+// 时间超前 now 太多的数据按 now 计 (见 reportTimestamp)，否则会让节点的可用率和流量统计停在未来
+func groupPoints(points []Point, now time.Time) ([]int64, map[int64][]Point) {
+	groups := map[int64][]Point{}
+	for _, p := range points {
+		sec := reportTimestamp(p.Time, now).Unix()
+		groups[sec] = append(groups[sec], p)
+	}
+	secs := make([]int64, 0, len(groups))
+	for sec := range groups {
+		secs = append(secs, sec)
+	}
+	sort.Slice(secs, func(i, j int) bool { return secs[i] < secs[j] })
+	return secs, groups
+}
+
+// applyTelegraf 把同一时刻的一组数据合并到节点状态中
+func applyTelegraf(s *externalState, nodeID string, ts time.Time, points []Point) externalUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.dynamic
+	st := s.static
+	hasDynamic := false
+
+	var diskUsed, diskTotal uint64
+	var recv, sent uint64
+	hasDisk, hasNet := false, false
+	seenDisk := map[string]bool{}
+
+	for _, p := range points {
+		if host := p.Tags["host"]; host != "" {
+			st.HostName = host
+		}
+		switch p.Measurement {
+		case "cpu":
+			if p.Tags["cpu"] != "cpu-total" {
+				continue
+			}
+			if idle, ok := p.FloatField("usage_idle"); ok {
+				d.CPUUsage = 100 - idle
+				hasDynamic = true
+			}
+		case "mem":
+			if v, ok := p.FloatField("used"); ok {
+				d.MemoryUsed = uint64(v)
+				hasDynamic = true
+			}
+			if v, ok := p.FloatField("total"); ok {
+				st.MemoryTotal = fmt.Sprint(uint64(v))
+			}
+		case "swap":
+			if v, ok := p.FloatField("total"); ok {
+				st.SwapTotal = fmt.Sprint(uint64(v))
+			}
+		case "disk":
+			// 同一设备可能挂载在多个路径上，按设备去重
+			key := p.Tags["device"]
+			if key == "" {
+				key = p.Tags["path"]
+			}
+			if seenDisk[key] {
+				continue
+			}
+			seenDisk[key] = true
+			if v, ok := p.FloatField("used"); ok {
+				diskUsed += uint64(v)
+				hasDisk = true
+			}
+			if v, ok := p.FloatField("total"); ok {
+				diskTotal += uint64(v)
+			}
+		case "net":
+			iface := p.Tags["interface"]
+			if iface == "all" || strings.HasPrefix(iface, "lo") {
+				continue
+			}
+			if v, ok := p.FloatField("bytes_recv"); ok {
+				recv += uint64(v)
+				hasNet = true
+			}
+			if v, ok := p.FloatField("bytes_sent"); ok {
+				sent += uint64(v)
+			}
+		case "netstat":
+			tcp := 0
+			for name := range p.Fields {
+				if strings.HasPrefix(name, "tcp_") {
+					v, _ := p.FloatField(name)
+					tcp += int(v)
+				}
+			}
+			d.TCPCount = tcp
+			if v, ok := p.FloatField("udp_socket"); ok {
+				d.UDPCount = int(v)
+			}
+			hasDynamic = true
+		case "system":
+			if v, ok := p.FloatField("load1"); ok {
+				d.Load[0] = v
+				hasDynamic = true
+			}
+			if v, ok := p.FloatField("load5"); ok {
+				d.Load[1] = v
+			}
+			if v, ok := p.FloatField("load15"); ok {
+				d.Load[2] = v
+			}
+			if v, ok := p.FloatField("uptime"); ok {
+				st.UpDateTime = ts.Add(-time.Duration(v) * time.Second).Format(time.RFC3339)
+			}
+		case "processes":
+			if v, ok := p.FloatField("total"); ok {
+				d.ProcessCount = int(v)
+				hasDynamic = true
+			}
+			if v, ok := p.FloatField("total_threads"); ok {
+				d.ThreadCount = int(v)
+			}
+		}
+	}
+
+	if hasDisk {
+		d.DiskUsed = diskUsed
+		st.DiskTotal = fmt.Sprint(diskTotal)
+		hasDynamic = true
+	}
+	if hasNet {
+		s.setNetworkCounters(&d, recv, sent, ts)
+		hasDynamic = true
+	}
+
+	return s.commit(nodeID, "telegraf", ts, d, st, hasDynamic)
+}
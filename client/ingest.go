@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxReportBody 为解压后上报数据的大小上限
+const maxReportBody = 16 << 20
+
+// ReportError 为上报处理失败的原因，Status 为对应的 HTTP 状态码，Reason 为错误指标的标签
+type ReportError struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+func (e *ReportError) Error() string {
+	return e.Message
+}
+
+func invalidReport(err error) *ReportError {
+	return &ReportError{Status: http.StatusBadRequest, Reason: "invalid", Message: err.Error()}
+}
+
+// handleReport 读取 (按 Content-Encoding 解压) 请求体并交给 Ingest 处理
+func handleReport(c *gin.Context, kind string) {
+	body, closeBody, err := decodeBody(c.Request.Body, c.GetHeader("Content-Encoding"))
+	if err != nil {
+		reportsReceived.Inc(kind)
+		reportErrors.Inc(kind, "invalid")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer closeBody()
+	raw, err := io.ReadAll(io.LimitReader(body, maxReportBody+1))
+	if err != nil || len(raw) > maxReportBody {
+		reportsReceived.Inc(kind)
+		reportErrors.Inc(kind, "invalid")
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+
+	resp, err := Ingest(kind, raw, c.GetHeader("X-Agent-Signature"))
+	if err != nil {
+		var re *ReportError
+		errors.As(err, &re)
+		c.JSON(re.Status, gin.H{"error": re.Message})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Ingest 处理一次 agent 上报，HTTP 接口和 WebSocket 连接共用。
+// kind 为 dynamic、static 或 batch，signature 为 agent 身份私钥对 body 的签名，返回的错误为 *ReportError
+func Ingest(kind string, body []byte, signature string) (gin.H, error) {
+	start := time.Now()
+	defer func() {
+		reportDuration.Observe(time.Since(start).Seconds(), kind)
+	}()
+	reportsReceived.Inc(kind)
+
+	var resp gin.H
+	var err error
+	switch kind {
+	case "dynamic":
+		resp, err = ingestDynamic(body)
+	case "static":
+		resp, err = ingestStatic(body, signature)
+	case "batch":
+		resp, err = ingestBatch(body)
+	default:
+		err = &ReportError{Status: http.StatusNotFound, Reason: "invalid", Message: "Unknown report kind " + kind}
+	}
+	if err != nil {
+		reportErrors.Inc(kind, err.(*ReportError).Reason)
+	}
+	return resp, err
+}
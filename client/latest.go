@@ -0,0 +1,46 @@
+package client
+
+import (
+	"sync"
+)
+
+// 每个节点最近一次上报的动态数据，供 /metrics 等高频读取的接口使用，避免查询 MongoDB
+var (
+	latestMu sync.RWMutex
+	latest   = map[string]ServerDynamicData{}
+)
+
+func storeLatest(data ServerDynamicData) {
+	latestMu.Lock()
+	if prev, ok := latest[data.ID]; !ok || !data.Timestamp.Before(prev.Timestamp) {
+		latest[data.ID] = data
+	}
+	latestMu.Unlock()
+}
+
+// LatestDynamic 返回所有节点最近一次上报的动态数据
+func LatestDynamic() map[string]ServerDynamicData {
+	latestMu.RLock()
+	defer latestMu.RUnlock()
+
+	ret := make(map[string]ServerDynamicData, len(latest))
+	for id, data := range latest {
+		ret[id] = data
+	}
+	return ret
+}
+
+// Latest 返回节点最近一次上报的动态数据
+func Latest(id string) (ServerDynamicData, bool) {
+	latestMu.RLock()
+	defer latestMu.RUnlock()
+	data, ok := latest[id]
+	return data, ok
+}
+
+// ForgetNode 删除节点的缓存数据
+func ForgetNode(id string) {
+	latestMu.Lock()
+	delete(latest, id)
+	latestMu.Unlock()
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point 为 InfluxDB line protocol 中的一行
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// FloatField 以 float64 返回数值类型的字段
+func (p Point) FloatField(name string) (float64, bool) {
+	switch v := p.Fields[name].(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// ParseLineProtocol 解析 line protocol，precision 为 ns、us、ms、s 之一，
+// 没有时间戳的行使用 now
+func ParseLineProtocol(r io.Reader, precision string, now time.Time) ([]Point, error) {
+	var multiplier int64
+	switch precision {
+	case "", "n", "ns":
+		multiplier = 1
+	case "u", "us":
+		multiplier = int64(time.Microsecond)
+	case "ms":
+		multiplier = int64(time.Millisecond)
+	case "s":
+		multiplier = int64(time.Second)
+	default:
+		return nil, fmt.Errorf("unsupported precision %q", precision)
+	}
+
+	var points []Point
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseLine(line, multiplier, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func parseLine(line string, multiplier int64, now time.Time) (Point, error) {
+	// 按未转义、不在引号内的空格切分为 key、fields、timestamp 三段
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return Point{}, fmt.Errorf("expected measurement, fields and optional timestamp")
+	}
+
+	keyParts := splitUnescaped(sections[0], ',', false)
+	p := Point{
+		Measurement: unescape(keyParts[0]),
+		Tags:        map[string]string{},
+		Fields:      map[string]interface{}{},
+		Time:        now,
+	}
+	if p.Measurement == "" {
+		return Point{}, fmt.Errorf("missing measurement")
+	}
+	for _, kv := range keyParts[1:] {
+		k, v, ok := cutUnescaped(kv, '=')
+		if !ok {
+			return Point{}, fmt.Errorf("invalid tag %q", kv)
+		}
+		p.Tags[unescape(k)] = unescape(v)
+	}
+
+	for _, kv := range splitUnescaped(sections[1], ',', true) {
+		k, v, ok := cutUnescaped(kv, '=')
+		if !ok {
+			return Point{}, fmt.Errorf("invalid field %q", kv)
+		}
+		value, err := parseFieldValue(v)
+		if err != nil {
+			return Point{}, fmt.Errorf("field %s: %v", k, err)
+		}
+		p.Fields[unescape(k)] = value
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		p.Time = time.Unix(0, ts*multiplier)
+	}
+	return p, nil
+}
+
+func parseFieldValue(v string) (interface{}, error) {
+	if v == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	switch {
+	case v[0] == '"':
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1]), nil
+	case strings.HasSuffix(v, "i"):
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	case strings.HasSuffix(v, "u"):
+		return strconv.ParseUint(v[:len(v)-1], 10, 64)
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// splitUnescaped 按 sep 切分，跳过反斜杠转义的字符，quoted 为 true 时不切分双引号内的内容
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quoted:
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+var unescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`)
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return unescaper.Replace(s)
+}
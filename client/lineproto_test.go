@@ -0,0 +1,158 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLineProtocolEscaping(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		line string
+		want Point
+	}{
+		{
+			name: "plain",
+			line: `cpu,cpu=cpu-total,host=web1 usage_idle=97.5`,
+			want: Point{"cpu", map[string]string{"cpu": "cpu-total", "host": "web1"}, map[string]interface{}{"usage_idle": 97.5}, now},
+		},
+		{
+			name: "escaped measurement",
+			line: `disk\ io\,x,path=/ used=1i`,
+			want: Point{"disk io,x", map[string]string{"path": "/"}, map[string]interface{}{"used": int64(1)}, now},
+		},
+		{
+			name: "escaped tag key and value",
+			line: `net,inter\=face=eth\ 0\,1 bytes_recv=10u`,
+			want: Point{"net", map[string]string{"inter=face": "eth 0,1"}, map[string]interface{}{"bytes_recv": uint64(10)}, now},
+		},
+		{
+			name: "escaped field key",
+			line: `system,host=a load\ 1=0.5,up\,time=3i`,
+			want: Point{"system", map[string]string{"host": "a"}, map[string]interface{}{"load 1": 0.5, "up,time": int64(3)}, now},
+		},
+		{
+			name: "quoted string with separators",
+			line: `system,host=a uptime_format="1 day, 2:03",ok=true`,
+			want: Point{"system", map[string]string{"host": "a"}, map[string]interface{}{"uptime_format": "1 day, 2:03", "ok": true}, now},
+		},
+		{
+			name: "escaped quote and backslash in string",
+			line: `log msg="say \"hi\" c:\\tmp"`,
+			want: Point{"log", map[string]string{}, map[string]interface{}{"msg": `say "hi" c:\tmp`}, now},
+		},
+		{
+			name: "backslash in tag value",
+			line: `disk,path=C:\\ used=1`,
+			want: Point{"disk", map[string]string{"path": `C:\`}, map[string]interface{}{"used": 1.0}, now},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := ParseLineProtocol(strings.NewReader(tt.line), "", now)
+			if err != nil {
+				t.Fatalf("ParseLineProtocol(%q): %v", tt.line, err)
+			}
+			if len(points) != 1 {
+				t.Fatalf("got %d points, want 1", len(points))
+			}
+			if !reflect.DeepEqual(points[0], tt.want) {
+				t.Errorf("got %+v, want %+v", points[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLineProtocolPrecision(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		precision string
+		ts        string
+		want      time.Time
+	}{
+		{"", "1700000001000000123", time.Unix(1700000001, 123)},
+		{"ns", "1700000001000000123", time.Unix(1700000001, 123)},
+		{"n", "1700000001000000123", time.Unix(1700000001, 123)},
+		{"us", "1700000001000123", time.Unix(1700000001, 123000)},
+		{"u", "1700000001000123", time.Unix(1700000001, 123000)},
+		{"ms", "1700000001123", time.Unix(1700000001, 123000000)},
+		{"s", "1700000001", time.Unix(1700000001, 0)},
+		{"s", "", now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.precision+"/"+tt.ts, func(t *testing.T) {
+			line := "cpu usage_idle=1 " + tt.ts
+			points, err := ParseLineProtocol(strings.NewReader(line), tt.precision, now)
+			if err != nil {
+				t.Fatalf("ParseLineProtocol(%q, %q): %v", line, tt.precision, err)
+			}
+			if got := points[0].Time; !got.Equal(tt.want) {
+				t.Errorf("time = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		precision string
+		wantErr   string
+	}{
+		{"unsupported precision", "cpu a=1", "h", "unsupported precision"},
+		{"missing fields", "cpu", "", "line 1: expected measurement"},
+		{"missing measurement", ",host=a a=1", "", "missing measurement"},
+		{"invalid tag", "cpu,host a=1", "", "invalid tag"},
+		{"invalid field", "cpu a", "", "invalid field"},
+		{"unterminated string", `cpu a="x`, "", "unterminated string"},
+		{"invalid timestamp", "cpu a=1 soon", "", "invalid timestamp"},
+		{"line number", "# comment\n\ncpu a=1\ncpu a=", "", "line 4: field a: empty value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseLineProtocol(strings.NewReader(tt.input), tt.precision, time.Now())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGroupPointsClampsFutureTimestamps(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	input := "cpu,host=a usage_idle=90 1700000000000000000\n" +
+		"mem,host=a used=1i 1700000000000000000\n" +
+		"cpu,host=a usage_idle=80 1700000090000000000\n" +
+		"net,host=a bytes_recv=10u 1800000000000000000\n" +
+		"disk,host=a used=5i 1700000130000000000\n"
+	points, err := ParseLineProtocol(strings.NewReader(input), "", now)
+	if err != nil {
+		t.Fatalf("ParseLineProtocol: %v", err)
+	}
+
+	secs, groups := groupPoints(points, now)
+	// 超前一分钟以内的数据保留原时间，更远的未来数据按 now 计
+	wantSecs := []int64{1700000000, 1700000090, 1700000100, 1700000130}
+	if !reflect.DeepEqual(secs, wantSecs) {
+		t.Fatalf("secs = %v, want %v", secs, wantSecs)
+	}
+	wantMeasurements := map[int64][]string{
+		1700000000: {"cpu", "mem"},
+		1700000090: {"cpu"},
+		1700000100: {"net"},
+		1700000130: {"disk"},
+	}
+	for sec, want := range wantMeasurements {
+		var got []string
+		for _, p := range groups[sec] {
+			got = append(got, p.Measurement)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("group %d = %v, want %v", sec, got, want)
+		}
+	}
+}
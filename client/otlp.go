@@ -0,0 +1,280 @@
+package client
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxOTLPBody 为解压后请求体的大小上限
+const maxOTLPBody = 16 << 20
+
+// HandleOTLPMetrics 接收 OTLP/HTTP 格式 (protobuf 或 JSON) 的指标 (/v1/metrics)，
+// 把 OpenTelemetry Collector hostmetrics receiver 的指标转换为节点数据
+func HandleOTLPMetrics(c *gin.Context) {
+	start := time.Now()
+	defer func() {
+		reportDuration.Observe(time.Since(start).Seconds(), "otlp")
+	}()
+	reportsReceived.Inc("otlp")
+
+	nodeID := nodeCredential(c)
+	if err := AuthenticateNode(nodeID); err != nil {
+		reportErrors.Inc("otlp", "unauthorized")
+		if err == ErrUnknownNode {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid node credential"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate node"})
+		}
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != "application/x-protobuf" && mediaType != "application/json" {
+		reportErrors.Inc("otlp", "invalid")
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/x-protobuf or application/json"})
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			reportErrors.Inc("otlp", "invalid")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gzip body"})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	raw, err := io.ReadAll(io.LimitReader(body, maxOTLPBody+1))
+	if err != nil || len(raw) > maxOTLPBody {
+		reportErrors.Inc("otlp", "invalid")
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+
+	var resources []otlpResource
+	if mediaType == "application/json" {
+		resources, err = decodeOTLPJSON(raw, time.Now())
+	} else {
+		resources, err = decodeOTLPProto(raw, time.Now())
+	}
+	if err != nil {
+		reportErrors.Inc("otlp", "invalid")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ingestOTLP(nodeID, resources); err != nil {
+		reportErrors.Inc("otlp", "storage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store data"})
+		return
+	}
+
+	// 返回空的 ExportMetricsServiceResponse
+	if mediaType == "application/json" {
+		c.Data(http.StatusOK, "application/json", []byte("{}"))
+	} else {
+		c.Data(http.StatusOK, "application/x-protobuf", nil)
+	}
+}
+
+func ingestOTLP(nodeID string, resources []otlpResource) error {
+	// 一个 token 对应一个节点，同一请求中的多个 Resource 合并处理
+	attrs := map[string]string{}
+	groups := map[int64][]otlpSample{}
+	for _, r := range resources {
+		for k, v := range r.Attrs {
+			attrs[k] = v
+		}
+		for _, p := range r.Samples {
+			sec := p.Time.Unix()
+			groups[sec] = append(groups[sec], p)
+		}
+	}
+	secs := make([]int64, 0, len(groups))
+	for sec := range groups {
+		secs = append(secs, sec)
+	}
+	sort.Slice(secs, func(i, j int) bool { return secs[i] < secs[j] })
+
+	state := externalNode(nodeID)
+	for _, sec := range secs {
+		if err := state.store(applyOTLP(state, nodeID, time.Unix(sec, 0), attrs, groups[sec])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOTLP 把同一时刻的一组数据点按 hostmetrics 的语义约定合并到节点状态中
+func applyOTLP(s *externalState, nodeID string, ts time.Time, attrs map[string]string, samples []otlpSample) externalUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.dynamic
+	st := s.static
+	hasDynamic := false
+
+	if v := attrs["host.name"]; v != "" {
+		st.HostName = v
+	}
+	if v := attrs["os.type"]; v != "" {
+		st.OSName = v
+	}
+	if v := attrs["os.description"]; v != "" {
+		st.OSVersion = v
+	}
+	if v := attrs["host.arch"]; v != "" {
+		st.Architecture = v
+	}
+	if v := attrs["cloud.provider"]; v != "" {
+		st.VendorName = v
+	}
+
+	var cpuIdle, cpuTotal, cpuTimeIdle, cpuTimeTotal float64
+	var memUsed, memTotal, memLimit, swapTotal float64
+	var diskUsed, diskTotal float64
+	var recv, sent float64
+	var tcp, udp, procs int
+	hasCPU, hasCPUTime, hasMem, hasDisk, hasNet, hasConn, hasProcs := false, false, false, false, false, false, false
+	netDelta := false
+	seenDisk := map[string]bool{}
+
+	for _, p := range samples {
+		state := p.Attrs["state"]
+		switch p.Metric {
+		case "system.cpu.utilization":
+			// 每个 CPU 每种状态一个数据点，取值为 0~1
+			cpuTotal += p.Value
+			if state == "idle" {
+				cpuIdle += p.Value
+			}
+			hasCPU = true
+		case "system.cpu.time":
+			cpuTimeTotal += p.Value
+			if state == "idle" {
+				cpuTimeIdle += p.Value
+			}
+			hasCPUTime = true
+		case "system.cpu.load_average.1m":
+			d.Load[0] = p.Value
+			hasDynamic = true
+		case "system.cpu.load_average.5m":
+			d.Load[1] = p.Value
+		case "system.cpu.load_average.15m":
+			d.Load[2] = p.Value
+		case "system.memory.usage":
+			// slab 已经包含在其他状态中，不计入总量
+			if !strings.HasPrefix(state, "slab_") {
+				memTotal += p.Value
+			}
+			if state == "used" {
+				memUsed = p.Value
+			}
+			hasMem = true
+		case "system.memory.limit":
+			memLimit = p.Value
+		case "system.paging.usage":
+			if state != "cached" {
+				swapTotal += p.Value
+			}
+		case "system.filesystem.usage":
+			// 同一设备可能挂载在多个路径上，按设备去重
+			key := p.Attrs["device"]
+			if key == "" {
+				key = p.Attrs["mountpoint"]
+			}
+			if seenDisk[key+"\x00"+state] {
+				continue
+			}
+			seenDisk[key+"\x00"+state] = true
+			diskTotal += p.Value
+			if state == "used" {
+				diskUsed += p.Value
+			}
+			hasDisk = true
+		case "system.network.io":
+			if strings.HasPrefix(p.Attrs["device"], "lo") {
+				continue
+			}
+			switch p.Attrs["direction"] {
+			case "receive":
+				recv += p.Value
+			case "transmit":
+				sent += p.Value
+			}
+			netDelta = p.Delta
+			hasNet = true
+		case "system.network.connections":
+			switch p.Attrs["protocol"] {
+			case "tcp":
+				tcp += int(p.Value)
+			case "udp":
+				udp += int(p.Value)
+			}
+			hasConn = true
+		case "system.processes.count":
+			procs += int(p.Value)
+			hasProcs = true
+		case "system.uptime":
+			st.UpDateTime = ts.Add(-time.Duration(p.Value) * time.Second).Format(time.RFC3339)
+		}
+	}
+
+	if hasCPU && cpuTotal > 0 {
+		d.CPUUsage = (1 - cpuIdle/cpuTotal) * 100
+		hasDynamic = true
+	} else if hasCPUTime {
+		// 累计 CPU 时间需要与上一次的值相减才能得到使用率
+		if s.cpuTotal > 0 && cpuTimeTotal > s.cpuTotal && cpuTimeIdle >= s.cpuIdle {
+			d.CPUUsage = (1 - (cpuTimeIdle-s.cpuIdle)/(cpuTimeTotal-s.cpuTotal)) * 100
+			hasDynamic = true
+		}
+		s.cpuIdle, s.cpuTotal = cpuTimeIdle, cpuTimeTotal
+	}
+	if hasMem {
+		d.MemoryUsed = uint64(memUsed)
+		if memLimit > 0 {
+			memTotal = memLimit
+		}
+		st.MemoryTotal = fmt.Sprint(uint64(memTotal))
+		hasDynamic = true
+	}
+	if swapTotal > 0 {
+		st.SwapTotal = fmt.Sprint(uint64(swapTotal))
+	}
+	if hasDisk {
+		d.DiskUsed = uint64(diskUsed)
+		st.DiskTotal = fmt.Sprint(uint64(diskTotal))
+		hasDynamic = true
+	}
+	if hasConn {
+		d.TCPCount = tcp
+		d.UDPCount = udp
+		hasDynamic = true
+	}
+	if hasProcs {
+		d.ProcessCount = procs
+		hasDynamic = true
+	}
+	if hasNet {
+		// DELTA 累加到上一次的累计值上，统一按累计计数器处理
+		if netDelta {
+			recv += float64(s.recv)
+			sent += float64(s.sent)
+		}
+		s.setNetworkCounters(&d, uint64(recv), uint64(sent), ts)
+		hasDynamic = true
+	}
+
+	return s.commit(nodeID, "otlp", ts, d, st, hasDynamic)
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpResource 为 OTLP 请求中一个 Resource 下的所有数据点
+type otlpResource struct {
+	Attrs   map[string]string
+	Samples []otlpSample
+}
+
+// otlpSample 为 Gauge 或 Sum 中的一个数据点，其他类型的指标会被忽略
+type otlpSample struct {
+	Metric string
+	Attrs  map[string]string
+	Value  float64
+	Time   time.Time
+	// Delta 表示 Sum 的 aggregation temporality 为 DELTA
+	Delta bool
+}
+
+// OTLP 中 AGGREGATION_TEMPORALITY_DELTA 的取值
+const otlpTemporalityDelta = 1
+
+// decodeOTLPProto 解析 protobuf 编码的 ExportMetricsServiceRequest，
+// 只解析用到的字段，避免引入完整的 OTLP 和 gRPC 依赖
+func decodeOTLPProto(b []byte, now time.Time) ([]otlpResource, error) {
+	var resources []otlpResource
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		r, err := decodeResourceMetrics(raw, now)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, r)
+		return nil
+	})
+	return resources, err
+}
+
+func decodeResourceMetrics(b []byte, now time.Time) (otlpResource, error) {
+	r := otlpResource{Attrs: map[string]string{}}
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1: // resource
+			return walkProto(raw, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) error {
+				if num == 1 && typ == protowire.BytesType {
+					return decodeKeyValue(raw, r.Attrs)
+				}
+				return nil
+			})
+		case 2: // scope_metrics
+			return walkProto(raw, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) error {
+				if num != 2 || typ != protowire.BytesType {
+					return nil
+				}
+				samples, err := decodeMetric(raw, now)
+				r.Samples = append(r.Samples, samples...)
+				return err
+			})
+		}
+		return nil
+	})
+	return r, err
+}
+
+func decodeMetric(b []byte, now time.Time) ([]otlpSample, error) {
+	var name string
+	var samples []otlpSample
+	delta := false
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			name = string(raw)
+		case (num == 5 || num == 7) && typ == protowire.BytesType: // gauge, sum
+			return walkProto(raw, func(num protowire.Number, typ protowire.Type, raw []byte, x uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					p, err := decodeNumberDataPoint(raw, now)
+					if err != nil {
+						return err
+					}
+					samples = append(samples, p)
+				case num == 2 && typ == protowire.VarintType:
+					delta = x == otlpTemporalityDelta
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	for i := range samples {
+		samples[i].Metric = name
+		samples[i].Delta = delta
+	}
+	return samples, err
+}
+
+func decodeNumberDataPoint(b []byte, now time.Time) (otlpSample, error) {
+	p := otlpSample{Attrs: map[string]string{}}
+	var nanos uint64
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, raw []byte, x uint64) error {
+		switch {
+		case num == 3 && typ == protowire.Fixed64Type:
+			nanos = x
+		case num == 4 && typ == protowire.Fixed64Type:
+			p.Value = math.Float64frombits(x)
+		case num == 6 && typ == protowire.Fixed64Type:
+			p.Value = float64(int64(x))
+		case num == 7 && typ == protowire.BytesType:
+			return decodeKeyValue(raw, p.Attrs)
+		}
+		return nil
+	})
+	p.Time = otlpTime(nanos, now)
+	return p, err
+}
+
+// decodeKeyValue 解析 KeyValue 并以字符串形式写入 attrs，数组等复杂类型会被忽略
+func decodeKeyValue(b []byte, attrs map[string]string) error {
+	var key, value string
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key = string(raw)
+		case num == 2 && typ == protowire.BytesType:
+			return walkProto(raw, func(num protowire.Number, typ protowire.Type, raw []byte, x uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					value = string(raw)
+				case num == 2 && typ == protowire.VarintType:
+					value = strconv.FormatBool(x != 0)
+				case num == 3 && typ == protowire.VarintType:
+					value = strconv.FormatInt(int64(x), 10)
+				case num == 4 && typ == protowire.Fixed64Type:
+					value = strconv.FormatFloat(math.Float64frombits(x), 'f', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if key != "" {
+		attrs[key] = value
+	}
+	return err
+}
+
+// walkProto 依次回调消息中的每个字段，length-delimited 字段传入 raw，数值字段传入 x
+func walkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, raw []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var raw []byte
+		var x uint64
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			x = uint64(v)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, raw, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLP/JSON 编码，字段名为 lowerCamelCase，64 位整数可能以字符串表示
+type otlpJSONRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []otlpJSONMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpJSONMetric struct {
+	Name  string `json:"name"`
+	Gauge *struct {
+		DataPoints []otlpJSONDataPoint `json:"dataPoints"`
+	} `json:"gauge"`
+	Sum *struct {
+		DataPoints             []otlpJSONDataPoint `json:"dataPoints"`
+		AggregationTemporality int                 `json:"aggregationTemporality"`
+	} `json:"sum"`
+}
+
+type otlpJSONDataPoint struct {
+	Attributes   []otlpJSONKeyValue `json:"attributes"`
+	TimeUnixNano json.Number        `json:"timeUnixNano"`
+	AsDouble     *float64           `json:"asDouble"`
+	AsInt        json.Number        `json:"asInt"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string     `json:"stringValue"`
+		BoolValue   *bool       `json:"boolValue"`
+		IntValue    json.Number `json:"intValue"`
+		DoubleValue *float64    `json:"doubleValue"`
+	} `json:"value"`
+}
+
+// decodeOTLPJSON 解析 JSON 编码的 ExportMetricsServiceRequest
+func decodeOTLPJSON(b []byte, now time.Time) ([]otlpResource, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+
+	var resources []otlpResource
+	for _, rm := range req.ResourceMetrics {
+		r := otlpResource{Attrs: jsonAttrs(rm.Resource.Attributes)}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				var points []otlpJSONDataPoint
+				delta := false
+				switch {
+				case m.Gauge != nil:
+					points = m.Gauge.DataPoints
+				case m.Sum != nil:
+					points = m.Sum.DataPoints
+					delta = m.Sum.AggregationTemporality == otlpTemporalityDelta
+				}
+				for _, dp := range points {
+					p := otlpSample{Metric: m.Name, Attrs: jsonAttrs(dp.Attributes), Delta: delta}
+					switch {
+					case dp.AsDouble != nil:
+						p.Value = *dp.AsDouble
+					case dp.AsInt != "":
+						v, err := dp.AsInt.Int64()
+						if err != nil {
+							return nil, fmt.Errorf("metric %s: invalid asInt %q", m.Name, dp.AsInt)
+						}
+						p.Value = float64(v)
+					}
+					var nanos uint64
+					if dp.TimeUnixNano != "" {
+						v, err := strconv.ParseUint(string(dp.TimeUnixNano), 10, 64)
+						if err != nil {
+							return nil, fmt.Errorf("metric %s: invalid timeUnixNano %q", m.Name, dp.TimeUnixNano)
+						}
+						nanos = v
+					}
+					p.Time = otlpTime(nanos, now)
+					r.Samples = append(r.Samples, p)
+				}
+			}
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+func jsonAttrs(kvs []otlpJSONKeyValue) map[string]string {
+	attrs := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		v := kv.Value
+		switch {
+		case v.StringValue != nil:
+			attrs[kv.Key] = *v.StringValue
+		case v.BoolValue != nil:
+			attrs[kv.Key] = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != "":
+			attrs[kv.Key] = string(v.IntValue)
+		case v.DoubleValue != nil:
+			attrs[kv.Key] = strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+		default:
+			attrs[kv.Key] = ""
+		}
+	}
+	return attrs
+}
+
+// otlpTime 把 time_unix_nano 转换为时间，未设置或超前 now 太多时使用 now (见 reportTimestamp)
+func otlpTime(nanos uint64, now time.Time) time.Time {
+	if nanos == 0 {
+		return now
+	}
+	return reportTimestamp(time.Unix(0, int64(nanos)), now)
+}
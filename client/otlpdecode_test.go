@@ -0,0 +1,266 @@
+package client
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 以下函数按 OTLP proto 的字段号编码消息，用来构造测试请求
+
+func pbBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func pbString(b []byte, num protowire.Number, s string) []byte {
+	return pbBytes(b, num, []byte(s))
+}
+
+func pbVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func pbFixed32(b []byte, num protowire.Number, v uint32) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, v)
+}
+
+// pbAttr 编码 KeyValue，value 为 string、bool、int64 或 float64
+func pbAttr(key string, value interface{}) []byte {
+	var av []byte
+	switch v := value.(type) {
+	case string:
+		av = pbString(nil, 1, v)
+	case bool:
+		x := uint64(0)
+		if v {
+			x = 1
+		}
+		av = pbVarint(nil, 2, x)
+	case int64:
+		av = pbVarint(nil, 3, uint64(v))
+	case float64:
+		av = pbFixed64(nil, 4, math.Float64bits(v))
+	}
+	return pbBytes(pbString(nil, 1, key), 2, av)
+}
+
+// pbPoint 编码 NumberDataPoint，value 为 float64 时写入 as_double，int64 时写入 as_int
+func pbPoint(nanos uint64, value interface{}, attrs ...[]byte) []byte {
+	var b []byte
+	b = pbFixed64(b, 2, nanos-uint64(time.Minute)) // start_time_unix_nano
+	b = pbFixed64(b, 3, nanos)
+	switch v := value.(type) {
+	case float64:
+		b = pbFixed64(b, 4, math.Float64bits(v))
+	case int64:
+		b = pbFixed64(b, 6, uint64(v))
+	}
+	for _, a := range attrs {
+		b = pbBytes(b, 7, a)
+	}
+	b = pbVarint(b, 8, 0) // flags
+	return b
+}
+
+func pbGauge(name, unit string, points ...[]byte) []byte {
+	var g []byte
+	for _, p := range points {
+		g = pbBytes(g, 1, p)
+	}
+	b := pbString(nil, 1, name)
+	b = pbString(b, 2, "description of "+name)
+	b = pbString(b, 3, unit)
+	return pbBytes(b, 5, g)
+}
+
+func pbSum(name, unit string, temporality uint64, points ...[]byte) []byte {
+	var s []byte
+	for _, p := range points {
+		s = pbBytes(s, 1, p)
+	}
+	s = pbVarint(s, 2, temporality)
+	s = pbVarint(s, 3, 1) // is_monotonic
+	b := pbString(nil, 1, name)
+	b = pbString(b, 3, unit)
+	return pbBytes(b, 7, s)
+}
+
+// hostmetricsRequest 按 hostmetrics receiver 导出的结构编码 ExportMetricsServiceRequest:
+// 每个 scraper 一个 ScopeMetrics，包含 scope、schema_url，以及解码时需要跳过的 histogram 指标和未知字段
+func hostmetricsRequest(nanos uint64) []byte {
+	scope := func(name string, metrics ...[]byte) []byte {
+		b := pbBytes(nil, 1, pbString(pbString(nil, 1, "otelcol/hostmetricsreceiver/"+name), 2, "0.98.0"))
+		for _, m := range metrics {
+			b = pbBytes(b, 2, m)
+		}
+		return pbString(b, 3, "https://opentelemetry.io/schemas/1.9.0")
+	}
+
+	resource := pbBytes(nil, 1, pbAttr("host.name", "web-1"))
+	resource = pbBytes(resource, 1, pbAttr("os.type", "linux"))
+	resource = pbBytes(resource, 1, pbAttr("host.cpu.count", int64(4)))
+	resource = pbVarint(resource, 2, 0) // dropped_attributes_count
+
+	histogram := pbBytes(pbString(nil, 1, "system.disk.latency"), 9, pbVarint(nil, 2, 2))
+
+	rm := pbBytes(nil, 1, resource)
+	rm = pbBytes(rm, 2, scope("load",
+		pbGauge("system.cpu.load_average.1m", "{thread}", pbPoint(nanos, 0.25)),
+		pbGauge("system.cpu.load_average.5m", "{thread}", pbPoint(nanos, 0.5)),
+	))
+	rm = pbBytes(rm, 2, scope("cpu",
+		pbSum("system.cpu.time", "s", 2,
+			pbPoint(nanos, 1000.5, pbAttr("cpu", "cpu0"), pbAttr("state", "user")),
+			pbPoint(nanos, 9000.0, pbAttr("cpu", "cpu0"), pbAttr("state", "idle")),
+		),
+	))
+	rm = pbBytes(rm, 2, scope("memory",
+		pbSum("system.memory.usage", "By", 2,
+			pbPoint(nanos, int64(1<<30), pbAttr("state", "used")),
+			pbPoint(nanos, int64(3<<30), pbAttr("state", "free")),
+		),
+	))
+	rm = pbBytes(rm, 2, scope("network",
+		pbSum("system.network.io", "By", 1,
+			pbPoint(nanos, int64(4096), pbAttr("device", "eth0"), pbAttr("direction", "receive")),
+		),
+		histogram,
+	))
+	rm = pbFixed32(rm, 99, 7) // 未知字段
+	rm = pbString(rm, 3, "https://opentelemetry.io/schemas/1.9.0")
+
+	return pbBytes(nil, 1, rm)
+}
+
+func TestDecodeOTLPProtoHostmetrics(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	nanos := uint64(time.Unix(1700000000, 0).UnixNano())
+	ts := time.Unix(0, int64(nanos))
+
+	resources, err := decodeOTLPProto(hostmetricsRequest(nanos), now)
+	if err != nil {
+		t.Fatalf("decodeOTLPProto: %v", err)
+	}
+	want := []otlpResource{{
+		Attrs: map[string]string{"host.name": "web-1", "os.type": "linux", "host.cpu.count": "4"},
+		Samples: []otlpSample{
+			{Metric: "system.cpu.load_average.1m", Attrs: map[string]string{}, Value: 0.25, Time: ts},
+			{Metric: "system.cpu.load_average.5m", Attrs: map[string]string{}, Value: 0.5, Time: ts},
+			{Metric: "system.cpu.time", Attrs: map[string]string{"cpu": "cpu0", "state": "user"}, Value: 1000.5, Time: ts},
+			{Metric: "system.cpu.time", Attrs: map[string]string{"cpu": "cpu0", "state": "idle"}, Value: 9000, Time: ts},
+			{Metric: "system.memory.usage", Attrs: map[string]string{"state": "used"}, Value: 1 << 30, Time: ts},
+			{Metric: "system.memory.usage", Attrs: map[string]string{"state": "free"}, Value: 3 << 30, Time: ts},
+			{Metric: "system.network.io", Attrs: map[string]string{"device": "eth0", "direction": "receive"}, Value: 4096, Time: ts, Delta: true},
+		},
+	}}
+	if !reflect.DeepEqual(resources, want) {
+		t.Errorf("got  %+v\nwant %+v", resources, want)
+	}
+}
+
+func TestDecodeOTLPProtoValues(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	tests := []struct {
+		name  string
+		point []byte
+		want  otlpSample
+	}{
+		{
+			name:  "double",
+			point: pbPoint(1e18, 1.5),
+			want:  otlpSample{Attrs: map[string]string{}, Value: 1.5, Time: time.Unix(0, 1e18)},
+		},
+		{
+			name:  "negative int",
+			point: pbPoint(1e18, int64(-3)),
+			want:  otlpSample{Attrs: map[string]string{}, Value: -3, Time: time.Unix(0, 1e18)},
+		},
+		{
+			name:  "missing time uses now",
+			point: pbFixed64(nil, 4, math.Float64bits(2)),
+			want:  otlpSample{Attrs: map[string]string{}, Value: 2, Time: now},
+		},
+		{
+			name:  "future time uses now",
+			point: pbPoint(uint64(now.Add(time.Hour).UnixNano()), 2.0),
+			want:  otlpSample{Attrs: map[string]string{}, Value: 2, Time: now},
+		},
+		{
+			name:  "attribute types",
+			point: pbPoint(1e18, 1.0, pbAttr("s", "x"), pbAttr("b", true), pbAttr("i", int64(-7)), pbAttr("f", 0.5)),
+			want:  otlpSample{Attrs: map[string]string{"s": "x", "b": "true", "i": "-7", "f": "0.5"}, Value: 1, Time: time.Unix(0, 1e18)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeNumberDataPoint(tt.point, now)
+			if err != nil {
+				t.Fatalf("decodeNumberDataPoint: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeOTLPProtoInvalid(t *testing.T) {
+	valid := hostmetricsRequest(uint64(time.Unix(1700000000, 0).UnixNano()))
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"truncated", valid[:len(valid)-5]},
+		{"bad tag", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"length past end", []byte{0x0a, 0x10, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeOTLPProto(tt.body, time.Now()); err == nil {
+				t.Error("decodeOTLPProto succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestDecodeOTLPJSONMatchesProto(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	body := `{"resourceMetrics":[{"resource":{"attributes":[
+		{"key":"host.name","value":{"stringValue":"web-1"}},
+		{"key":"host.cpu.count","value":{"intValue":"4"}}]},
+	"scopeMetrics":[{"scope":{"name":"otelcol/hostmetricsreceiver/memory"},"metrics":[
+		{"name":"system.memory.usage","unit":"By","sum":{"aggregationTemporality":2,"isMonotonic":false,"dataPoints":[
+			{"attributes":[{"key":"state","value":{"stringValue":"used"}}],"timeUnixNano":"1700000000000000000","asInt":"1073741824"}]}},
+		{"name":"system.network.io","sum":{"aggregationTemporality":1,"dataPoints":[
+			{"timeUnixNano":"1700000000000000000","asDouble":4096}]}}]}]}]}`
+
+	got, err := decodeOTLPJSON([]byte(strings.ReplaceAll(body, "\n", "")), now)
+	if err != nil {
+		t.Fatalf("decodeOTLPJSON: %v", err)
+	}
+
+	nanos := uint64(time.Unix(1700000000, 0).UnixNano())
+	resource := pbBytes(nil, 1, pbAttr("host.name", "web-1"))
+	resource = pbBytes(resource, 1, pbAttr("host.cpu.count", int64(4)))
+	sm := pbBytes(nil, 2, pbSum("system.memory.usage", "By", 2, pbPoint(nanos, int64(1<<30), pbAttr("state", "used"))))
+	sm = pbBytes(sm, 2, pbSum("system.network.io", "By", 1, pbPoint(nanos, 4096.0)))
+	want, err := decodeOTLPProto(pbBytes(nil, 1, pbBytes(pbBytes(nil, 1, resource), 2, sm)), now)
+	if err != nil {
+		t.Fatalf("decodeOTLPProto: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON decoded to %+v, protobuf to %+v", got, want)
+	}
+}
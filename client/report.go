@@ -2,8 +2,13 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"server/agentconf"
+	"server/agentupdate"
 	"server/db"
+	"server/metrics"
+	"slices"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +32,23 @@ type ServerDynamicData struct {
 	ProcessCount    int        `json:"processCount" bson:"processCount"`
 	ThreadCount     int        `json:"threadCount" bson:"threadCount"`
 	Timestamp       time.Time  `json:"timestamp" bson:"timestamp"`
+	// Seq 为 agent 生成的递增序号，同一个节点的序号不会重复，用于重试时去重
+	Seq uint64 `json:"seq,omitempty" bson:"seq,omitempty"`
+	// Probes 为 agent 对探测目标的 TCP 连接测试结果
+	Probes []ProbeResult `json:"probes,omitempty" bson:"probes,omitempty"`
+	// ConfigVersion 为 agent 正在使用的服务端配置版本，不保存
+	ConfigVersion string `json:"configVersion,omitempty" bson:"-"`
+	// BootTime 为节点的开机时间 (Unix 秒)，用于区分节点重启和计数器变小，旧版本 agent 和外部来源没有，不保存
+	BootTime int64 `json:"bootTime,omitempty" bson:"-"`
+	// TrafficScope 为参与统计累计流量的网卡集合的摘要，网卡增减或过滤条件变化时改变，不保存
+	TrafficScope string `json:"trafficScope,omitempty" bson:"-"`
+}
+
+type ProbeResult struct {
+	Name string `json:"name" bson:"name"`
+	// Latency 为建立连接的耗时 (毫秒)，失败时为 0
+	Latency float64 `json:"latency" bson:"latency"`
+	Error   string  `json:"error,omitempty" bson:"error,omitempty"`
 }
 
 type ServerStaticData struct {
@@ -49,6 +71,42 @@ type ServerStaticData struct {
 	DiskTotal      string    `json:"diskTotal" bson:"diskTotal"`
 	UpDateTime     string    `json:"upDateTime" bson:"upDateTime"`
 	LastReportTime time.Time `json:"lastReportTime" bson:"lastReportTime"`
+	// Source 为数据来源: 空表示 xprobe agent，其他如 telegraf、otlp
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+	// Identity 为 agent 的持久身份，旧版本 agent 和外部来源没有
+	Identity *AgentIdentity `json:"identity,omitempty" bson:"identity,omitempty"`
+	// CloneSuspected 表示节点可能是共用 agent 状态的克隆机器
+	CloneSuspected bool `json:"cloneSuspected" bson:"cloneSuspected"`
+	// Agent 为 agent 的构建信息和能采集的数据，旧版本 agent 和外部来源没有
+	Agent *AgentInfo `json:"agent,omitempty" bson:"agent,omitempty"`
+}
+
+// AgentInfo 为 agent 的构建信息
+type AgentInfo struct {
+	Version   string `json:"version" bson:"version"`
+	Commit    string `json:"commit,omitempty" bson:"commit,omitempty"`
+	GoVersion string `json:"goVersion" bson:"goVersion"`
+	OS        string `json:"os" bson:"os"`
+	Arch      string `json:"arch" bson:"arch"`
+	// Capabilities 为 agent 开启并且在所在平台支持的采集项，如 cpu、load、disk
+	Capabilities []string `json:"capabilities" bson:"capabilities"`
+}
+
+// Collectors 为服务端展示的动态数据对应的采集项
+var Collectors = []string{"cpu", "load", "memory", "disk", "network", "connections", "processes"}
+
+// Missing 返回节点没有提供的采集项，不知道节点能采集哪些数据时返回 nil
+func (s ServerStaticData) Missing() []string {
+	if s.Agent == nil {
+		return nil
+	}
+	var ret []string
+	for _, name := range Collectors {
+		if !slices.Contains(s.Agent.Capabilities, name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
 }
 
 var (
@@ -57,59 +115,149 @@ var (
 	collection  string
 )
 
+var (
+	reportsReceived = metrics.NewCounterVec("xprobe_reports_received_total", "Reports received from agents.", "kind")
+	reportErrors    = metrics.NewCounterVec("xprobe_report_errors_total", "Reports rejected or failed to store.", "kind", "reason")
+	reportDuration  = metrics.NewSummaryVec("xprobe_report_processing_seconds", "Time spent handling a report.", "kind")
+)
+
 func HandleDynamicReport(c *gin.Context) {
+	handleReport(c, "dynamic")
+}
+
+func ingestDynamic(body []byte) (gin.H, error) {
 	var data ServerDynamicData
-	if err := c.ShouldBindJSON(&data); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, invalidReport(err)
 	}
 
-	// 添加时间戳
-	data.Timestamp = time.Now()
+	// 补报的数据保留 agent 的采集时间，旧版本 agent 没有时间戳
+	data.Timestamp = reportTimestamp(data.Timestamp, time.Now())
 
 	// 插入数据到 MongoDB
+	if err := StoreDynamic(data); err != nil {
+		return nil, &ReportError{Status: http.StatusInternalServerError, Reason: "storage", Message: "Failed to insert data"}
+	}
+	agentconf.SetRunning(data.ID, data.ConfigVersion)
+	return gin.H{"message": "Data received and stored successfully", "configVersion": agentconf.Version(data.ID)}, nil
+}
+
+// maxClockSkew 为 agent 时钟允许超前服务端的时长，超过时使用服务端时间
+const maxClockSkew = time.Minute
+
+// reportTimestamp 返回动态数据的保存时间: agent 提供的采集时间，没有或明显超前时为 now
+func reportTimestamp(ts, now time.Time) time.Time {
+	if ts.IsZero() || ts.After(now.Add(maxClockSkew)) {
+		return now
+	}
+	return ts
+}
+
+// StoreDynamic 保存一条动态数据，所有上报途径共用。已经保存过的数据 (节点 ID 和序号相同) 直接忽略
+func StoreDynamic(data ServerDynamicData) error {
 	err := insertDynamicData(data)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert data"})
-		return
+		return err
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Data received and stored successfully"})
+	storeLatest(data)
+	notifyDynamic(data)
+	return nil
 }
 
 func insertDynamicData(data ServerDynamicData) error {
-	collection := db.MG.CC("vps", "dynamic")
+	collection := db.VPS("dynamic")
 	_, err := collection.InsertOne(context.TODO(), data)
 	return err
 }
 
 func HandleStaticReport(c *gin.Context) {
+	handleReport(c, "static")
+}
+
+// ingestStatic 处理静态数据，signature 为 agent 身份私钥对 body 的签名
+func ingestStatic(body []byte, signature string) (gin.H, error) {
 	var data ServerStaticData
-	if err := c.ShouldBindJSON(&data); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, invalidReport(err)
 	}
 
 	// 添加或更新最后报告时间
 	data.LastReportTime = time.Now()
+	data.CloneSuspected = false
+	if data.Identity != nil {
+		if err := verifyIdentity(data.Identity, body, signature); err != nil {
+			return nil, &ReportError{Status: http.StatusUnauthorized, Reason: "unauthorized", Message: "Invalid agent signature"}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := checkPinnedKey(ctx, data.ID, data.Identity); err == ErrKeyChanged {
+		return nil, &ReportError{Status: http.StatusForbidden, Reason: "unauthorized", Message: "Agent key does not match the key pinned for this node"}
+	} else if err != nil {
+		return nil, &ReportError{Status: http.StatusInternalServerError, Reason: "storage", Message: "Failed to check agent key"}
+	}
+	if data.Identity != nil {
+		data.CloneSuspected = checkClone(data.ID, data.Identity, data.LastReportTime)
+	}
 
 	// 插入或更新数据到 MongoDB
-	err := upsertStaticData(data)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upsert data"})
-		return
+	if err := StoreStatic(data); err != nil {
+		return nil, &ReportError{Status: http.StatusInternalServerError, Reason: "storage", Message: "Failed to upsert data"}
 	}
+	return gin.H{"message": "Static data received and stored successfully", "configVersion": agentconf.Version(data.ID)}, nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Static data received and stored successfully"})
+// StoreStatic 插入或更新节点的静态数据，所有上报途径共用
+func StoreStatic(data ServerStaticData) error {
+	return upsertStaticData(data)
 }
 
 func upsertStaticData(data ServerStaticData) error {
-	collection := db.MG.CC("vps", "static")
+	collection := db.VPS("static")
 
 	filter := bson.M{"_id": data.ID}
 	update := bson.M{"$set": data}
+	if data.Agent == nil {
+		// 换成旧版本 agent 或外部来源后不再使用原来的构建信息
+		update["$unset"] = bson.M{"agent": ""}
+	}
 	opts := options.Update().SetUpsert(true)
 
 	_, err := collection.UpdateOne(context.TODO(), filter, update, opts)
 	return err
 }
+
+// HandleAgentConfig 返回节点生效的服务端配置，agent 在上报响应中的 configVersion 变化时获取
+func HandleAgentConfig(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing node ID"})
+		return
+	}
+	s, v := agentconf.Effective(id)
+	c.JSON(http.StatusOK, gin.H{"version": v, "config": s})
+}
+
+// HandleAgentUpdate 返回 agent 应更新到的版本和构建的下载地址、校验和，不需要更新时返回 204
+func HandleAgentUpdate(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing node ID"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := agentupdate.Check(ctx, id, c.Query("os"), c.Query("arch"), c.Query("version"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for updates"})
+		return
+	}
+	if u == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
@@ -0,0 +1,787 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration 在 YAML 中以 "30s"、"720h" 这样的字符串表示
+type Duration time.Duration
+
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	v, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", value.Value, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// ByteSize 在 YAML 中可以写为字节数或 "500GB"、"1TiB" 这样的字符串，单位按 1024 换算
+type ByteSize uint64
+
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"PiB", 1 << 50}, {"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"PB", 1 << 50}, {"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"P", 1 << 50}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	if s := b.String(); s != strconv.FormatUint(uint64(b), 10) {
+		return s, nil
+	}
+	return uint64(b), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	return b.Set(value.Value)
+}
+
+func (b *ByteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	multiplier := uint64(1)
+	for _, u := range byteUnits {
+		if n := len(s) - len(u.suffix); n >= 0 && strings.EqualFold(s[n:], u.suffix) {
+			s = strings.TrimSpace(s[:n])
+			multiplier = u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = ByteSize(v * float64(multiplier))
+	return nil
+}
+
+func (b ByteSize) String() string {
+	for _, u := range byteUnits[:5] {
+		if b != 0 && uint64(b)%u.size == 0 {
+			return fmt.Sprintf("%d%s", uint64(b)/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatUint(uint64(b), 10)
+}
+
+type Config struct {
+	Listen         string          `yaml:"listen"`
+	StaticDir      string          `yaml:"staticDir"`
+	LogLevel       string          `yaml:"logLevel"`
+	TrustedProxies []string        `yaml:"trustedProxies"`
+	CORS           CORSConfig      `yaml:"cors"`
+	TLS            TLSConfig       `yaml:"tls"`
+	Mongo          MongoConfig     `yaml:"mongo"`
+	Retention      RetentionConfig `yaml:"retention"`
+	Shutdown       ShutdownConfig  `yaml:"shutdown"`
+	Nodes          NodesConfig     `yaml:"nodes"`
+	Metrics        MetricsConfig   `yaml:"metrics"`
+	Forward        ForwardConfig   `yaml:"forward"`
+	Traffic        TrafficConfig   `yaml:"traffic"`
+	Alerts         AlertsConfig    `yaml:"alerts"`
+	Capacity       CapacityConfig  `yaml:"capacity"`
+	Anomaly        AnomalyConfig   `yaml:"anomaly"`
+	// PublicURL 为服务的公开访问地址，如 https://probe.example.com，用于生成 RSS/Atom 中的链接
+	PublicURL string `yaml:"publicURL"`
+}
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allowOrigins"`
+}
+
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Listen 为 HTTPS 监听地址，顶层的 listen 仍然提供 HTTP 服务
+	Listen   string `yaml:"listen"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ReloadInterval 为检查证书文件是否变化的间隔
+	ReloadInterval Duration `yaml:"reloadInterval"`
+	// RedirectHTTP 为 true 时 HTTP 监听只做跳转
+	RedirectHTTP bool `yaml:"redirectHTTP"`
+	// ClientCAFile 不为空时，/api/report 路由要求客户端证书
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+type MongoConfig struct {
+	URI    string `yaml:"uri"`
+	ProbDB string `yaml:"probDB"`
+	VPSDB  string `yaml:"vpsDB"`
+	// MaxBackoff 为启动时重连 MongoDB 的最长等待间隔
+	MaxBackoff Duration `yaml:"maxBackoff"`
+}
+
+type RetentionConfig struct {
+	// Dynamic 为 vps.dynamic 中采样数据的保留时长，0 表示永久保留
+	Dynamic Duration `yaml:"dynamic"`
+}
+
+type ShutdownConfig struct {
+	// DrainDelay 为收到退出信号后、停止接受新连接前的等待时间，
+	// 让负载均衡器有时间通过 /readyz 摘除本实例
+	DrainDelay Duration `yaml:"drainDelay"`
+	// Timeout 为等待进行中的请求完成的最长时间
+	Timeout Duration `yaml:"timeout"`
+}
+
+type NodesConfig struct {
+	// OfflineAfter 为节点超过多久没有上报视为离线，也是统计可用率的心跳阈值，
+	// 两次上报间隔超过该值时记为一次中断
+	OfflineAfter Duration `yaml:"offlineAfter"`
+}
+
+type MetricsConfig struct {
+	// Enabled 为 true 时提供 Prometheus 格式的 /metrics，默认关闭
+	Enabled bool `yaml:"enabled"`
+	// BearerToken 不为空时，抓取请求需要携带 Authorization: Bearer <token>
+	BearerToken string `yaml:"bearerToken"`
+}
+
+// TrafficConfig 为流量统计的默认设置，每个节点可以单独覆盖账单日、计费方式和配额
+type TrafficConfig struct {
+	// BillingDay 为每月的账单日 (1~31)，大于当月天数时取当月最后一天
+	BillingDay int `yaml:"billingDay"`
+	// Mode 为计费方式: in 只计入站，out 只计出站，max 取两者较大值，sum 计两者之和
+	Mode string `yaml:"mode"`
+	// Quota 为每个账单周期的流量配额，0 表示不限
+	Quota ByteSize `yaml:"quota"`
+	// Timezone 为计算账单周期使用的时区，如 Asia/Shanghai，空表示服务器本地时区
+	Timezone string `yaml:"timezone"`
+	// FlushInterval 为流量账本写入 MongoDB 的间隔，同时也是检查流量告警的间隔
+	FlushInterval Duration `yaml:"flushInterval"`
+	// AlertThresholds 为触发告警的配额使用百分比
+	AlertThresholds []float64 `yaml:"alertThresholds"`
+	// ForecastAlert 为 true 时，按当前速率预计本周期内用完配额即触发告警
+	ForecastAlert bool `yaml:"forecastAlert"`
+}
+
+// Location 返回账单周期使用的时区
+func (t TrafficConfig) Location() *time.Location {
+	if t.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// ValidTrafficMode 表示 mode 是否为支持的计费方式
+func ValidTrafficMode(mode string) bool {
+	switch mode {
+	case "in", "out", "max", "sum":
+		return true
+	}
+	return false
+}
+
+type AlertsConfig struct {
+	// WebhookURL 不为空时，告警触发和恢复时以 JSON POST 到该地址
+	WebhookURL     string   `yaml:"webhookURL"`
+	WebhookTimeout Duration `yaml:"webhookTimeout"`
+}
+
+// CapacityConfig 为磁盘和内存用满预测的设置
+type CapacityConfig struct {
+	// Window 为参与拟合的历史数据时长
+	Window Duration `yaml:"window"`
+	// Interval 为重新计算预测和检查告警的间隔
+	Interval Duration `yaml:"interval"`
+	// AlertWithin 为预计在这段时间内用满时告警，0 表示不告警
+	AlertWithin Duration `yaml:"alertWithin"`
+	// MinConfidence 为触发告警要求的最低置信度 (0~1)，避免波动较大的数据误报
+	MinConfidence float64 `yaml:"minConfidence"`
+}
+
+// AnomalyConfig 为基于 EWMA 基线的异常检测设置，每个节点可以单独开启和调整灵敏度
+type AnomalyConfig struct {
+	// Enabled 为所有节点的默认开关，为 false 时只检测单独开启的节点
+	Enabled bool `yaml:"enabled"`
+	// Sensitivity 为判定异常的 z-score，越小越灵敏
+	Sensitivity float64 `yaml:"sensitivity"`
+	// HalfLife 为基线的半衰期，越长基线越平稳，对缓慢的变化也越敏感
+	HalfLife Duration `yaml:"halfLife"`
+	// Warmup 为开始检测前基线至少需要的样本数
+	Warmup int `yaml:"warmup"`
+	// For 为持续异常多久才告警，恢复同样需要持续正常这么久
+	For Duration `yaml:"for"`
+	// History 为没有保存基线的节点在启动时从历史数据学习的时长
+	History Duration `yaml:"history"`
+	// Metrics 为检测的指标
+	Metrics []string `yaml:"metrics"`
+}
+
+// AnomalyMetrics 为支持异常检测的指标
+var AnomalyMetrics = []string{"cpuUsage", "networkDownload", "networkUpload", "tcpCount", "processCount"}
+
+// ValidAnomalyMetric 表示 name 是否为支持异常检测的指标
+func ValidAnomalyMetric(name string) bool {
+	for _, m := range AnomalyMetrics {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+type ForwardConfig struct {
+	Sinks []SinkConfig `yaml:"sinks"`
+}
+
+// SinkConfig 为一个外部时序数据库转发目标，每个目标有独立的队列和重试策略
+type SinkConfig struct {
+	Name string `yaml:"name"`
+	// Type 为 influx、prometheus 或 graphite
+	Type string `yaml:"type"`
+	// URL 为 influx 的写入地址 (如 http://influx:8086/write?db=xprobe) 或 Prometheus remote_write 地址
+	URL string `yaml:"url"`
+	// Address 为 graphite 的 host:port
+	Address string `yaml:"address"`
+	// Token 不为空时作为 influx 的 Authorization: Token 或 remote_write 的 Bearer Token
+	Token string `yaml:"token"`
+	// Prefix 为 graphite 指标前缀
+	Prefix        string   `yaml:"prefix"`
+	QueueSize     int      `yaml:"queueSize"`
+	BatchSize     int      `yaml:"batchSize"`
+	FlushInterval Duration `yaml:"flushInterval"`
+	Timeout       Duration `yaml:"timeout"`
+	MaxRetries    int      `yaml:"maxRetries"`
+	RetryBackoff  Duration `yaml:"retryBackoff"`
+	// DropPolicy 为队列满时的处理方式: oldest 丢弃最早的数据，newest 丢弃新数据
+	DropPolicy string `yaml:"dropPolicy"`
+}
+
+// WithDefaults 返回补全默认值后的配置
+func (s SinkConfig) WithDefaults() SinkConfig {
+	if s.QueueSize == 0 {
+		s.QueueSize = 10000
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = 500
+	}
+	if s.FlushInterval == 0 {
+		s.FlushInterval = Duration(10 * time.Second)
+	}
+	if s.Timeout == 0 {
+		s.Timeout = Duration(10 * time.Second)
+	}
+	if s.MaxRetries == 0 {
+		s.MaxRetries = 5
+	}
+	if s.RetryBackoff == 0 {
+		s.RetryBackoff = Duration(time.Second)
+	}
+	if s.DropPolicy == "" {
+		s.DropPolicy = "oldest"
+	}
+	if s.Prefix == "" {
+		s.Prefix = "xprobe"
+	}
+	return s
+}
+
+func (s SinkConfig) validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	switch s.Type {
+	case "influx", "prometheus":
+		if s.URL == "" {
+			return fmt.Errorf("url is required for %s sinks", s.Type)
+		}
+	case "graphite":
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("address: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", s.Type)
+	}
+	switch s.DropPolicy {
+	case "", "oldest", "newest":
+	default:
+		return fmt.Errorf("unknown dropPolicy %q", s.DropPolicy)
+	}
+	if s.QueueSize < 0 || s.BatchSize < 0 || s.MaxRetries < 0 {
+		return errors.New("queueSize, batchSize and maxRetries must not be negative")
+	}
+	return nil
+}
+
+// C 为当前生效的配置，由 Load 设置
+var C = Default()
+
+func Default() *Config {
+	return &Config{
+		Listen:    ":8080",
+		StaticDir: "html",
+		LogLevel:  "info",
+		CORS: CORSConfig{
+			AllowOrigins: []string{"*"},
+		},
+		TLS: TLSConfig{
+			Listen:         ":8443",
+			ReloadInterval: Duration(30 * time.Second),
+		},
+		Mongo: MongoConfig{
+			URI:        "mongodb://localhost:27017",
+			ProbDB:     "prob",
+			VPSDB:      "vps",
+			MaxBackoff: Duration(30 * time.Second),
+		},
+		Shutdown: ShutdownConfig{
+			Timeout: Duration(15 * time.Second),
+		},
+		Nodes: NodesConfig{
+			OfflineAfter: Duration(30 * time.Second),
+		},
+		Traffic: TrafficConfig{
+			BillingDay:      1,
+			Mode:            "sum",
+			FlushInterval:   Duration(time.Minute),
+			AlertThresholds: []float64{80, 95, 100},
+			ForecastAlert:   true,
+		},
+		Alerts: AlertsConfig{
+			WebhookTimeout: Duration(10 * time.Second),
+		},
+		Capacity: CapacityConfig{
+			Window:        Duration(7 * 24 * time.Hour),
+			Interval:      Duration(5 * time.Minute),
+			AlertWithin:   Duration(72 * time.Hour),
+			MinConfidence: 0.6,
+		},
+		Anomaly: AnomalyConfig{
+			Sensitivity: 4,
+			HalfLife:    Duration(time.Hour),
+			Warmup:      300,
+			For:         Duration(time.Minute),
+			History:     Duration(24 * time.Hour),
+			Metrics:     append([]string(nil), AnomalyMetrics...),
+		},
+	}
+}
+
+// Load 依次应用默认值、配置文件、环境变量和命令行参数，优先级逐级递增。
+// 返回的 printOnly 表示是否指定了 --print-config。
+func Load(args []string) (cfg *Config, printOnly bool, err error) {
+	fs := flag.NewFlagSet("xprobe", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("XPROBE_CONFIG"), "path to YAML config file")
+	printCfg := fs.Bool("print-config", false, "print the effective configuration and exit")
+
+	// 命令行参数先写入临时变量，文件和环境变量处理完之后再覆盖
+	var (
+		listen    = fs.String("listen", "", "listen address, e.g. :8080")
+		staticDir = fs.String("static-dir", "", "directory of the web frontend")
+		publicURL = fs.String("public-url", "", "public base URL of the server, e.g. https://probe.example.com")
+		logLevel  = fs.String("log-level", "", "log level: debug, info, warn, error")
+		mongoURI  = fs.String("mongo-uri", "", "MongoDB connection URI")
+		probDB    = fs.String("prob-db", "", "MongoDB database for probe settings")
+		vpsDB     = fs.String("vps-db", "", "MongoDB database for reported data")
+		retention = fs.String("retention", "", "how long to keep dynamic samples, e.g. 720h; 0 keeps them forever")
+		origins   = fs.String("cors-origins", "", "comma separated list of allowed CORS origins")
+		proxies   = fs.String("trusted-proxies", "", "comma separated list of trusted proxy IPs or CIDRs")
+		tlsListen = fs.String("tls-listen", "", "HTTPS listen address, e.g. :8443")
+		certFile  = fs.String("tls-cert", "", "TLS certificate file")
+		keyFile   = fs.String("tls-key", "", "TLS private key file")
+		clientCA  = fs.String("tls-client-ca", "", "CA file for verifying agent client certificates")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	cfg = Default()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, false, err
+	}
+
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if *staticDir != "" {
+		cfg.StaticDir = *staticDir
+	}
+	if *publicURL != "" {
+		cfg.PublicURL = *publicURL
+	}
+	if *logLevel != "" {
+		cfg.LogLevel = *logLevel
+	}
+	if *mongoURI != "" {
+		cfg.Mongo.URI = *mongoURI
+	}
+	if *probDB != "" {
+		cfg.Mongo.ProbDB = *probDB
+	}
+	if *vpsDB != "" {
+		cfg.Mongo.VPSDB = *vpsDB
+	}
+	if *retention != "" {
+		if err := cfg.Retention.Dynamic.Set(*retention); err != nil {
+			return nil, false, fmt.Errorf("-retention: %v", err)
+		}
+	}
+	if *origins != "" {
+		cfg.CORS.AllowOrigins = splitList(*origins)
+	}
+	if *proxies != "" {
+		cfg.TrustedProxies = splitList(*proxies)
+	}
+	if *certFile != "" {
+		cfg.TLS.CertFile = *certFile
+		cfg.TLS.Enabled = true
+	}
+	if *keyFile != "" {
+		cfg.TLS.KeyFile = *keyFile
+	}
+	if *tlsListen != "" {
+		cfg.TLS.Listen = *tlsListen
+	}
+	if *clientCA != "" {
+		cfg.TLS.ClientCAFile = *clientCA
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, *printCfg, err
+	}
+	return cfg, *printCfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	// MONGO_URI 保留以兼容现有的 docker-compose 部署
+	if v := os.Getenv("MONGO_URI"); v != "" {
+		c.Mongo.URI = v
+	}
+	envString("XPROBE_MONGO_URI", &c.Mongo.URI)
+	envString("XPROBE_PROB_DB", &c.Mongo.ProbDB)
+	envString("XPROBE_VPS_DB", &c.Mongo.VPSDB)
+	envString("XPROBE_LISTEN", &c.Listen)
+	envString("XPROBE_STATIC_DIR", &c.StaticDir)
+	envString("XPROBE_PUBLIC_URL", &c.PublicURL)
+	envString("XPROBE_LOG_LEVEL", &c.LogLevel)
+	// 与 --tls-cert 一致，给出证书即启用 TLS，XPROBE_TLS_ENABLED=false 仍可关闭
+	if v := os.Getenv("XPROBE_TLS_CERT"); v != "" {
+		c.TLS.CertFile = v
+		c.TLS.Enabled = true
+	}
+	envString("XPROBE_TLS_KEY", &c.TLS.KeyFile)
+	envString("XPROBE_TLS_LISTEN", &c.TLS.Listen)
+	envString("XPROBE_TLS_CLIENT_CA", &c.TLS.ClientCAFile)
+	envBool("XPROBE_TLS_ENABLED", &c.TLS.Enabled)
+	envBool("XPROBE_TLS_REDIRECT", &c.TLS.RedirectHTTP)
+	envBool("XPROBE_METRICS_ENABLED", &c.Metrics.Enabled)
+	envString("XPROBE_METRICS_TOKEN", &c.Metrics.BearerToken)
+	envList("XPROBE_CORS_ORIGINS", &c.CORS.AllowOrigins)
+	envList("XPROBE_TRUSTED_PROXIES", &c.TrustedProxies)
+	envString("XPROBE_TRAFFIC_TIMEZONE", &c.Traffic.Timezone)
+	envString("XPROBE_ALERT_WEBHOOK", &c.Alerts.WebhookURL)
+	if v := os.Getenv("XPROBE_TRAFFIC_QUOTA"); v != "" {
+		if err := c.Traffic.Quota.Set(v); err != nil {
+			return fmt.Errorf("XPROBE_TRAFFIC_QUOTA: %v", err)
+		}
+	}
+	if err := envDuration("XPROBE_SHUTDOWN_TIMEOUT", &c.Shutdown.Timeout); err != nil {
+		return err
+	}
+	return envDuration("XPROBE_RETENTION", &c.Retention.Dynamic)
+}
+
+// Validate 检查配置是否可用，在启动时调用
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %v", err))
+	}
+	if c.StaticDir == "" {
+		errs = append(errs, errors.New("staticDir must not be empty"))
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("publicURL: %q is not an absolute http or https URL", c.PublicURL))
+		}
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("logLevel: unknown level %q", c.LogLevel))
+	}
+	for _, p := range c.TrustedProxies {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				errs = append(errs, fmt.Errorf("trustedProxies: %q is neither an IP nor a CIDR", p))
+			}
+		}
+	}
+	if len(c.CORS.AllowOrigins) == 0 {
+		errs = append(errs, errors.New("cors.allowOrigins must list at least one origin"))
+	}
+	if c.TLS.Enabled {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			errs = append(errs, errors.New("tls: certFile and keyFile are required when TLS is enabled"))
+		}
+		if _, _, err := net.SplitHostPort(c.TLS.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("tls.listen: %v", err))
+		} else if c.TLS.Listen == c.Listen {
+			errs = append(errs, errors.New("tls.listen must differ from listen"))
+		}
+		if c.TLS.ReloadInterval < Duration(time.Second) {
+			errs = append(errs, errors.New("tls.reloadInterval must be at least 1s"))
+		}
+	} else if c.TLS.RedirectHTTP || c.TLS.ClientCAFile != "" {
+		errs = append(errs, errors.New("tls.redirectHTTP and tls.clientCAFile require tls.enabled"))
+	}
+	if c.Mongo.URI == "" {
+		errs = append(errs, errors.New("mongo.uri must not be empty"))
+	}
+	if c.Mongo.ProbDB == "" || c.Mongo.VPSDB == "" {
+		errs = append(errs, errors.New("mongo.probDB and mongo.vpsDB must not be empty"))
+	}
+	if c.Mongo.ProbDB == c.Mongo.VPSDB {
+		errs = append(errs, errors.New("mongo.probDB and mongo.vpsDB must differ"))
+	}
+	if c.Mongo.MaxBackoff < Duration(time.Second) {
+		errs = append(errs, errors.New("mongo.maxBackoff must be at least 1s"))
+	}
+	if c.Shutdown.DrainDelay < 0 || c.Shutdown.Timeout <= 0 {
+		errs = append(errs, errors.New("shutdown.drainDelay must not be negative and shutdown.timeout must be positive"))
+	}
+	if c.Nodes.OfflineAfter < Duration(time.Second) {
+		errs = append(errs, errors.New("nodes.offlineAfter must be at least 1s"))
+	}
+	sinkNames := map[string]bool{}
+	for i, sink := range c.Forward.Sinks {
+		if err := sink.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("forward.sinks[%d]: %v", i, err))
+		}
+		if sinkNames[sink.Name] {
+			errs = append(errs, fmt.Errorf("forward.sinks[%d]: duplicate name %q", i, sink.Name))
+		}
+		sinkNames[sink.Name] = true
+	}
+	if c.Traffic.BillingDay < 1 || c.Traffic.BillingDay > 31 {
+		errs = append(errs, errors.New("traffic.billingDay must be between 1 and 31"))
+	}
+	if !ValidTrafficMode(c.Traffic.Mode) {
+		errs = append(errs, fmt.Errorf("traffic.mode: unknown mode %q", c.Traffic.Mode))
+	}
+	if c.Traffic.Timezone != "" {
+		if _, err := time.LoadLocation(c.Traffic.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("traffic.timezone: %v", err))
+		}
+	}
+	if c.Traffic.FlushInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("traffic.flushInterval must be at least 1s"))
+	}
+	for _, t := range c.Traffic.AlertThresholds {
+		if t <= 0 {
+			errs = append(errs, errors.New("traffic.alertThresholds must be positive percentages"))
+			break
+		}
+	}
+	if c.Alerts.WebhookURL != "" && !strings.HasPrefix(c.Alerts.WebhookURL, "http://") && !strings.HasPrefix(c.Alerts.WebhookURL, "https://") {
+		errs = append(errs, errors.New("alerts.webhookURL must be an http or https URL"))
+	}
+	if c.Alerts.WebhookTimeout <= 0 {
+		errs = append(errs, errors.New("alerts.webhookTimeout must be positive"))
+	}
+	if c.Capacity.Window < Duration(time.Hour) {
+		errs = append(errs, errors.New("capacity.window must be at least 1h"))
+	}
+	if c.Capacity.Interval < Duration(time.Second) {
+		errs = append(errs, errors.New("capacity.interval must be at least 1s"))
+	}
+	if c.Capacity.AlertWithin < 0 {
+		errs = append(errs, errors.New("capacity.alertWithin must not be negative"))
+	}
+	if c.Capacity.MinConfidence < 0 || c.Capacity.MinConfidence > 1 {
+		errs = append(errs, errors.New("capacity.minConfidence must be between 0 and 1"))
+	}
+	if c.Anomaly.Sensitivity <= 0 {
+		errs = append(errs, errors.New("anomaly.sensitivity must be positive"))
+	}
+	if c.Anomaly.HalfLife < Duration(time.Minute) {
+		errs = append(errs, errors.New("anomaly.halfLife must be at least 1m"))
+	}
+	if c.Anomaly.Warmup < 1 || c.Anomaly.For < 0 || c.Anomaly.History < 0 {
+		errs = append(errs, errors.New("anomaly.warmup must be positive and anomaly.for, anomaly.history must not be negative"))
+	}
+	for _, m := range c.Anomaly.Metrics {
+		if !ValidAnomalyMetric(m) {
+			errs = append(errs, fmt.Errorf("anomaly.metrics: unknown metric %q", m))
+		}
+	}
+	if c.Retention.Dynamic < 0 {
+		errs = append(errs, errors.New("retention.dynamic must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// AllowAllOrigins 表示 CORS 配置为通配符
+func (c *Config) AllowAllOrigins() bool {
+	for _, o := range c.CORS.AllowOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// YAML 返回配置的 YAML 表示，用于 --print-config。
+// 输出常被贴到 issue 中，令牌、URL 中的用户名密码和凭据参数以及告警 webhook 的路径都会被替换为 REDACTED
+func (c *Config) YAML() ([]byte, error) {
+	r := *c
+	r.Mongo.URI = redactURL(r.Mongo.URI)
+	r.Metrics.BearerToken = redactSecret(r.Metrics.BearerToken)
+	r.Alerts.WebhookURL = redactWebhook(r.Alerts.WebhookURL)
+	r.Forward.Sinks = append([]SinkConfig(nil), c.Forward.Sinks...)
+	for i := range r.Forward.Sinks {
+		s := &r.Forward.Sinks[i]
+		s.URL = redactURL(s.URL)
+		s.Token = redactSecret(s.Token)
+	}
+	return yaml.Marshal(&r)
+}
+
+const redacted = "REDACTED"
+
+// credentialParams 为 URL 中常用来传递凭据的查询参数，如 InfluxDB v1 的 u 和 p
+var credentialParams = []string{"u", "p", "password", "token", "access_token", "apikey", "api_key"}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL 替换 URL 中的用户名密码和凭据参数，MongoDB 的多主机 URI 无法解析时只替换用户名密码
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if at := strings.LastIndex(raw, "@"); at >= 0 {
+			if i := strings.Index(raw, "://"); i >= 0 && i < at {
+				return raw[:i+3] + redacted + raw[at:]
+			}
+		}
+		return raw
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	q := u.Query()
+	changed := false
+	for _, k := range credentialParams {
+		if q.Has(k) {
+			q.Set(k, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactWebhook 只保留 webhook 的协议和主机，Slack 等服务的 webhook 路径本身就是凭据
+func redactWebhook(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return redactSecret(raw)
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		*dst = v
+	}
+}
+
+func envBool(key string, dst *bool) {
+	switch strings.ToLower(os.Getenv(key)) {
+	case "1", "true", "yes", "on":
+		*dst = true
+	case "0", "false", "no", "off":
+		*dst = false
+	}
+}
+
+func envList(key string, dst *[]string) {
+	if v := os.Getenv(key); v != "" {
+		*dst = splitList(v)
+	}
+}
+
+func envDuration(key string, dst *Duration) error {
+	if v := os.Getenv(key); v != "" {
+		if err := dst.Set(v); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
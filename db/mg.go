@@ -2,11 +2,12 @@ package db
 
 import (
 	"context"
-	"log"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type mg struct {
@@ -35,21 +36,119 @@ type cc struct {
 
 var MG mg
 
-func Init(uri string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// 数据库名称，可通过配置修改
+var (
+	ProbName = "prob"
+	VPSName  = "vps"
+)
+
+// Prob 返回存放用户、设置等业务数据的集合
+func Prob(name string) *cc {
+	return MG.CC(ProbName, name)
+}
 
-	clientOptions := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(ctx, clientOptions)
+// VPS 返回存放节点上报数据的集合
+func VPS(name string) *cc {
+	return MG.CC(VPSName, name)
+}
+
+// Init 创建 MongoDB 客户端。mongo.Connect 不会等待数据库可用，
+// 需要再调用 WaitReady 确认连接。
+func Init(uri string) error {
+	clientOptions := options.Client().ApplyURI(uri).SetServerSelectionTimeout(5 * time.Second)
+	client, err := mongo.Connect(context.Background(), clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	MG = mg{client}
+	return nil
+}
+
+// WaitReady 反复 Ping 数据库直到成功，失败时指数退避，最长间隔 maxBackoff。
+// 每次失败后调用 onRetry 报告错误和下次重试前的等待时间
+func WaitReady(ctx context.Context, maxBackoff time.Duration, onRetry func(err error, backoff time.Duration)) error {
+	backoff := time.Second
+	for {
+		err := Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		onRetry(err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	err = client.Ping(ctx, nil)
+	return MG.Ping(ctx, readpref.Primary())
+}
+
+func Close(ctx context.Context) error {
+	return MG.Disconnect(ctx)
+}
+
+// EnsureDedup 为 vps.dynamic 建立节点 ID 和 agent 序号的唯一索引，重试上报的数据不会重复保存。
+// 旧版本 agent 和外部来源的数据没有序号，不受影响
+func EnsureDedup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	_, err := VPS("dynamic").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "id", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetName("id_seq_unique").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// EnsureRetention 为 vps.dynamic 建立查询索引，并按 retention 维护 TTL 索引，
+// retention 为 0 时删除 TTL 索引，数据永久保留
+func EnsureRetention(retention time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dynamic := VPS("dynamic")
+	_, err := dynamic.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "id", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	MG = mg{client}
-	return nil
+
+	const ttlName = "timestamp_ttl"
+	if retention <= 0 {
+		_, err = dynamic.Indexes().DropOne(ctx, ttlName)
+		if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Name == "IndexNotFound" {
+			return nil
+		}
+		return err
+	}
+
+	seconds := int32(retention / time.Second)
+	_, err = dynamic.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetName(ttlName).SetExpireAfterSeconds(seconds),
+	})
+	if err == nil {
+		return nil
+	}
+
+	// 索引已存在但过期时间不同，使用 collMod 修改
+	return VPS("dynamic").Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: "dynamic"},
+		{Key: "index", Value: bson.D{
+			{Key: "name", Value: ttlName},
+			{Key: "expireAfterSeconds", Value: seconds},
+		}},
+	}).Err()
 }
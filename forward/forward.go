@@ -0,0 +1,273 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"server/client"
+	"server/config"
+	"server/health"
+	"server/util"
+	"sync"
+	"time"
+)
+
+// Sink 为外部时序数据库
+type Sink interface {
+	Send(ctx context.Context, batch []client.ServerDynamicData) error
+}
+
+// Status 为一个转发目标的运行状态
+type Status struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Queued int    `json:"queued"`
+	// LagSeconds 为队列中最早一条数据进入队列后等待的时间，补报的旧数据不会显示为延迟
+	LagSeconds  float64   `json:"lagSeconds"`
+	Sent        uint64    `json:"sent"`
+	Dropped     uint64    `json:"dropped"`
+	Failed      uint64    `json:"failed"`
+	Retries     uint64    `json:"retries"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+	LastSentAt  time.Time `json:"lastSentAt,omitempty"`
+}
+
+// maxBackoff 为重试间隔的上限
+const maxBackoff = time.Minute
+
+type forwarder struct {
+	cfg  config.SinkConfig
+	sink Sink
+
+	mu     sync.Mutex
+	queue  []queued
+	notify chan struct{}
+	status Status
+}
+
+// queued 为队列中的一条数据及其进入队列的时间
+type queued struct {
+	data client.ServerDynamicData
+	at   time.Time
+}
+
+var (
+	forwardersMu sync.RWMutex
+	forwarders   []*forwarder
+)
+
+// Start 按配置创建转发目标并注册上报回调，ctx 结束时尽量把队列中剩余的数据发送出去
+func Start(ctx context.Context, sinks []config.SinkConfig, wg *sync.WaitGroup) error {
+	var created []*forwarder
+	for _, sc := range sinks {
+		sc = sc.WithDefaults()
+		sink, err := newSink(sc)
+		if err != nil {
+			return fmt.Errorf("forward sink %s: %v", sc.Name, err)
+		}
+		created = append(created, &forwarder{
+			cfg:    sc,
+			sink:   sink,
+			notify: make(chan struct{}, 1),
+			status: Status{Name: sc.Name, Type: sc.Type},
+		})
+	}
+	if len(created) == 0 {
+		return nil
+	}
+
+	forwardersMu.Lock()
+	forwarders = created
+	forwardersMu.Unlock()
+
+	for _, f := range created {
+		wg.Add(1)
+		go func(f *forwarder) {
+			defer wg.Done()
+			f.run(ctx)
+		}(f)
+	}
+	client.OnDynamic(enqueue)
+	return nil
+}
+
+func newSink(sc config.SinkConfig) (Sink, error) {
+	switch sc.Type {
+	case "influx":
+		return newInfluxSink(sc), nil
+	case "prometheus":
+		return newRemoteWriteSink(sc), nil
+	case "graphite":
+		return newGraphiteSink(sc), nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+}
+
+// enqueue 把数据加入所有转发目标的队列。节点 ID 同时是上报凭据，转发到外部的数据中只使用公开 ID
+func enqueue(data client.ServerDynamicData) {
+	data.ID = client.PublicID(data.ID)
+	item := queued{data: data, at: time.Now()}
+
+	forwardersMu.RLock()
+	defer forwardersMu.RUnlock()
+	for _, f := range forwarders {
+		f.push(item)
+	}
+}
+
+// GetStatus 返回所有转发目标的状态
+func GetStatus() []Status {
+	forwardersMu.RLock()
+	defer forwardersMu.RUnlock()
+
+	now := time.Now()
+	ret := make([]Status, 0, len(forwarders))
+	for _, f := range forwarders {
+		f.mu.Lock()
+		st := f.status
+		st.Queued = len(f.queue)
+		if len(f.queue) > 0 {
+			st.LagSeconds = now.Sub(f.queue[0].at).Seconds()
+		}
+		f.mu.Unlock()
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+func (f *forwarder) push(item queued) {
+	f.mu.Lock()
+	if len(f.queue) >= f.cfg.QueueSize {
+		f.status.Dropped++
+		if f.cfg.DropPolicy == "newest" {
+			f.mu.Unlock()
+			return
+		}
+		f.queue = f.queue[1:]
+	}
+	f.queue = append(f.queue, item)
+	full := len(f.queue) >= f.cfg.BatchSize
+	f.mu.Unlock()
+
+	if full {
+		select {
+		case f.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take 取出最多 BatchSize 条数据
+func (f *forwarder) take() []client.ServerDynamicData {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(f.queue)
+	if n > f.cfg.BatchSize {
+		n = f.cfg.BatchSize
+	}
+	if n == 0 {
+		return nil
+	}
+	batch := make([]client.ServerDynamicData, n)
+	for i := range batch {
+		batch[i] = f.queue[i].data
+	}
+	f.queue = f.queue[n:]
+	return batch
+}
+
+func (f *forwarder) run(ctx context.Context) {
+	interval := f.cfg.FlushInterval.D()
+	worker := health.Register("forward:"+f.cfg.Name, 3*interval+f.cfg.Timeout.D()+maxBackoff)
+	defer worker.Unregister()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			f.drain()
+			return
+		case <-ticker.C:
+		case <-f.notify:
+		}
+		worker.Beat()
+		for {
+			batch := f.take()
+			if batch == nil {
+				break
+			}
+			f.sendWithRetry(ctx, batch, worker)
+			if len(batch) < f.cfg.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+// drain 在退出时尝试发送剩余数据，只尝试一次
+func (f *forwarder) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), f.cfg.Timeout.D())
+	defer cancel()
+	for batch := f.take(); batch != nil; batch = f.take() {
+		if err := f.sink.Send(ctx, batch); err != nil {
+			f.recordFailure(len(batch), err)
+			util.Warnf("Forward sink %s: dropping %d samples on shutdown: %v", f.cfg.Name, len(batch), err)
+			return
+		}
+		f.recordSuccess(len(batch))
+	}
+}
+
+func (f *forwarder) sendWithRetry(ctx context.Context, batch []client.ServerDynamicData, worker *health.Worker) {
+	backoff := f.cfg.RetryBackoff.D()
+	for attempt := 0; ; attempt++ {
+		worker.Beat()
+		sendCtx, cancel := context.WithTimeout(ctx, f.cfg.Timeout.D())
+		err := f.sink.Send(sendCtx, batch)
+		cancel()
+		if err == nil {
+			f.recordSuccess(len(batch))
+			return
+		}
+
+		f.mu.Lock()
+		f.status.LastError = err.Error()
+		f.status.LastErrorAt = time.Now()
+		f.mu.Unlock()
+
+		if attempt >= f.cfg.MaxRetries || ctx.Err() != nil || !retryable(err) {
+			f.recordFailure(len(batch), err)
+			util.Errorf("Forward sink %s: dropping %d samples after %d attempts: %v", f.cfg.Name, len(batch), attempt+1, err)
+			return
+		}
+
+		f.mu.Lock()
+		f.status.Retries++
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (f *forwarder) recordSuccess(n int) {
+	f.mu.Lock()
+	f.status.Sent += uint64(n)
+	f.status.LastSentAt = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *forwarder) recordFailure(n int, err error) {
+	f.mu.Lock()
+	f.status.Failed += uint64(n)
+	f.status.LastError = err.Error()
+	f.status.LastErrorAt = time.Now()
+	f.mu.Unlock()
+}
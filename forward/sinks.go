@@ -0,0 +1,226 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"server/client"
+	"server/config"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field 为转发的一个字段，name 用于 influx 和 graphite，Prometheus 指标名为 xprobe_node_<name>
+type field struct {
+	name  string
+	value func(d client.ServerDynamicData) float64
+}
+
+var fields = []field{
+	{"load1", func(d client.ServerDynamicData) float64 { return d.Load[0] }},
+	{"load5", func(d client.ServerDynamicData) float64 { return d.Load[1] }},
+	{"load15", func(d client.ServerDynamicData) float64 { return d.Load[2] }},
+	{"cpu_usage_percent", func(d client.ServerDynamicData) float64 { return d.CPUUsage }},
+	{"memory_used_bytes", func(d client.ServerDynamicData) float64 { return float64(d.MemoryUsed) }},
+	{"disk_used_bytes", func(d client.ServerDynamicData) float64 { return float64(d.DiskUsed) }},
+	{"network_receive_bytes_per_second", func(d client.ServerDynamicData) float64 { return float64(d.NetworkDownload) }},
+	{"network_transmit_bytes_per_second", func(d client.ServerDynamicData) float64 { return float64(d.NetworkUpload) }},
+	{"network_receive_bytes_total", func(d client.ServerDynamicData) float64 { return float64(d.TrafficDownload) }},
+	{"network_transmit_bytes_total", func(d client.ServerDynamicData) float64 { return float64(d.TrafficUpload) }},
+	{"tcp_connections", func(d client.ServerDynamicData) float64 { return float64(d.TCPCount) }},
+	{"udp_connections", func(d client.ServerDynamicData) float64 { return float64(d.UDPCount) }},
+	{"processes", func(d client.ServerDynamicData) float64 { return float64(d.ProcessCount) }},
+	{"threads", func(d client.ServerDynamicData) float64 { return float64(d.ThreadCount) }},
+}
+
+var httpClient = &http.Client{}
+
+// statusError 为目标返回的错误状态
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, http.StatusText(e.status), e.msg)
+}
+
+// retryable 表示发送失败后是否值得重试。网络错误、5xx、408 和 429 可能在稍后成功，
+// 其他 4xx (如 remote_write 拒绝乱序的补报数据) 重试也不会成功
+func retryable(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.status >= 500 || se.status == http.StatusRequestTimeout || se.status == http.StatusTooManyRequests
+}
+
+func post(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{status: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// influxSink 以 line protocol 写入 InfluxDB
+type influxSink struct {
+	url   string
+	token string
+}
+
+func newInfluxSink(sc config.SinkConfig) *influxSink {
+	return &influxSink{url: sc.URL, token: sc.Token}
+}
+
+var tagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func (s *influxSink) Send(ctx context.Context, batch []client.ServerDynamicData) error {
+	var b bytes.Buffer
+	for _, d := range batch {
+		b.WriteString("xprobe,node=")
+		b.WriteString(tagEscaper.Replace(d.ID))
+		for i, f := range fields {
+			if i == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteByte(',')
+			}
+			b.WriteString(f.name)
+			b.WriteByte('=')
+			b.WriteString(strconv.FormatFloat(f.value(d), 'f', -1, 64))
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(d.Timestamp.UnixNano(), 10))
+		b.WriteByte('\n')
+	}
+
+	headers := map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+	if s.token != "" {
+		headers["Authorization"] = "Token " + s.token
+	}
+	return post(ctx, s.url, b.Bytes(), headers)
+}
+
+// remoteWriteSink 以 Prometheus remote_write 协议 (protobuf + snappy) 写入
+type remoteWriteSink struct {
+	url   string
+	token string
+}
+
+func newRemoteWriteSink(sc config.SinkConfig) *remoteWriteSink {
+	return &remoteWriteSink{url: sc.URL, token: sc.Token}
+}
+
+func (s *remoteWriteSink) Send(ctx context.Context, batch []client.ServerDynamicData) error {
+	// 同一节点同一指标的样本放在同一个 TimeSeries 中，样本需要按时间排序
+	sorted := append([]client.ServerDynamicData(nil), batch...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	byNode := map[string][]client.ServerDynamicData{}
+	var nodes []string
+	for _, d := range sorted {
+		if _, ok := byNode[d.ID]; !ok {
+			nodes = append(nodes, d.ID)
+		}
+		byNode[d.ID] = append(byNode[d.ID], d)
+	}
+
+	var req []byte
+	for _, node := range nodes {
+		for _, f := range fields {
+			var ts []byte
+			// 标签需要按名称排序，__name__ 排在最前
+			ts = appendLabel(ts, "__name__", "xprobe_node_"+f.name)
+			ts = appendLabel(ts, "node", node)
+			for _, d := range byNode[node] {
+				var sample []byte
+				sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+				sample = protowire.AppendFixed64(sample, math.Float64bits(f.value(d)))
+				sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+				sample = protowire.AppendVarint(sample, uint64(d.Timestamp.UnixMilli()))
+				ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, sample)
+			}
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, ts)
+		}
+	}
+
+	headers := map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	}
+	if s.token != "" {
+		headers["Authorization"] = "Bearer " + s.token
+	}
+	return post(ctx, s.url, snappy.Encode(nil, req), headers)
+}
+
+func appendLabel(b []byte, name, value string) []byte {
+	var label []byte
+	label = protowire.AppendTag(label, 1, protowire.BytesType)
+	label = protowire.AppendString(label, name)
+	label = protowire.AppendTag(label, 2, protowire.BytesType)
+	label = protowire.AppendString(label, value)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, label)
+}
+
+// graphiteSink 以 plaintext 协议写入 Graphite
+type graphiteSink struct {
+	address string
+	prefix  string
+}
+
+func newGraphiteSink(sc config.SinkConfig) *graphiteSink {
+	return &graphiteSink{address: sc.Address, prefix: sc.Prefix}
+}
+
+var graphiteEscaper = strings.NewReplacer(".", "_", " ", "_", "/", "_")
+
+func (s *graphiteSink) Send(ctx context.Context, batch []client.ServerDynamicData) error {
+	var b bytes.Buffer
+	for _, d := range batch {
+		node := graphiteEscaper.Replace(d.ID)
+		for _, f := range fields {
+			fmt.Fprintf(&b, "%s.%s.%s %s %d\n", s.prefix, node, f.name,
+				strconv.FormatFloat(f.value(d), 'f', -1, 64), d.Timestamp.Unix())
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(b.Bytes())
+	return err
+}
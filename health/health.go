@@ -0,0 +1,162 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Worker 表示一个后台任务，任务需要定期调用 Beat 表明自己仍在运行
+type Worker struct {
+	name       string
+	maxSilence time.Duration
+	lastBeat   atomic.Int64
+	lastErr    atomic.Value
+	warming    atomic.Bool
+}
+
+var (
+	mu       sync.RWMutex
+	workers  = map[string]*Worker{}
+	started  atomic.Bool
+	stopping atomic.Bool
+)
+
+// Register 注册后台任务，超过 maxSilence 没有 Beat 时视为异常
+func Register(name string, maxSilence time.Duration) *Worker {
+	w := &Worker{name: name, maxSilence: maxSilence}
+	w.Beat()
+
+	mu.Lock()
+	workers[name] = w
+	mu.Unlock()
+	return w
+}
+
+// Unregister 移除后台任务，任务正常退出时调用
+func (w *Worker) Unregister() {
+	mu.Lock()
+	if workers[w.name] == w {
+		delete(workers, w.name)
+	}
+	mu.Unlock()
+}
+
+func (w *Worker) Beat() {
+	w.lastBeat.Store(time.Now().UnixNano())
+	w.lastErr.Store("")
+	w.warming.Store(false)
+}
+
+// WarmUp 标记任务正在加载历史数据，直到下次 Beat 之前不检查心跳，readyz 中显示为 warming up 但不影响就绪
+func (w *Worker) WarmUp() {
+	w.warming.Store(true)
+}
+
+// Fail 记录任务最近一次出错，直到下次 Beat 之前任务都视为异常
+func (w *Worker) Fail(err error) {
+	w.lastErr.Store(err.Error())
+}
+
+func (w *Worker) check(now time.Time) error {
+	if msg, _ := w.lastErr.Load().(string); msg != "" {
+		return fmt.Errorf("%s", msg)
+	}
+	if w.warming.Load() {
+		return nil
+	}
+	silence := now.Sub(time.Unix(0, w.lastBeat.Load()))
+	if silence > w.maxSilence {
+		return fmt.Errorf("no heartbeat for %s", silence.Truncate(time.Second))
+	}
+	return nil
+}
+
+// CheckWorkers 返回异常的后台任务及原因
+func CheckWorkers() map[string]string {
+	now := time.Now()
+	failed := map[string]string{}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for name, w := range workers {
+		if err := w.check(now); err != nil {
+			failed[name] = err.Error()
+		}
+	}
+	return failed
+}
+
+// WarmingWorkers 返回正在加载历史数据的后台任务
+func WarmingWorkers() map[string]bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	warming := map[string]bool{}
+	for name, w := range workers {
+		if w.warming.Load() {
+			warming[name] = true
+		}
+	}
+	return warming
+}
+
+// WorkerNames 返回已注册的后台任务名称
+func WorkerNames() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(workers))
+	for name := range workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetStarted 在数据库连接和初始化完成后调用
+func SetStarted() {
+	started.Store(true)
+}
+
+func Started() bool {
+	return started.Load()
+}
+
+// SetStopping 在收到退出信号后调用，之后 readyz 返回不可用
+func SetStopping() {
+	stopping.Store(true)
+}
+
+func Stopping() bool {
+	return stopping.Load()
+}
+
+// Gate 在启动完成之前拒绝 /api 请求，避免访问尚未初始化的数据库
+func Gate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !started.Load() && strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is starting"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireStarted 用于 /api 以外需要访问数据库的路由
+func RequireStarted() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !started.Load() {
+			c.Header("Retry-After", "5")
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		c.Next()
+	}
+}
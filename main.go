@@ -1,13 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"server/agentconf"
+	"server/agentupdate"
+	"server/alert"
+	"server/anomaly"
+	"server/capacity"
 	"server/client"
+	"server/config"
 	"server/db"
+	"server/forward"
+	"server/health"
+	"server/stream"
+	"server/traffic"
+	"server/uptime"
 	"server/util"
+	"sync"
+	"syscall"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -17,40 +35,90 @@ import (
 )
 
 func main() {
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017" // 默认值
+	cfg, printOnly, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		// -h 已经打印了用法
+		return
+	}
+	if printOnly {
+		if cfg == nil {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+			os.Exit(1)
+		}
+		out, _ := cfg.YAML()
+		fmt.Print(string(out))
+		return
 	}
-	err := db.Init(mongoURI)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	config.C = cfg
+	util.SetLogLevel(cfg.LogLevel)
+	util.SetTrustedProxies(cfg.TrustedProxies)
+	if cfg.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
 	}
-	util.Init()
 
-	// 获取当前工作目录
-	currentDir, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Error getting current directory:", err)
-		return
+	// 收到 SIGINT/SIGTERM 时取消 ctx，开始优雅退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db.ProbName = cfg.Mongo.ProbDB
+	db.VPSName = cfg.Mongo.VPSDB
+	if err := db.Init(cfg.Mongo.URI); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid MongoDB URI:", err)
+		os.Exit(2)
+	}
+
+	// 构建静态文件目录路径，相对路径基于当前工作目录
+	staticDir := cfg.StaticDir
+	if !filepath.IsAbs(staticDir) {
+		currentDir, err := os.Getwd()
+		if err != nil {
+			fmt.Println("Error getting current directory:", err)
+			return
+		}
+		staticDir = filepath.Join(currentDir, staticDir)
 	}
+	// agent 的构建放在静态文件目录下，同时供安装脚本下载和 agent 自动更新
+	agentupdate.SetDir(filepath.Join(staticDir, "agent"))
 
-	// 构建静态文件目录路径
-	staticDir := filepath.Join(currentDir, "html")
+	// 创建 Gin 引擎，访问日志隐去查询参数中的节点密钥
+	r := gin.New()
+	r.Use(util.RequestLogger(), gin.Recovery())
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid trusted proxies:", err)
+		os.Exit(2)
+	}
 
-	// 创建 Gin 引擎
-	r := gin.Default()
+	// 添加 CORS 中间件，通配符来源不能与 credentials 同时使用
+	corsConfig := cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		ExposeHeaders: []string{"Content-Length", "X-New-Token"},
+		MaxAge:        12 * time.Hour,
+	}
+	if cfg.AllowAllOrigins() {
+		corsConfig.AllowAllOrigins = true
+	} else {
+		corsConfig.AllowOrigins = cfg.CORS.AllowOrigins
+		corsConfig.AllowCredentials = true
+	}
+	r.Use(cors.New(corsConfig))
+	r.Use(health.Gate())
 
-	// 添加 CORS 中间件
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	r.GET("/healthz", web.Healthz)
+	r.GET("/readyz", web.Readyz)
+	if cfg.Metrics.Enabled {
+		r.GET("/metrics", web.MetricsAuth(), health.RequireStarted(), web.Metrics)
+	}
 
 	r.GET("/api/status", web.Status)
+	r.GET("/api/node/:id", web.GetNodeDetail)
+	r.GET("/api/status/incidents", web.PublicIncidents)
+	r.GET("/api/status/incidents.rss", web.IncidentsRSS)
+	r.GET("/api/status/incidents.atom", web.IncidentsAtom)
 	r.GET("/api/user", util.Auth(), web.User)
 	r.POST("/api/login", web.Login)
 	r.GET("/api/logout", util.Auth(), web.Logout)
@@ -58,21 +126,190 @@ func main() {
 	r.GET("/api/setting", util.Auth(), web.SettingGet)
 	r.POST("/api/setting", util.Auth(), web.SettingSet)
 	r.POST("/api/node/delete", util.Auth(), web.DeleteNode)
+	r.POST("/api/node/tags", util.Auth(), web.SetNodeTags)
+	r.POST("/api/node/traffic", util.Auth(), web.SetNodeTraffic)
+	r.POST("/api/node/anomaly", util.Auth(), web.SetNodeAnomaly)
+	r.POST("/api/node/visibility", util.Auth(), web.SetNodeVisibility)
+	r.POST("/api/node/identity/reset", util.Auth(), web.ResetNodeIdentity)
+	r.POST("/api/node/agent-config", util.Auth(), web.SetNodeAgentConfig)
+	r.GET("/api/forward/status", util.Auth(), web.ForwardStatus)
+	r.GET("/api/agents/connections", util.Auth(), web.AgentConnections)
+	r.POST("/api/node/command", util.Auth(), web.NodeCommand)
+	r.GET("/api/agents/config", util.Auth(), web.AgentConfigs)
+	r.POST("/api/agents/config/group", util.Auth(), web.SetGroupAgentConfig)
+	r.GET("/api/agents/update", util.Auth(), web.AgentUpdate)
+	r.POST("/api/agents/update", util.Auth(), web.SetAgentUpdate)
+	r.GET("/api/agents/fleet", util.Auth(), web.AgentFleet)
+	r.GET("/api/export", util.Auth(), web.Export)
+	r.GET("/api/alerts", util.Auth(), web.Alerts)
+	r.GET("/api/incidents", util.Auth(), web.ListIncidents)
+	r.POST("/api/incidents", util.Auth(), web.CreateIncident)
+	r.PUT("/api/incidents/:id", util.Auth(), web.UpdateIncident)
+	r.DELETE("/api/incidents/:id", util.Auth(), web.DeleteIncident)
+	r.POST("/api/incidents/:id/updates", util.Auth(), web.AddIncidentUpdate)
+	r.GET("/badge/:node/:metric", health.RequireStarted(), web.Badge)
 	r.GET("/install.sh", web.InstallSh)
 	r.GET("/install.ps1", web.InstallPs)
 	r.GET("/install.cmd", web.InstallCmd)
 
-	r.POST("/api/report/dynamic", client.HandleDynamicReport)
-	r.POST("/api/report/static", client.HandleStaticReport)
+	report := r.Group("/api/report")
+	if cfg.TLS.ClientCAFile != "" {
+		report.Use(util.RequireClientCert())
+	}
+	report.POST("/dynamic", client.HandleDynamicReport)
+	report.POST("/static", client.HandleStaticReport)
+	report.POST("/batch", client.HandleBatchReport)
+	report.GET("/stream", stream.Handle)
+	report.GET("/config", client.HandleAgentConfig)
+	report.GET("/update", client.HandleAgentUpdate)
+	report.GET("/check", client.HandleCheck)
+
+	// 兼容 InfluxDB 写入接口，供 Telegraf 上报
+	r.POST("/write", health.RequireStarted(), client.HandleInfluxWrite)
+	r.POST("/api/v2/write", client.HandleInfluxWrite)
+	r.Match([]string{"GET", "POST"}, "/query", client.HandleInfluxQuery)
+	r.Match([]string{"GET", "HEAD"}, "/ping", client.HandleInfluxPing)
+
+	// OTLP/HTTP 指标接收，供 OpenTelemetry Collector 上报
+	r.POST("/v1/metrics", health.RequireStarted(), client.HandleOTLPMetrics)
 
 	// 设置静态文件服务
 	r.NoRoute(gin.WrapH(http.FileServer(http.Dir(staticDir))))
 
-	// 启动服务器
-	port := 8080
-	fmt.Printf("Starting server on :%d, serving files from %s\n", port, staticDir)
-	err = r.Run(fmt.Sprintf(":%d", port))
+	// 启动服务器，启用 TLS 时同时监听 HTTP 和 HTTPS
+	var servers []*http.Server
+	errCh := make(chan error, 2)
+	workersDone := make(chan struct{})
+	httpHandler := http.Handler(r)
+	if cfg.TLS.Enabled {
+		reloader, err := util.NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading TLS certificate:", err)
+			os.Exit(1)
+		}
+		tlsConfig, err := reloader.TLSConfig(cfg.TLS.ClientCAFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error configuring TLS:", err)
+			os.Exit(1)
+		}
+		go reloader.Watch(cfg.TLS.ReloadInterval.D(), ctx.Done())
+
+		if cfg.TLS.RedirectHTTP {
+			_, port, _ := net.SplitHostPort(cfg.TLS.Listen)
+			httpHandler = util.RedirectToHTTPS(port)
+		}
+
+		httpsServer := &http.Server{
+			Addr:      cfg.TLS.Listen,
+			Handler:   r,
+			TLSConfig: tlsConfig,
+		}
+		servers = append(servers, httpsServer)
+		fmt.Printf("Starting HTTPS server on %s\n", cfg.TLS.Listen)
+		go func() {
+			errCh <- httpsServer.ListenAndServeTLS("", "")
+		}()
+	}
+
+	httpServer := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: httpHandler,
+	}
+	servers = append(servers, httpServer)
+	fmt.Printf("Starting server on %s, serving files from %s\n", cfg.Listen, staticDir)
+	go func() {
+		errCh <- httpServer.ListenAndServe()
+	}()
+
+	// 监听端口后再等待数据库，期间 /healthz 可用，/readyz 返回未就绪
+	go func() {
+		defer close(workersDone)
+		var wg sync.WaitGroup
+		if err := startup(ctx, cfg, &wg); err != nil {
+			return
+		}
+		<-ctx.Done()
+		wg.Wait()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("Error starting server:", err)
+		}
+		stop()
+	case <-ctx.Done():
+	}
+
+	shutdown(cfg, servers, workersDone)
+}
+
+// startup 等待 MongoDB 可用后完成初始化并启动后台任务，后台任务退出时调用 wg.Done
+func startup(ctx context.Context, cfg *config.Config, wg *sync.WaitGroup) error {
+	err := db.WaitReady(ctx, cfg.Mongo.MaxBackoff.D(), func(err error, backoff time.Duration) {
+		util.Warnf("MongoDB is not reachable, retrying in %s: %v", backoff, err)
+	})
 	if err != nil {
-		fmt.Println("Error starting server:", err)
+		return err
+	}
+	util.Init()
+	if err := db.EnsureRetention(cfg.Retention.Dynamic.D()); err != nil {
+		util.Errorf("Error applying retention policy: %v", err)
+	}
+	if err := db.EnsureDedup(); err != nil {
+		util.Errorf("Error creating report deduplication index: %v", err)
+	}
+	if err := forward.Start(ctx, cfg.Forward.Sinks, wg); err != nil {
+		util.Errorf("Error starting forwarders: %v", err)
+	}
+	if err := alert.Start(ctx, cfg.Alerts, wg); err != nil {
+		util.Errorf("Error starting alerts: %v", err)
+	}
+	if err := traffic.Start(ctx, cfg.Traffic, wg); err != nil {
+		util.Errorf("Error starting traffic accounting: %v", err)
+	}
+	if err := uptime.Start(ctx, cfg.Nodes.OfflineAfter.D(), wg); err != nil {
+		util.Errorf("Error starting uptime tracking: %v", err)
+	}
+	if err := capacity.Start(ctx, cfg.Capacity, wg); err != nil {
+		util.Errorf("Error starting capacity forecasting: %v", err)
+	}
+	if err := anomaly.Start(ctx, cfg.Anomaly, wg); err != nil {
+		util.Errorf("Error starting anomaly detection: %v", err)
+	}
+	if err := agentconf.Start(ctx, wg); err != nil {
+		util.Errorf("Error loading agent config: %v", err)
+	}
+	health.SetStarted()
+	util.Infof("Connected to MongoDB, server is ready")
+	return nil
+}
+
+// shutdown 依次摘除就绪状态、停止接受新连接并等待进行中的请求完成，最后断开数据库
+func shutdown(cfg *config.Config, servers []*http.Server, workersDone <-chan struct{}) {
+	health.SetStopping()
+	util.Infof("Shutting down, draining connections")
+	time.Sleep(cfg.Shutdown.DrainDelay.D())
+	// Shutdown 不会等待已经升级为 WebSocket 的连接，先主动关闭
+	stream.CloseAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout.D())
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			util.Errorf("Error shutting down server %s: %v", srv.Addr, err)
+		}
+	}
+
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		util.Warnf("Timed out waiting for background workers")
+	}
+
+	if err := db.Close(ctx); err != nil {
+		util.Errorf("Error disconnecting from MongoDB: %v", err)
 	}
+	util.Infof("Server stopped")
 }
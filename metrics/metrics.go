@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Label 为指标的一个标签
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Writer 按 Prometheus 文本格式 (0.0.4) 输出指标
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Family 输出指标族的 HELP 和 TYPE，同一指标族只能调用一次
+func (mw *Writer) Family(name, help, typ string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// Sample 输出一个样本
+func (mw *Writer) Sample(name string, labels []Label, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l.Name)
+			b.WriteString(`="`)
+			b.WriteString(escapeLabel(l.Value))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatValue(value))
+	b.WriteByte('\n')
+	io.WriteString(mw.w, b.String())
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// collector 为服务端自身的指标
+type collector interface {
+	write(w *Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+}
+
+// WriteRegistered 输出所有通过 NewCounterVec、NewSummaryVec 注册的指标
+func WriteRegistered(w *Writer) {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// CounterVec 为带标签的计数器
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w *Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.Family(c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		w.Sample(c.name, labelsFor(c.labels, key), c.values[key])
+	}
+}
+
+// SummaryVec 为只有 sum 和 count 的摘要，用于统计处理耗时
+type SummaryVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu    sync.Mutex
+	sum   map[string]float64
+	count map[string]float64
+}
+
+func NewSummaryVec(name, help string, labels ...string) *SummaryVec {
+	s := &SummaryVec{name: name, help: help, labels: labels, sum: map[string]float64{}, count: map[string]float64{}}
+	register(s)
+	return s
+}
+
+func (s *SummaryVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	s.mu.Lock()
+	s.sum[key] += v
+	s.count[key]++
+	s.mu.Unlock()
+}
+
+func (s *SummaryVec) write(w *Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Family(s.name, s.help, "summary")
+	for _, key := range sortedKeys(s.count) {
+		labels := labelsFor(s.labels, key)
+		w.Sample(s.name+"_sum", labels, s.sum[key])
+		w.Sample(s.name+"_count", labels, s.count[key])
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelsFor(names []string, key string) []Label {
+	if len(names) == 0 {
+		return nil
+	}
+	values := strings.Split(key, "\xff")
+	labels := make([]Label, len(names))
+	for i, name := range names {
+		labels[i] = Label{Name: name}
+		if i < len(values) {
+			labels[i].Value = values[i]
+		}
+	}
+	return labels
+}
@@ -0,0 +1,348 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/client"
+	"server/util"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Message 为 agent 连接上的一条消息，每个文本帧一条。
+// agent 发送 report，服务端回复 ack；服务端发送 command，agent 回复 result
+type Message struct {
+	Type string `json:"type"`
+	// ID 为请求的编号，ack 和 result 使用对应请求的 ID
+	ID uint64 `json:"id"`
+	// Path 为上报对应的 HTTP 接口，如 api/report/batch
+	Path string `json:"path,omitempty"`
+	// Name 为命令名称
+	Name string `json:"name,omitempty"`
+	// Signature 为 agent 身份私钥对 Data 的签名，同 X-Agent-Signature
+	Signature string          `json:"signature,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	// Status 为上报的处理结果，与 HTTP 接口的状态码相同，成功时 Data 为 HTTP 接口的响应体
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	pingInterval = 30 * time.Second
+	// readTimeout 内没有收到任何消息 (包括 pong) 时断开连接
+	readTimeout  = 3 * pingInterval
+	writeTimeout = 10 * time.Second
+	// maxMessageSize 为一条消息的大小上限，与 HTTP 上报接口一致
+	maxMessageSize = 16 << 20
+)
+
+var (
+	ErrNotConnected = errors.New("agent is not connected")
+	ErrClosed       = errors.New("connection closed")
+)
+
+// Info 为连接的状态
+type Info struct {
+	NodeID      string    `json:"nodeId"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// Conn 为一个 agent 的连接
+type Conn struct {
+	nodeID      string
+	remoteAddr  string
+	connectedAt time.Time
+
+	ws       *websocket.Conn
+	writeMu  sync.Mutex
+	lastSeen atomic.Int64
+	nextID   atomic.Uint64
+	mu       sync.Mutex
+	pending  map[uint64]chan Message
+	closed   chan struct{}
+}
+
+var (
+	mu    sync.Mutex
+	conns = map[string]*Conn{}
+
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:    16 << 10,
+		WriteBufferSize:   16 << 10,
+		EnableCompression: true,
+	}
+)
+
+// Handle 把 agent 的请求升级为 WebSocket 连接并处理到连接断开，认证方式见 client.AuthenticateRequest
+func Handle(c *gin.Context) {
+	nodeID, err := client.AuthenticateRequest(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade 已经写入了错误响应
+		return
+	}
+
+	now := time.Now()
+	conn := &Conn{
+		nodeID:      nodeID,
+		remoteAddr:  c.ClientIP(),
+		connectedAt: now,
+		ws:          ws,
+		pending:     map[uint64]chan Message{},
+		closed:      make(chan struct{}),
+	}
+	conn.lastSeen.Store(now.UnixNano())
+	register(conn)
+	util.Infof("Agent %s connected from %s", nodeID, conn.remoteAddr)
+
+	err = conn.serve()
+	unregister(conn)
+	util.Infof("Agent %s disconnected: %v", nodeID, err)
+}
+
+// register 登记连接，同一个节点之前的连接会被关闭
+func register(conn *Conn) {
+	mu.Lock()
+	prev := conns[conn.nodeID]
+	conns[conn.nodeID] = conn
+	mu.Unlock()
+	if prev != nil {
+		prev.close(websocket.ClosePolicyViolation, "replaced by a new connection")
+	}
+}
+
+func unregister(conn *Conn) {
+	mu.Lock()
+	if conns[conn.nodeID] == conn {
+		delete(conns, conn.nodeID)
+	}
+	mu.Unlock()
+	conn.close(websocket.CloseNormalClosure, "")
+}
+
+// serve 处理连接上的消息，上报按收到的顺序依次处理
+func (c *Conn) serve() error {
+	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(readTimeout))
+	c.ws.SetPongHandler(func(string) error {
+		c.touch()
+		return nil
+	})
+	go c.ping()
+
+	for {
+		var m Message
+		if err := c.ws.ReadJSON(&m); err != nil {
+			return err
+		}
+		c.touch()
+
+		switch m.Type {
+		case "report":
+			ack := Message{Type: "ack", ID: m.ID, Status: http.StatusOK}
+			kind := strings.TrimPrefix(strings.Trim(m.Path, "/"), "api/report/")
+			var resp gin.H
+			var err error
+			if reportFor(kind, m.Data, c.nodeID) {
+				resp, err = client.Ingest(kind, m.Data, m.Signature)
+			} else {
+				err = &client.ReportError{Status: http.StatusForbidden, Reason: "unauthorized", Message: "Report is for a different node than the connection"}
+			}
+			if err != nil {
+				var re *client.ReportError
+				errors.As(err, &re)
+				ack.Status, ack.Error = re.Status, re.Message
+			} else {
+				// 与 HTTP 接口的响应体相同，其中有 agent 应使用的配置版本
+				ack.Data, _ = json.Marshal(resp)
+			}
+			if err := c.write(ack); err != nil {
+				return err
+			}
+		case "result":
+			c.mu.Lock()
+			ch, ok := c.pending[m.ID]
+			delete(c.pending, m.ID)
+			c.mu.Unlock()
+			if ok {
+				ch <- m
+			}
+		}
+	}
+}
+
+// reportFor 表示上报中的节点 ID (batch 为每个样本的节点 ID) 是否都是连接认证的节点。
+// 无法解析的上报交给 client.Ingest 返回错误
+func reportFor(kind string, data []byte, nodeID string) bool {
+	type report struct {
+		ID string `json:"id"`
+	}
+	var reports []report
+	if kind == "batch" {
+		if json.Unmarshal(data, &reports) != nil {
+			return true
+		}
+	} else {
+		var r report
+		if json.Unmarshal(data, &r) != nil {
+			return true
+		}
+		reports = append(reports, r)
+	}
+	for _, r := range reports {
+		if r.ID != nodeID {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Conn) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+	c.ws.SetReadDeadline(time.Now().Add(readTimeout))
+}
+
+func (c *Conn) ping() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		c.writeMu.Lock()
+		err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		c.writeMu.Unlock()
+		if err != nil {
+			c.ws.Close()
+			return
+		}
+	}
+}
+
+func (c *Conn) write(m Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.ws.WriteJSON(m)
+}
+
+// close 发送关闭帧并断开连接，等待中的命令返回 ErrClosed
+func (c *Conn) close(code int, reason string) {
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return
+	default:
+	}
+	close(c.closed)
+	pending := c.pending
+	c.pending = map[uint64]chan Message{}
+	c.mu.Unlock()
+
+	for _, ch := range pending {
+		close(ch)
+	}
+	c.writeMu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	c.ws.Close()
+}
+
+// Command 向节点的 agent 发送命令并等待结果
+func Command(ctx context.Context, nodeID, name string, args json.RawMessage) (json.RawMessage, error) {
+	mu.Lock()
+	c, ok := conns[nodeID]
+	mu.Unlock()
+	if !ok {
+		return nil, ErrNotConnected
+	}
+
+	id := c.nextID.Add(1)
+	ch := make(chan Message, 1)
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(Message{Type: "command", ID: id, Name: name, Data: args}); err != nil {
+		return nil, err
+	}
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if m.Error != "" {
+			return nil, fmt.Errorf("agent: %s", m.Error)
+		}
+		return m.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Connected 表示节点的 agent 当前是否有连接
+func Connected(nodeID string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := conns[nodeID]
+	return ok
+}
+
+// List 返回当前所有连接，按节点 ID 排序
+func List() []Info {
+	mu.Lock()
+	ret := make([]Info, 0, len(conns))
+	for _, c := range conns {
+		ret = append(ret, Info{
+			NodeID:      c.nodeID,
+			RemoteAddr:  c.remoteAddr,
+			ConnectedAt: c.connectedAt,
+			LastSeen:    time.Unix(0, c.lastSeen.Load()),
+		})
+	}
+	mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].NodeID < ret[j].NodeID })
+	return ret
+}
+
+// CloseAll 在服务端退出时关闭所有连接，agent 会重连到其他服务端或改用 HTTP 上报
+func CloseAll() {
+	mu.Lock()
+	all := make([]*Conn, 0, len(conns))
+	for _, c := range conns {
+		all = append(all, c)
+	}
+	mu.Unlock()
+	for _, c := range all {
+		c.close(websocket.CloseGoingAway, "server shutting down")
+	}
+}
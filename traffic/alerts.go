@@ -0,0 +1,62 @@
+package traffic
+
+import (
+	"fmt"
+	"server/alert"
+	"server/util"
+	"time"
+)
+
+// checkAlerts 检查各节点的配额使用比例和预测，用量回落 (如进入新周期) 后恢复告警
+func checkAlerts(now time.Time) {
+	mu.Lock()
+	ids := make([]string, 0, len(ledgers))
+	for id := range ledgers {
+		ids = append(ids, id)
+	}
+	forecastAlert := defaults.ForecastAlert
+	mu.Unlock()
+
+	for _, id := range ids {
+		u, _ := Get(id, now)
+		mu.Lock()
+		thresholds := effective(id).thresholds
+		mu.Unlock()
+
+		for _, t := range thresholds {
+			key := fmt.Sprintf("traffic_quota:%s:%g", id, t)
+			if u.Quota == 0 || u.Percent < t {
+				alert.Resolve(key)
+				continue
+			}
+			level := alert.LevelWarning
+			if t >= 100 {
+				level = alert.LevelCritical
+			}
+			alert.Fire(alert.Event{
+				Key:       key,
+				NodeID:    id,
+				Kind:      "traffic_quota",
+				Level:     level,
+				Message:   fmt.Sprintf("traffic usage %.1f%% of %s quota (cycle ends %s)", u.Percent, util.FormatBytes(u.Quota), u.CycleEnd.Format("2006-01-02")),
+				Value:     u.Percent,
+				Threshold: t,
+			})
+		}
+
+		key := "traffic_forecast:" + id
+		if !forecastAlert || u.Forecast == nil || u.Forecast.ExhaustAt == nil {
+			alert.Resolve(key)
+			continue
+		}
+		alert.Fire(alert.Event{
+			Key:       key,
+			NodeID:    id,
+			Kind:      "traffic_forecast",
+			Level:     alert.LevelWarning,
+			Message:   fmt.Sprintf("traffic quota of %s expected to run out at %s, before the cycle ends", util.FormatBytes(u.Quota), u.Forecast.ExhaustAt.Format(time.RFC3339)),
+			Value:     float64(u.Forecast.ProjectedUsed),
+			Threshold: float64(u.Quota),
+		})
+	}
+}
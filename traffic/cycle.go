@@ -0,0 +1,91 @@
+package traffic
+
+import (
+	"math"
+	"server/client"
+	"time"
+)
+
+// CycleStart 返回 t 所在账单周期的开始时间。
+// day 大于当月天数时取当月最后一天，例如账单日为 31 时二月的周期从 28 日或 29 日开始
+func CycleStart(t time.Time, day int, loc *time.Location) time.Time {
+	t = t.In(loc)
+	start := billingDate(t.Year(), t.Month(), day, loc)
+	if t.Before(start) {
+		start = billingDate(t.Year(), t.Month()-1, day, loc)
+	}
+	return start
+}
+
+// CycleEnd 返回从 start 开始的账单周期的结束时间，即下一个周期的开始时间
+func CycleEnd(start time.Time, day int, loc *time.Location) time.Time {
+	start = start.In(loc)
+	return billingDate(start.Year(), start.Month()+1, day, loc)
+}
+
+func billingDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	// time.Date 会规范化月份，第 0 天即上个月最后一天
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// bootTimeSlack 为判断节点重启时开机时间允许的误差，校时会让计算出的开机时间有少量偏移
+const bootTimeSlack = 60
+
+// counterDelta 计算两次上报之间计数器的增量。
+// restarted 为 true 表示已知节点重启过，计数器从零开始，直接返回当前值；
+// 否则计数器变小时，如果上一次的值接近 32 位或 64 位上限则视为回绕，其余情况说明计数器因为其他原因变小，返回 0 重新取基准
+func counterDelta(last, cur uint64, restarted bool) uint64 {
+	if restarted {
+		return cur
+	}
+	if cur >= last {
+		return cur - last
+	}
+	if last <= math.MaxUint32 && math.MaxUint32-last < 1<<30 {
+		return math.MaxUint32 - last + cur + 1
+	}
+	if math.MaxUint64-last < 1<<62 {
+		return math.MaxUint64 - last + cur + 1
+	}
+	return 0
+}
+
+// legacyDelta 用于没有上报开机时间的旧版 agent：无法区分回绕和重启，不像回绕的下降按重启处理。
+func legacyDelta(last, cur uint64) uint64 {
+	if delta := counterDelta(last, cur, false); delta > 0 || cur >= last {
+		return delta
+	}
+	return cur
+}
+
+func trafficDelta(l *ledger, d client.ServerDynamicData) (in, out uint64) {
+	if d.TrafficScope != l.LastScope || (d.ConfigVersion != "" && l.LastConfig != "" && d.ConfigVersion != l.LastConfig) {
+		return 0, 0
+	}
+	if d.BootTime == 0 || l.LastBoot == 0 {
+		return legacyDelta(l.LastIn, d.TrafficDownload), legacyDelta(l.LastOut, d.TrafficUpload)
+	}
+	diff := d.BootTime - l.LastBoot
+	restarted := diff > bootTimeSlack || diff < -bootTimeSlack
+	return counterDelta(l.LastIn, d.TrafficDownload, restarted), counterDelta(l.LastOut, d.TrafficUpload, restarted)
+}
+
+// Used 按计费方式计算用量
+func Used(mode string, in, out uint64) uint64 {
+	switch mode {
+	case "in":
+		return in
+	case "out":
+		return out
+	case "max":
+		if in > out {
+			return in
+		}
+		return out
+	}
+	return in + out
+}
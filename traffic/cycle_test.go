@@ -0,0 +1,128 @@
+package traffic
+
+import (
+	"math"
+	"server/client"
+	"testing"
+)
+
+func TestTrafficDelta(t *testing.T) {
+	const boot = 1700000000
+	tests := []struct {
+		name    string
+		last    ledger
+		d       client.ServerDynamicData
+		in, out uint64
+	}{
+		{
+			name: "increase",
+			last: ledger{LastIn: 100, LastOut: 50, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 150, TrafficUpload: 80, BootTime: boot, TrafficScope: "a"},
+			in:   50, out: 30,
+		},
+		{
+			name: "32-bit wrap",
+			last: ledger{LastIn: math.MaxUint32 - 10, LastOut: 10, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 5, TrafficUpload: 20, BootTime: boot, TrafficScope: "a"},
+			in:   16, out: 10,
+		},
+		{
+			name: "64-bit wrap",
+			last: ledger{LastIn: math.MaxUint64 - 1, LastOut: 10, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 3, TrafficUpload: 10, BootTime: boot, TrafficScope: "a"},
+			in:   5, out: 0,
+		},
+		{
+			name: "reboot with smaller counters",
+			last: ledger{LastIn: 1 << 40, LastOut: 1 << 40, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 300, TrafficUpload: 200, BootTime: boot + 3600, TrafficScope: "a"},
+			in:   300, out: 200,
+		},
+		{
+			name: "reboot with larger counters",
+			last: ledger{LastIn: 100, LastOut: 100, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 500, TrafficUpload: 400, BootTime: boot + 3600, TrafficScope: "a"},
+			in:   500, out: 400,
+		},
+		{
+			name: "reboot with counters near the 32-bit limit",
+			last: ledger{LastIn: math.MaxUint32 - 10, LastOut: math.MaxUint32 - 10, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 5, TrafficUpload: 7, BootTime: boot + 3600, TrafficScope: "a"},
+			in:   5, out: 7,
+		},
+		{
+			name: "boot time jitter is not a reboot",
+			last: ledger{LastIn: 100, LastOut: 100, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 110, TrafficUpload: 120, BootTime: boot + 1, TrafficScope: "a"},
+			in:   10, out: 20,
+		},
+		{
+			name: "counter drop without reboot",
+			last: ledger{LastIn: 1 << 40, LastOut: 1 << 40, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 1 << 30, TrafficUpload: 1<<40 + 10, BootTime: boot, TrafficScope: "a"},
+			in:   0, out: 10,
+		},
+		{
+			name: "interface removed",
+			last: ledger{LastIn: 1 << 40, LastOut: 1 << 40, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 1 << 30, TrafficUpload: 1 << 30, BootTime: boot, TrafficScope: "b"},
+			in:   0, out: 0,
+		},
+		{
+			name: "interface added to the filter",
+			last: ledger{LastIn: 100, LastOut: 100, LastBoot: boot, LastScope: "a"},
+			d:    client.ServerDynamicData{TrafficDownload: 1 << 40, TrafficUpload: 1 << 40, BootTime: boot, TrafficScope: "b"},
+			in:   0, out: 0,
+		},
+		{
+			name: "config version change",
+			last: ledger{LastIn: 100, LastOut: 100, LastBoot: boot, LastScope: "a", LastConfig: "v1"},
+			d:    client.ServerDynamicData{TrafficDownload: 1 << 40, TrafficUpload: 1 << 40, BootTime: boot, TrafficScope: "a", ConfigVersion: "v2"},
+			in:   0, out: 0,
+		},
+		{
+			name: "same config version",
+			last: ledger{LastIn: 100, LastOut: 100, LastBoot: boot, LastScope: "a", LastConfig: "v1"},
+			d:    client.ServerDynamicData{TrafficDownload: 200, TrafficUpload: 100, BootTime: boot, TrafficScope: "a", ConfigVersion: "v1"},
+			in:   100, out: 0,
+		},
+		{
+			name: "without boot time a drop is a reset",
+			last: ledger{LastIn: 1 << 40, LastOut: 100},
+			d:    client.ServerDynamicData{TrafficDownload: 300, TrafficUpload: 150},
+			in:   300, out: 50,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, out := trafficDelta(&tt.last, tt.d)
+			if in != tt.in || out != tt.out {
+				t.Errorf("trafficDelta() = %d, %d, want %d, %d", in, out, tt.in, tt.out)
+			}
+		})
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		last, cur uint64
+		restarted bool
+		want      uint64
+	}{
+		{"increase", 100, 150, false, 50},
+		{"32-bit wrap", math.MaxUint32 - 10, 5, false, 16},
+		{"64-bit wrap", math.MaxUint64 - 1, 3, false, 5},
+		{"drop", 1 << 40, 300, false, 0},
+		{"restarted near the 32-bit limit", math.MaxUint32 - 10, 5, true, 5},
+		{"restarted near the 64-bit limit", math.MaxUint64 - 1, 3, true, 3},
+		{"restarted with larger counter", 100, 500, true, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterDelta(tt.last, tt.cur, tt.restarted); got != tt.want {
+				t.Errorf("counterDelta() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package traffic
+
+import (
+	"context"
+	"server/client"
+	"server/config"
+	"server/db"
+	"server/health"
+	"server/util"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings 为节点单独设置的账单日、计费方式和配额，未设置的字段使用配置文件中的默认值
+type Settings struct {
+	BillingDay int    `json:"billingDay,omitempty" bson:"billingDay,omitempty"`
+	Mode       string `json:"mode,omitempty" bson:"mode,omitempty"`
+	// Quota 为 nil 时使用默认配额，0 表示不限
+	Quota *uint64 `json:"quota,omitempty" bson:"quota,omitempty"`
+	// AlertThresholds 为触发告警的配额使用百分比，为空时使用默认值
+	AlertThresholds []float64 `json:"alertThresholds,omitempty" bson:"alertThresholds,omitempty"`
+}
+
+// Cycle 为一个已经结束的账单周期
+type Cycle struct {
+	Start time.Time `json:"start" bson:"start"`
+	End   time.Time `json:"end" bson:"end"`
+	In    uint64    `json:"in" bson:"in"`
+	Out   uint64    `json:"out" bson:"out"`
+}
+
+// Usage 为节点当前账单周期和累计的流量
+type Usage struct {
+	Mode       string    `json:"mode"`
+	BillingDay int       `json:"billingDay"`
+	Quota      uint64    `json:"quota"`
+	CycleStart time.Time `json:"cycleStart"`
+	CycleEnd   time.Time `json:"cycleEnd"`
+	In         uint64    `json:"in"`
+	Out        uint64    `json:"out"`
+	// Used 为按计费方式计算的本周期用量
+	Used     uint64  `json:"used"`
+	TotalIn  uint64  `json:"totalIn"`
+	TotalOut uint64  `json:"totalOut"`
+	History  []Cycle `json:"history,omitempty"`
+	// Percent 为本周期用量占配额的百分比，没有配额时为 0
+	Percent  float64   `json:"percent"`
+	Forecast *Forecast `json:"forecast,omitempty"`
+}
+
+// Forecast 为按当前速率对本周期用量的预测
+type Forecast struct {
+	// BytesPerSecond 为最近 24 小时 (不足时为本周期) 按计费方式计算的平均速率
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	// ProjectedUsed 为按当前速率到周期结束时的用量
+	ProjectedUsed uint64 `json:"projectedUsed"`
+	// ExhaustAt 为预计用完配额的时间，没有配额、已经用完或本周期内不会用完时为空
+	ExhaustAt *time.Time `json:"exhaustAt,omitempty"`
+}
+
+// ledger 为一个节点的流量账本，保存在 prob.traffic 中
+type ledger struct {
+	NodeID string `bson:"_id"`
+	// 上一次上报的网卡累计字节数，用于计算增量
+	LastIn  uint64    `bson:"lastIn"`
+	LastOut uint64    `bson:"lastOut"`
+	LastAt  time.Time `bson:"lastAt"`
+	// 上一次上报的开机时间、网卡集合摘要和配置版本，用于判断计数器变小的原因
+	LastBoot   int64     `bson:"lastBoot,omitempty"`
+	LastScope  string    `bson:"lastScope,omitempty"`
+	LastConfig string    `bson:"lastConfig,omitempty"`
+	TotalIn    uint64    `bson:"totalIn"`
+	TotalOut   uint64    `bson:"totalOut"`
+	CycleStart time.Time `bson:"cycleStart"`
+	CycleIn    uint64    `bson:"cycleIn"`
+	CycleOut   uint64    `bson:"cycleOut"`
+	History    []Cycle   `bson:"history"`
+	// Checkpoints 为每小时记录一次的累计流量，用于计算最近的速率
+	Checkpoints []checkpoint `bson:"checkpoints"`
+}
+
+type checkpoint struct {
+	At  time.Time `bson:"at"`
+	In  uint64    `bson:"in"`
+	Out uint64    `bson:"out"`
+}
+
+const (
+	// maxHistory 为每个节点保留的历史周期数
+	maxHistory = 24
+	// rateWindow 为计算预测速率使用的时间窗口
+	rateWindow = 24 * time.Hour
+	// minRateSpan 为计算速率至少需要的数据时长
+	minRateSpan = time.Hour
+	// maxCheckpoints 为保留的检查点数，覆盖 rateWindow
+	maxCheckpoints = 25
+)
+
+var (
+	mu       sync.Mutex
+	defaults = config.Default().Traffic
+	loc      = time.Local
+	ledgers  = map[string]*ledger{}
+	settings = map[string]Settings{}
+	dirty    = map[string]bool{}
+)
+
+// Start 从 MongoDB 加载流量账本并开始统计，ctx 结束时把未保存的账本写回
+func Start(ctx context.Context, cfg config.TrafficConfig, wg *sync.WaitGroup) error {
+	mu.Lock()
+	defaults = cfg
+	loc = cfg.Location()
+	mu.Unlock()
+
+	if err := loadLedgers(ctx); err != nil {
+		return err
+	}
+	if err := loadSettings(ctx); err != nil {
+		return err
+	}
+	client.OnDynamic(record)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run(ctx, cfg.FlushInterval.D())
+	}()
+	return nil
+}
+
+func loadLedgers(ctx context.Context) error {
+	cursor, err := db.Prob("traffic").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var all []*ledger
+	if err := cursor.All(ctx, &all); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, l := range all {
+		ledgers[l.NodeID] = l
+	}
+	return nil
+}
+
+// loadSettings 读取 prob.node 中各节点的流量设置
+func loadSettings(ctx context.Context) error {
+	opts := options.Find().SetProjection(bson.M{"token": 1, "traffic": 1})
+	cursor, err := db.Prob("node").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	var nodes []struct {
+		Token   string   `bson:"token"`
+		Traffic Settings `bson:"traffic"`
+	}
+	if err := cursor.All(ctx, &nodes); err != nil {
+		return err
+	}
+
+	loaded := make(map[string]Settings, len(nodes))
+	for _, n := range nodes {
+		loaded[n.Token] = n.Traffic
+	}
+	mu.Lock()
+	settings = loaded
+	mu.Unlock()
+	return nil
+}
+
+func run(ctx context.Context, interval time.Duration) {
+	worker := health.Register("traffic", 3*interval)
+	defer worker.Unregister()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := flush(flushCtx); err != nil {
+				util.Errorf("Error saving traffic ledgers on shutdown: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+
+		checkAlerts(time.Now())
+		err := flush(ctx)
+		if err == nil {
+			// 节点设置可能被其他实例修改，定期重新读取
+			err = loadSettings(ctx)
+		}
+		if err != nil {
+			worker.Fail(err)
+			util.Errorf("Error saving traffic ledgers: %v", err)
+			continue
+		}
+		worker.Beat()
+	}
+}
+
+// flush 把有变化的账本写入 MongoDB，失败的账本下次重试
+func flush(ctx context.Context) error {
+	mu.Lock()
+	pending := make([]ledger, 0, len(dirty))
+	for id := range dirty {
+		l := *ledgers[id]
+		l.History = append([]Cycle(nil), l.History...)
+		l.Checkpoints = append([]checkpoint(nil), l.Checkpoints...)
+		pending = append(pending, l)
+	}
+	dirty = map[string]bool{}
+	mu.Unlock()
+
+	cc := db.Prob("traffic")
+	for i, l := range pending {
+		_, err := cc.ReplaceOne(ctx, bson.M{"_id": l.NodeID}, l, options.Replace().SetUpsert(true))
+		if err != nil {
+			mu.Lock()
+			for _, p := range pending[i:] {
+				dirty[p.NodeID] = true
+			}
+			mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// resolved 为合并默认值后的节点设置
+type resolved struct {
+	day        int
+	mode       string
+	quota      uint64
+	thresholds []float64
+}
+
+// effective 返回节点生效的设置，调用方需持有 mu
+func effective(nodeID string) resolved {
+	r := resolved{day: defaults.BillingDay, mode: defaults.Mode, quota: uint64(defaults.Quota), thresholds: defaults.AlertThresholds}
+	s := settings[nodeID]
+	if s.BillingDay > 0 {
+		r.day = s.BillingDay
+	}
+	if s.Mode != "" {
+		r.mode = s.Mode
+	}
+	if s.Quota != nil {
+		r.quota = *s.Quota
+	}
+	if len(s.AlertThresholds) > 0 {
+		r.thresholds = s.AlertThresholds
+	}
+	return r
+}
+
+// record 把一条动态数据中的网卡计数器增量计入账本
+func record(d client.ServerDynamicData) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := effective(d.ID)
+	l, ok := ledgers[d.ID]
+	if !ok {
+		// 第一次上报之前的流量无法区分是否属于本周期，不计入
+		ledgers[d.ID] = &ledger{
+			NodeID:     d.ID,
+			LastIn:     d.TrafficDownload,
+			LastOut:    d.TrafficUpload,
+			LastAt:     d.Timestamp,
+			LastBoot:   d.BootTime,
+			LastScope:  d.TrafficScope,
+			LastConfig: d.ConfigVersion,
+			CycleStart: CycleStart(d.Timestamp, s.day, loc),
+		}
+		dirty[d.ID] = true
+		return
+	}
+	// 乱序到达的旧数据会打乱计数器，直接忽略
+	if d.Timestamp.Before(l.LastAt) {
+		return
+	}
+
+	in, out := trafficDelta(l, d)
+	l.LastIn, l.LastOut, l.LastAt = d.TrafficDownload, d.TrafficUpload, d.Timestamp
+	l.LastBoot, l.LastScope = d.BootTime, d.TrafficScope
+	if d.ConfigVersion != "" {
+		l.LastConfig = d.ConfigVersion
+	}
+
+	roll(l, CycleStart(d.Timestamp, s.day, loc))
+	l.CycleIn += in
+	l.CycleOut += out
+	l.TotalIn += in
+	l.TotalOut += out
+	if n := len(l.Checkpoints); n == 0 || d.Timestamp.Sub(l.Checkpoints[n-1].At) >= time.Hour {
+		l.Checkpoints = append(l.Checkpoints, checkpoint{At: d.Timestamp, In: l.TotalIn, Out: l.TotalOut})
+		if len(l.Checkpoints) > maxCheckpoints {
+			l.Checkpoints = l.Checkpoints[len(l.Checkpoints)-maxCheckpoints:]
+		}
+	}
+	dirty[d.ID] = true
+}
+
+// roll 在进入新的账单周期时归档上一个周期
+func roll(l *ledger, start time.Time) {
+	if start.Equal(l.CycleStart) {
+		return
+	}
+	if start.After(l.CycleStart) {
+		l.History = append(l.History, Cycle{Start: l.CycleStart, End: start, In: l.CycleIn, Out: l.CycleOut})
+		if len(l.History) > maxHistory {
+			l.History = l.History[len(l.History)-maxHistory:]
+		}
+		l.CycleIn, l.CycleOut = 0, 0
+	}
+	// 账单日改早时 start 早于原周期开始时间，已统计的流量继续计入新周期
+	l.CycleStart = start
+}
+
+// Get 返回节点在 now 所在账单周期的流量，节点还没有账本时 ok 为 false
+func Get(nodeID string, now time.Time) (u Usage, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := effective(nodeID)
+	u = Usage{
+		Mode:       s.mode,
+		BillingDay: s.day,
+		Quota:      s.quota,
+		CycleStart: CycleStart(now, s.day, loc),
+	}
+	u.CycleEnd = CycleEnd(u.CycleStart, s.day, loc)
+
+	l, ok := ledgers[nodeID]
+	if !ok {
+		return u, false
+	}
+	// 节点在新周期还没有上报时，本周期用量为 0
+	current := !l.CycleStart.Before(u.CycleStart)
+	if current {
+		u.In, u.Out = l.CycleIn, l.CycleOut
+	}
+	u.Used = Used(s.mode, u.In, u.Out)
+	u.TotalIn, u.TotalOut = l.TotalIn, l.TotalOut
+	u.History = append([]Cycle(nil), l.History...)
+	if u.Quota > 0 {
+		u.Percent = float64(u.Used) / float64(u.Quota) * 100
+	}
+	if current {
+		u.Forecast = forecast(l, s, u, now)
+	}
+	return u, true
+}
+
+// forecast 按最近的速率预测本周期结束时的用量和用完配额的时间，调用方需持有 mu
+func forecast(l *ledger, s resolved, u Usage, now time.Time) *Forecast {
+	// 优先使用最近 24 小时内最早且不早于本周期开始的检查点，数据不足时使用整个周期的平均速率
+	var rate float64
+	for _, cp := range l.Checkpoints {
+		span := l.LastAt.Sub(cp.At)
+		if cp.At.Before(u.CycleStart) || span > rateWindow {
+			continue
+		}
+		if span >= minRateSpan {
+			rate = float64(Used(s.mode, l.TotalIn-cp.In, l.TotalOut-cp.Out)) / span.Seconds()
+		}
+		break
+	}
+	if rate == 0 {
+		span := l.LastAt.Sub(u.CycleStart)
+		if span < minRateSpan {
+			return nil
+		}
+		rate = float64(u.Used) / span.Seconds()
+	}
+
+	f := &Forecast{
+		BytesPerSecond: rate,
+		ProjectedUsed:  u.Used + uint64(rate*u.CycleEnd.Sub(now).Seconds()),
+	}
+	if u.Quota > u.Used && rate > 0 {
+		at := now.Add(time.Duration(float64(u.Quota-u.Used) / rate * float64(time.Second)))
+		if at.Before(u.CycleEnd) {
+			f.ExhaustAt = &at
+		}
+	}
+	return f
+}
+
+// SetSettings 更新节点的流量设置，由修改设置的接口在写入数据库后调用
+func SetSettings(nodeID string, s Settings) {
+	mu.Lock()
+	settings[nodeID] = s
+	mu.Unlock()
+}
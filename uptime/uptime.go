@@ -0,0 +1,322 @@
+package uptime
+
+import (
+	"context"
+	"server/client"
+	"server/db"
+	"server/health"
+	"server/util"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outage 为节点两次上报间隔超过心跳阈值的一段时间，保存在 vps.outages 中
+type Outage struct {
+	NodeID string    `json:"-" bson:"node"`
+	Start  time.Time `json:"start" bson:"start"`
+	End    time.Time `json:"end" bson:"end"`
+	// Ongoing 表示节点目前仍未恢复，End 为当前时间
+	Ongoing bool `json:"ongoing,omitempty" bson:"-"`
+}
+
+// Day 为一天的可用率，节点当天还没有开始上报时 Uptime 为空
+type Day struct {
+	Date   string   `json:"date"`
+	Uptime *float64 `json:"uptime"`
+}
+
+// Report 为节点最近 24 小时、7 天、30 天、90 天的可用率 (百分比) 和每日可用率
+type Report struct {
+	Last24h *float64 `json:"24h"`
+	Last7d  *float64 `json:"7d"`
+	Last30d *float64 `json:"30d"`
+	Last90d *float64 `json:"90d"`
+	Days    []Day    `json:"days"`
+	// Outages 为最近的中断记录，最新的在前
+	Outages []Outage `json:"outages,omitempty"`
+}
+
+// state 为节点第一次和最近一次上报的时间，保存在 prob.uptime 中
+type state struct {
+	NodeID    string    `bson:"_id"`
+	FirstSeen time.Time `bson:"firstSeen"`
+	LastSeen  time.Time `bson:"lastSeen"`
+}
+
+const (
+	// serverStateID 为服务端自身心跳在 prob.uptime 中的 _id，用于判断服务端停机的时间段
+	serverStateID = "@server"
+	// keep 为内存中保留的中断记录时长
+	keep = 90 * 24 * time.Hour
+	// flushInterval 为写入 MongoDB 的间隔
+	flushInterval = time.Minute
+	// Days 为每日可用率的天数
+	Days = 90
+)
+
+var (
+	mu        sync.Mutex
+	threshold = 30 * time.Second
+	states    = map[string]*state{}
+	outages   = map[string][]Outage{}
+	dirty     = map[string]bool{}
+	pending   []Outage
+)
+
+// Start 加载节点状态和中断记录并开始根据上报间隔统计可用率，heartbeat 为心跳阈值
+func Start(ctx context.Context, heartbeat time.Duration, wg *sync.WaitGroup) error {
+	now := time.Now()
+	mu.Lock()
+	threshold = heartbeat
+	mu.Unlock()
+
+	if err := ensureIndexes(ctx); err != nil {
+		return err
+	}
+	if err := load(ctx, now); err != nil {
+		return err
+	}
+	client.OnDynamic(record)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run(ctx)
+	}()
+	return nil
+}
+
+func ensureIndexes(ctx context.Context) error {
+	_, err := db.VPS("outages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "node", Value: 1}, {Key: "end", Value: -1}}},
+		// 超过统计窗口的记录没有用处，多保留一段时间后自动删除
+		{Keys: bson.D{{Key: "end", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(2 * keep / time.Second))},
+	})
+	return err
+}
+
+func load(ctx context.Context, now time.Time) error {
+	cursor, err := db.Prob("uptime").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var all []*state
+	if err := cursor.All(ctx, &all); err != nil {
+		return err
+	}
+
+	cursor, err = db.VPS("outages").Find(ctx, bson.M{"end": bson.M{"$gte": now.Add(-keep)}}, options.Find().SetSort(bson.M{"start": 1}))
+	if err != nil {
+		return err
+	}
+	var saved []Outage
+	if err := cursor.All(ctx, &saved); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var server *state
+	for _, s := range all {
+		if s.NodeID == serverStateID {
+			server = s
+			continue
+		}
+		states[s.NodeID] = s
+	}
+	// 服务端停机期间收不到上报，停机时在线的节点视为一直在线
+	if server != nil {
+		for _, s := range states {
+			if !s.LastSeen.Before(server.LastSeen.Add(-threshold)) && s.LastSeen.Before(now) {
+				s.LastSeen = now
+				dirty[s.NodeID] = true
+			}
+		}
+	}
+	for _, o := range saved {
+		outages[o.NodeID] = append(outages[o.NodeID], o)
+	}
+	return nil
+}
+
+func run(ctx context.Context) {
+	worker := health.Register("uptime", 3*flushInterval)
+	defer worker.Unregister()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := flush(flushCtx, time.Now()); err != nil {
+				util.Errorf("Error saving uptime state on shutdown: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+
+		if err := flush(ctx, time.Now()); err != nil {
+			worker.Fail(err)
+			util.Errorf("Error saving uptime state: %v", err)
+			continue
+		}
+		worker.Beat()
+	}
+}
+
+// flush 写入有变化的节点状态、新的中断记录和服务端心跳，失败的部分下次重试
+func flush(ctx context.Context, now time.Time) error {
+	mu.Lock()
+	changed := make([]state, 0, len(dirty)+1)
+	for id := range dirty {
+		changed = append(changed, *states[id])
+	}
+	changed = append(changed, state{NodeID: serverStateID, LastSeen: now})
+	dirty = map[string]bool{}
+	inserts := pending
+	pending = nil
+	// 顺便清理超出统计窗口的中断记录
+	for id, list := range outages {
+		i := sort.Search(len(list), func(i int) bool { return list[i].End.After(now.Add(-keep)) })
+		if i > 0 {
+			outages[id] = append([]Outage(nil), list[i:]...)
+		}
+	}
+	mu.Unlock()
+
+	for i, o := range inserts {
+		if _, err := db.VPS("outages").InsertOne(ctx, o); err != nil {
+			mu.Lock()
+			pending = append(inserts[i:], pending...)
+			for _, s := range changed {
+				if s.NodeID != serverStateID {
+					dirty[s.NodeID] = true
+				}
+			}
+			mu.Unlock()
+			return err
+		}
+	}
+	cc := db.Prob("uptime")
+	for i, s := range changed {
+		_, err := cc.ReplaceOne(ctx, bson.M{"_id": s.NodeID}, s, options.Replace().SetUpsert(true))
+		if err != nil {
+			mu.Lock()
+			for _, s := range changed[i:] {
+				if s.NodeID != serverStateID {
+					dirty[s.NodeID] = true
+				}
+			}
+			mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// record 根据上报间隔判断节点是否中断过
+func record(d client.ServerDynamicData) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := states[d.ID]
+	if !ok {
+		states[d.ID] = &state{NodeID: d.ID, FirstSeen: d.Timestamp, LastSeen: d.Timestamp}
+		dirty[d.ID] = true
+		return
+	}
+	if !d.Timestamp.After(s.LastSeen) {
+		return
+	}
+	if d.Timestamp.Sub(s.LastSeen) > threshold {
+		o := Outage{NodeID: d.ID, Start: s.LastSeen, End: d.Timestamp}
+		outages[d.ID] = append(outages[d.ID], o)
+		pending = append(pending, o)
+	}
+	s.LastSeen = d.Timestamp
+	dirty[d.ID] = true
+}
+
+// Get 计算节点截至 now 的可用率，withOutages 为 true 时附带最近的中断记录
+func Get(nodeID string, now time.Time, withOutages bool) Report {
+	mu.Lock()
+	s, ok := states[nodeID]
+	var first time.Time
+	list := append([]Outage(nil), outages[nodeID]...)
+	if ok {
+		first = s.FirstSeen
+		if now.Sub(s.LastSeen) > threshold {
+			list = append(list, Outage{NodeID: nodeID, Start: s.LastSeen, End: now, Ongoing: true})
+		}
+	}
+	mu.Unlock()
+
+	r := Report{Days: make([]Day, 0, Days)}
+	if !ok {
+		return r
+	}
+	r.Last24h = availability(list, first, now.Add(-24*time.Hour), now)
+	r.Last7d = availability(list, first, now.Add(-7*24*time.Hour), now)
+	r.Last30d = availability(list, first, now.Add(-30*24*time.Hour), now)
+	r.Last90d = availability(list, first, now.Add(-90*24*time.Hour), now)
+
+	local := now.In(time.Local)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+	for i := Days - 1; i >= 0; i-- {
+		start := today.AddDate(0, 0, -i)
+		end := start.AddDate(0, 0, 1)
+		if end.After(now) {
+			end = now
+		}
+		r.Days = append(r.Days, Day{Date: start.Format("2006-01-02"), Uptime: availability(list, first, start, end)})
+	}
+
+	if withOutages {
+		for i := len(list) - 1; i >= 0 && len(r.Outages) < 20; i-- {
+			r.Outages = append(r.Outages, list[i])
+		}
+	}
+	return r
+}
+
+// availability 返回 [from, to) 中可用时间的百分比，节点在 to 之前还没有上报过时返回 nil
+func availability(list []Outage, first, from, to time.Time) *float64 {
+	if from.Before(first) {
+		from = first
+	}
+	total := to.Sub(from)
+	if total <= 0 {
+		return nil
+	}
+	var down time.Duration
+	for _, o := range list {
+		start, end := o.Start, o.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			down += end.Sub(start)
+		}
+	}
+	pct := 100 * (1 - down.Seconds()/total.Seconds())
+	return &pct
+}
+
+// Online 表示节点最近一次上报是否在心跳阈值之内
+func Online(nodeID string, now time.Time) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	s, ok := states[nodeID]
+	return ok && now.Sub(s.LastSeen) <= threshold
+}
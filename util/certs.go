@@ -0,0 +1,156 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"server/health"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CertReloader 持有当前使用的证书，证书或私钥文件变化时自动重新加载
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading key pair: %v", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !certInfo.ModTime().Equal(r.certTime) || !keyInfo.ModTime().Equal(r.keyTime)
+}
+
+// Watch 按 interval 检查证书文件，直到 stop 被关闭。
+// 加载失败时继续使用旧证书，避免证书轮换过程中的中间状态导致服务中断。
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	worker := health.Register("tls-reloader", 3*interval)
+	defer worker.Unregister()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			worker.Beat()
+			if !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				Errorf("Error reloading TLS certificate, keeping the previous one: %v", err)
+				continue
+			}
+			Infof("Reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig 创建服务端 TLS 配置。clientCAFile 不为空时校验客户端证书，
+// 但不强制要求，由 RequireClientCert 在具体路由上决定。
+func (r *CertReloader) TLSConfig(clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
+// RequireClientCert 要求请求通过 TLS 并携带已验证的客户端证书
+func RequireClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "A valid client certificate is required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RedirectToHTTPS 返回把请求跳转到 HTTPS 端口的 handler。使用 308 跳转，
+// 客户端会保留请求方法和请求体，agent 的 POST 上报跳转后仍然有效
+func RedirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusPermanentRedirect)
+	})
+}
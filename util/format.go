@@ -0,0 +1,70 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FormatBytes 以 1024 为进制格式化字节数，如 1.5 GiB
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseSize 把静态数据中的容量 (字节数或 "16GB" 这样带单位的值) 转换为字节数，无法解析时返回 0
+func ParseSize(size string) int {
+	size = strings.TrimSpace(size)
+	if size == "" {
+		return 0
+	}
+
+	// 将大小转换为小写以统一处理
+	size = strings.ToLower(size)
+
+	// 分离数字和单位
+	var numStr string
+	var unit string
+	for i, c := range size {
+		if c < '0' || c > '9' {
+			numStr = size[:i]
+			unit = size[i:]
+			break
+		}
+	}
+
+	// 如果没有找到单位，假设整个字符串都是数字
+	if unit == "" {
+		numStr = size
+	}
+
+	// 解析数字部分
+	num, err := strconv.ParseFloat(numStr, 64)
+	if err != nil {
+		return 0
+	}
+
+	// 根据单位转换为字节
+	switch unit {
+	case "b", "bytes":
+		return int(num)
+	case "k", "kb", "kib":
+		return int(num * 1024)
+	case "m", "mb", "mib":
+		return int(num * 1024 * 1024)
+	case "g", "gb", "gib":
+		return int(num * 1024 * 1024 * 1024)
+	case "t", "tb", "tib":
+		return int(num * 1024 * 1024 * 1024 * 1024)
+	default:
+		return int(num)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"strings"
+	"time"
 )
 
 func DebugRequest(c *gin.Context) {
@@ -69,3 +70,43 @@ func DebugRequest(c *gin.Context) {
 	// Continue with the request
 	c.Next()
 }
+
+// RequestLogger 与 gin.Logger 输出格式相同，但会隐去查询参数中的凭据:
+// InfluxDB v1 客户端把节点密钥放在 p 参数里，不能原样写进访问日志
+func RequestLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if param.IsOutputColor() {
+			statusColor = param.StatusCodeColor()
+			methodColor = param.MethodColor()
+			resetColor = param.ResetColor()
+		}
+		if param.Latency > time.Minute {
+			param.Latency = param.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, param.StatusCode, resetColor,
+			param.Latency,
+			param.ClientIP,
+			methodColor, param.Method, resetColor,
+			redactQuery(param.Path),
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactQuery 把路径中 p 参数的值替换为 REDACTED，其余参数保持原样和原顺序
+func redactQuery(path string) string {
+	base, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	params := strings.Split(query, "&")
+	for i, kv := range params {
+		if key, _, _ := strings.Cut(kv, "="); key == "p" {
+			params[i] = "p=REDACTED"
+		}
+	}
+	return base + "?" + strings.Join(params, "&")
+}
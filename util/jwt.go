@@ -38,7 +38,7 @@ type TokenRecord struct {
 var tokenCollection *mongo.Collection
 
 func Init() {
-	tokenCollection = db2.MG.CC("prob", "tokens").Collection
+	tokenCollection = db2.Prob("tokens").Collection
 
 	_, err := tokenCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
 		{
@@ -42,3 +42,20 @@ func Auth() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// Authenticated 表示请求是否带有有效的登录 token，供公开接口区分访问者，不会中止请求
+func Authenticated(c *gin.Context) bool {
+	parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+	if !(len(parts) == 2 && parts[0] == "Bearer") {
+		return false
+	}
+	newToken, claims, err := ValidateAndRenewToken(parts[1])
+	if err != nil {
+		return false
+	}
+	c.Set("userID", claims.UserID)
+	if newToken != parts[1] {
+		c.Header("X-New-Token", newToken)
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies 设置允许携带 X-Forwarded-Proto 的代理地址，支持 IP 和 CIDR
+func SetTrustedProxies(proxies []string) {
+	trustedProxies = nil
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			trustedProxies = append(trustedProxies, ipNet)
+		}
+	}
+}
+
+func isTrustedProxy(remoteIP string) bool {
+	ip := net.ParseIP(remoteIP)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scheme 返回客户端访问本服务使用的协议，只有来自可信代理的请求才采信 X-Forwarded-Proto
+func Scheme(c *gin.Context) string {
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	if isTrustedProxy(c.RemoteIP()) && c.GetHeader("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
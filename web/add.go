@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"net/url"
 	"server/db"
+	"server/util"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,17 +18,14 @@ import (
 func GetAddSetting(c *gin.Context) AddSetting {
 	hostname := c.Request.Host
 
-	scheme := "http"
-	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
-		scheme = "https"
-	}
+	scheme := util.Scheme(c)
 
 	baseURL := url.URL{
 		Scheme: scheme,
 		Host:   hostname,
 	}
 
-	cc := db.MG.CC("prob", "node")
+	cc := db.Prob("node")
 	token, err := createOrGetUnboundToken(cc.Collection)
 	if err != nil {
 		return AddSetting{}
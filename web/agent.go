@@ -0,0 +1,233 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"server/agentconf"
+	"server/agentupdate"
+	"server/client"
+	"server/db"
+	"server/stream"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AgentConnections 返回当前通过 WebSocket 连接的 agent
+func AgentConnections(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"connections": stream.List()})
+}
+
+type NodeCommandRq struct {
+	ID   string          `json:"id" binding:"required"`
+	Name string          `json:"name" binding:"required"`
+	Args json.RawMessage `json:"args"`
+}
+
+// commandTimeout 为等待 agent 返回命令结果的最长时间
+const commandTimeout = 15 * time.Second
+
+// NodeCommand 通过 WebSocket 连接向节点的 agent 发送命令，如 ping、collect、report-static
+func NodeCommand(c *gin.Context) {
+	var rq NodeCommandRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), commandTimeout)
+	defer cancel()
+
+	result, err := stream.Command(ctx, rq.ID, rq.Name, rq.Args)
+	switch {
+	case errors.Is(err, stream.ErrNotConnected):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent is not connected"})
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Timed out waiting for the agent"})
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"result": result})
+	}
+}
+
+// AgentConfigs 返回各分组的 agent 配置，以及每个节点应使用和正在使用的配置版本
+func AgentConfigs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"groups": agentconf.Groups(), "nodes": agentconf.Nodes()})
+}
+
+type GroupAgentConfigRq struct {
+	// Group 为节点标签
+	Group string `json:"group" binding:"required"`
+	agentconf.Settings
+}
+
+// SetGroupAgentConfig 设置下发给带有某个标签的节点的 agent 配置，设置为空时删除
+func SetGroupAgentConfig(c *gin.Context) {
+	var rq GroupAgentConfigRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := rq.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := agentconf.SetGroup(ctx, rq.Group, rq.Settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update group"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Group agent config updated successfully"})
+}
+
+// AgentUpdate 返回推送的 agent 版本、灰度比例和服务端上的构建
+func AgentUpdate(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	release, err := agentupdate.GetRelease(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get release"})
+		return
+	}
+	builds, err := agentupdate.Builds()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"release": release, "builds": builds})
+}
+
+// SetAgentUpdate 设置推送的 agent 版本和灰度比例，version 为空时停止推送
+func SetAgentUpdate(c *gin.Context) {
+	var rq agentupdate.Release
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := rq.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := agentupdate.SetRelease(ctx, rq); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update release"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Agent release updated successfully"})
+}
+
+// FleetNode 为节点运行的 agent 构建和能采集的数据
+type FleetNode struct {
+	ID       string `json:"id"`
+	HostName string `json:"hostName"`
+	// Source 为数据来源，空表示 xprobe agent
+	Source string `json:"source,omitempty"`
+	// Agent 为 agent 上报的构建信息，旧版本 agent 和外部来源没有
+	Agent          *client.AgentInfo `json:"agent"`
+	LastReportTime time.Time         `json:"lastReportTime"`
+	// Outdated 表示 agent 的版本比最新版本旧 (比推送的版本新的不算)，旧版本 agent 不上报版本号，也算作不是最新版本
+	Outdated bool `json:"outdated"`
+	// MissingCollectors 为 agent 没有开启或所在平台不支持的采集项
+	MissingCollectors []string `json:"missingCollectors,omitempty"`
+}
+
+// AgentFleet 返回所有节点的 agent 版本和采集项，以及版本不是最新和缺少采集项的节点。
+// 最新版本为推送的版本，没有推送时为节点中最新的版本
+func AgentFleet(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	release, err := agentupdate.GetRelease(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get release"})
+		return
+	}
+	cursor, err := db.VPS("static").Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"id": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve nodes"})
+		return
+	}
+	var statics []client.ServerStaticData
+	if err := cursor.All(ctx, &statics); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve nodes"})
+		return
+	}
+
+	latest := release.Version
+	if latest == "" {
+		for _, s := range statics {
+			if s.Agent != nil && versionLess(latest, s.Agent.Version) {
+				latest = s.Agent.Version
+			}
+		}
+	}
+
+	nodes := make([]FleetNode, 0, len(statics))
+	outdated, missing := []string{}, []string{}
+	for _, s := range statics {
+		n := FleetNode{ID: s.ID, HostName: s.HostName, Source: s.Source, Agent: s.Agent, LastReportTime: s.LastReportTime}
+		if s.Source == "" {
+			n.Outdated = s.Agent == nil || (latest != "" && versionLess(s.Agent.Version, latest))
+		}
+		n.MissingCollectors = s.Missing()
+		if n.Outdated {
+			outdated = append(outdated, n.ID)
+		}
+		if len(n.MissingCollectors) > 0 {
+			missing = append(missing, n.ID)
+		}
+		nodes = append(nodes, n)
+	}
+	c.JSON(http.StatusOK, gin.H{"latest": latest, "nodes": nodes, "outdated": outdated, "missingCollectors": missing})
+}
+
+// versionLess 比较 v1.2.3 形式的版本号，无法解析的版本号 (如 dev) 比其他版本旧
+func versionLess(a, b string) bool {
+	pa, pb := parseVersion(a), parseVersion(b)
+	if pa == nil || pb == nil {
+		if (pa == nil) != (pb == nil) {
+			return pa == nil
+		}
+		return a < b
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	// 数字部分相同时预发布版本 (v1.2.0-rc1) 较旧
+	return strings.Contains(a, "-") && !strings.Contains(b, "-")
+}
+
+func parseVersion(v string) []int {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+	v, _, _ = strings.Cut(v, "-")
+	var ret []int
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
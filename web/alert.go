@@ -0,0 +1,36 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"server/alert"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Alerts 返回告警记录，active=1 时只返回当前处于触发状态的告警，node 参数按节点过滤
+func Alerts(c *gin.Context) {
+	nodeID := c.Query("node")
+	if c.Query("active") == "1" {
+		c.JSON(http.StatusOK, gin.H{"alerts": alert.Active(nodeID)})
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", "100"), 10, 64)
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, err := alert.List(ctx, nodeID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve alerts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": events})
+}
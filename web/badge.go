@@ -0,0 +1,213 @@
+package web
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"server/client"
+	"server/db"
+	"server/traffic"
+	"server/uptime"
+	"server/util"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 徽章颜色，与 shields.io 相同
+const (
+	badgeBrightGreen = "#4c1"
+	badgeGreen       = "#97ca00"
+	badgeYellow      = "#dfb317"
+	badgeOrange      = "#fe7d37"
+	badgeRed         = "#e05d44"
+	badgeBlue        = "#007ec6"
+	badgeGrey        = "#9f9f9f"
+)
+
+// badgeMaxAge 为徽章的缓存时间，CDN 可以在重新验证期间继续返回旧的徽章
+const badgeMaxAge = 60
+
+// Badge 返回节点指标的 SVG 徽章，路径为 /badge/:node/:metric.svg。
+// metric 可以是 status、uptime (uptime-7d、uptime-30d、uptime-90d)、cpu、memory、disk、load、traffic，
+// 参数 label 可以替换左侧的文字。节点不存在或已隐藏时返回 404 和灰色的 not found 徽章
+func Badge(c *gin.Context) {
+	metric, ok := strings.CutSuffix(c.Param("metric"), ".svg")
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Badge must end with .svg"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 徽章会嵌入公开的页面，只接受节点的公开 ID
+	id, found := resolveNodeID(ctx, c.Param("node"), false)
+	var static client.ServerStaticData
+	found = found && db.VPS("static").FindOne(ctx, bson.M{"id": id}).Decode(&static) == nil && !nodeHidden(ctx, id)
+
+	label, value, color, known := badgeMetric(ctx, metric, id, static)
+	if custom := c.Query("label"); custom != "" {
+		label = custom
+	}
+	status := http.StatusOK
+	switch {
+	case !known:
+		status, value, color = http.StatusNotFound, "unknown metric", badgeGrey
+	case !found:
+		status, value, color = http.StatusNotFound, "not found", badgeGrey
+	}
+
+	svg := renderBadge(label, value, color)
+	sum := sha1.Sum([]byte(svg))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, s-maxage=%d, stale-while-revalidate=%d", badgeMaxAge, badgeMaxAge, badgeMaxAge))
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(status, "image/svg+xml; charset=utf-8", []byte(svg))
+}
+
+// badgeMetric 返回指标的标签、值和颜色，known 为 false 表示不支持的指标
+func badgeMetric(ctx context.Context, metric, id string, static client.ServerStaticData) (label, value, color string, known bool) {
+	now := time.Now()
+	if strings.HasPrefix(metric, "uptime") {
+		r := uptime.Get(id, now, false)
+		windows := map[string]*float64{"uptime": r.Last24h, "uptime-24h": r.Last24h, "uptime-7d": r.Last7d, "uptime-30d": r.Last30d, "uptime-90d": r.Last90d}
+		pct, ok := windows[metric]
+		if !ok {
+			return metric, "", "", false
+		}
+		label = "uptime"
+		if metric != "uptime" && metric != "uptime-24h" {
+			label = "uptime " + strings.TrimPrefix(metric, "uptime-")
+		}
+		if pct == nil {
+			return label, "n/a", badgeGrey, true
+		}
+		return label, formatPercent(*pct), uptimeColor(*pct), true
+	}
+
+	switch metric {
+	case "status":
+		if uptime.Online(id, now) {
+			return metric, "online", badgeBrightGreen, true
+		}
+		return metric, "offline", badgeRed, true
+	case "traffic":
+		usage, _ := traffic.Get(id, now)
+		if usage.Quota == 0 {
+			return metric, util.FormatBytes(usage.Used), badgeBlue, true
+		}
+		pct := 100 * float64(usage.Used) / float64(usage.Quota)
+		return metric, util.FormatBytes(usage.Used) + " / " + util.FormatBytes(usage.Quota), usageColor(pct), true
+	case "cpu", "memory", "disk", "load":
+	default:
+		return metric, "", "", false
+	}
+
+	d := latestDynamic(ctx, id)
+	if d == nil || !uptime.Online(id, now) {
+		return metric, "n/a", badgeGrey, true
+	}
+	switch metric {
+	case "cpu":
+		return metric, formatPercent(d.CPUUsage), usageColor(d.CPUUsage), true
+	case "memory":
+		value, color = usageValue(d.MemoryUsed, parseMemoryTotal(static.MemoryTotal))
+		return metric, value, color, true
+	case "disk":
+		value, color = usageValue(d.DiskUsed, parseDiskTotal(static.DiskTotal))
+		return metric, value, color, true
+	}
+	return metric, fmt.Sprintf("%.2f %.2f %.2f", d.Load[0], d.Load[1], d.Load[2]), badgeBlue, true
+}
+
+// usageValue 返回使用率和颜色，总量未知时返回已用量
+func usageValue(used uint64, total int) (string, string) {
+	if total <= 0 {
+		return util.FormatBytes(used), badgeBlue
+	}
+	pct := 100 * float64(used) / float64(total)
+	return formatPercent(pct), usageColor(pct)
+}
+
+func formatPercent(pct float64) string {
+	if pct >= 99.995 || pct < 10 {
+		return fmt.Sprintf("%.2f%%", pct)
+	}
+	return fmt.Sprintf("%.1f%%", pct)
+}
+
+func uptimeColor(pct float64) string {
+	switch {
+	case pct >= 99.9:
+		return badgeBrightGreen
+	case pct >= 99:
+		return badgeGreen
+	case pct >= 97:
+		return badgeYellow
+	case pct >= 90:
+		return badgeOrange
+	}
+	return badgeRed
+}
+
+func usageColor(pct float64) string {
+	switch {
+	case pct < 50:
+		return badgeBrightGreen
+	case pct < 75:
+		return badgeGreen
+	case pct < 90:
+		return badgeYellow
+	case pct < 100:
+		return badgeOrange
+	}
+	return badgeRed
+}
+
+// renderBadge 按 shields.io flat 样式绘制徽章
+func renderBadge(label, value, color string) string {
+	lw, vw := textWidth(label)+10, textWidth(value)+10
+	w := lw + vw
+	label, value = html.EscapeString(label), html.EscapeString(value)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`+
+		`<title>%s: %s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%.1f" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%.1f" y="14">%s</text>`+
+		`<text x="%.1f" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%.1f" y="14">%s</text></g></svg>`,
+		w, label, value, label, value, w, lw, lw, vw, color, w,
+		float64(lw)/2, label, float64(lw)/2, label,
+		float64(lw)+float64(vw)/2, value, float64(lw)+float64(vw)/2, value)
+}
+
+// textWidth 估算 11px Verdana 文字的宽度
+func textWidth(s string) int {
+	var w float64
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("iljt.,:;|!'()[] ", r):
+			w += 3.9
+		case strings.ContainsRune("mwMW%", r):
+			w += 10.5
+		case r >= 'A' && r <= 'Z':
+			w += 7.6
+		case r > 0x2e80:
+			// 中日韩文字为全角
+			w += 11
+		default:
+			w += 6.8
+		}
+	}
+	return int(w + 0.5)
+}
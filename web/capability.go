@@ -0,0 +1,67 @@
+package web
+
+import (
+	"encoding/json"
+	"server/client"
+)
+
+// statusFields 为各采集项在节点状态 (ServerData) 中对应的字段
+var statusFields = map[string][]string{
+	"cpu":         {"cpuUsed", "cpuTotal"},
+	"load":        {"load"},
+	"memory":      {"memoryUsed"},
+	"disk":        {"diskUsed"},
+	"network":     {"netDownload", "netUpload", "trafficDownload", "trafficUpload"},
+	"connections": {"tcpCount", "udpCount"},
+	"processes":   {"processCount", "threadCount"},
+}
+
+// dynamicFields 为各采集项在动态数据 (client.ServerDynamicData) 中对应的字段
+var dynamicFields = map[string][]string{
+	"cpu":         {"cpuUsage"},
+	"load":        {"load"},
+	"memory":      {"memoryUsed"},
+	"disk":        {"diskUsed"},
+	"network":     {"networkDownload", "networkUpload", "trafficDownload", "trafficUpload"},
+	"connections": {"tcpCount", "udpCount"},
+	"processes":   {"processCount", "threadCount"},
+}
+
+// unprovidedFields 返回节点不提供的字段，不知道节点能采集哪些数据 (旧版本 agent 和外部来源) 时返回 nil，
+// 此时所有字段照常显示
+func unprovidedFields(static client.ServerStaticData, fields map[string][]string) []string {
+	if static.Agent == nil {
+		return nil
+	}
+	var ret []string
+	for _, name := range static.Missing() {
+		ret = append(ret, fields[name]...)
+	}
+	return ret
+}
+
+// omitFields 把 v 编码为 JSON 对象并删除 fields 中的字段，前端不显示这些字段而不是显示为 0
+func omitFields(v interface{}, fields []string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(fields) == 0 {
+		return data, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		delete(m, f)
+	}
+	return json.Marshal(m)
+}
+
+// dynamicView 为删除了节点不提供的字段的动态数据
+type dynamicView struct {
+	*client.ServerDynamicData
+	omit []string
+}
+
+func (d dynamicView) MarshalJSON() ([]byte, error) {
+	return omitFields(d.ServerDynamicData, d.omit)
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"server/alert"
+	"server/anomaly"
+	"server/capacity"
+	"server/client"
+	"server/config"
+	"server/db"
+	"server/traffic"
+	"server/uptime"
+	"server/util"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NodeDetail 为单个节点的详细信息
+type NodeDetail struct {
+	ID       string                  `json:"id"`
+	PublicID string                  `json:"publicId"`
+	Online   bool                    `json:"online"`
+	Tags     []string                `json:"tags"`
+	Static   client.ServerStaticData `json:"static"`
+	// Dynamic 中不包括节点不提供的字段
+	Dynamic *dynamicView  `json:"dynamic,omitempty"`
+	Traffic traffic.Usage `json:"traffic"`
+	Uptime  uptime.Report `json:"uptime"`
+	// Capacity 为磁盘和内存用满时间的预测
+	Capacity capacity.Report `json:"capacity"`
+	// Baselines 为异常检测各指标当前的基线
+	Baselines map[string]anomaly.Baseline `json:"baselines,omitempty"`
+	Alerts    []alert.Event               `json:"alerts"`
+}
+
+// GetNodeDetail 返回节点的静态信息、最新数据、流量统计和预测、可用率、容量预测以及当前告警。
+// 未登录时路径中为节点的公开 ID，只返回与 /api/status 相同的字段，不包括 IP、身份和告警等信息
+func GetNodeDetail(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authenticated := util.Authenticated(c)
+	id, ok := resolveNodeID(ctx, c.Param("id"), authenticated)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	var detail NodeDetail
+	err := db.VPS("static").FindOne(ctx, bson.M{"id": id}).Decode(&detail.Static)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve node"})
+		return
+	}
+	detail.ID = id
+	detail.PublicID = client.PublicID(id)
+
+	var node Node
+	if err := db.Prob("node").FindOne(ctx, bson.M{"token": id}).Decode(&node); err == nil {
+		detail.Tags = node.Tags
+	}
+	// 隐藏的节点对未登录的访问者与不存在的节点相同
+	if node.Hidden && !authenticated {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	dynamic := latestDynamic(ctx, id)
+	if !authenticated {
+		// 与 /api/status 一样，没有动态数据的节点不显示
+		if dynamic == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+			return
+		}
+		c.JSON(http.StatusOK, newServerData(id, detail.Static, *dynamic, false, false))
+		return
+	}
+
+	now := time.Now()
+	detail.Online = dynamic != nil && now.Sub(dynamic.Timestamp) <= config.C.Nodes.OfflineAfter.D()
+	if dynamic != nil {
+		detail.Dynamic = &dynamicView{ServerDynamicData: dynamic, omit: unprovidedFields(detail.Static, dynamicFields)}
+	}
+
+	detail.Traffic, _ = traffic.Get(id, now)
+	detail.Uptime = uptime.Get(id, now, true)
+	detail.Capacity, _ = capacity.Get(id)
+	detail.Baselines = anomaly.Baselines(id)
+	detail.Alerts = alert.Active(id)
+
+	c.JSON(http.StatusOK, detail)
+}
+
+// latestDynamic 返回节点最近一次上报的动态数据，服务端重启后内存中还没有最新数据时从数据库读取
+func latestDynamic(ctx context.Context, id string) *client.ServerDynamicData {
+	if d, ok := client.Latest(id); ok {
+		return &d
+	}
+	var d client.ServerDynamicData
+	opts := options.FindOne().SetSort(bson.M{"timestamp": -1})
+	if err := db.VPS("dynamic").FindOne(ctx, bson.M{"id": id}, opts).Decode(&d); err != nil {
+		return nil
+	}
+	return &d
+}
@@ -0,0 +1,422 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/client"
+	"server/db"
+	"server/util"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportColumn 为导出的一列，raw 从原始数据取值，agg 为按时间段汇总时的聚合表达式
+type exportColumn struct {
+	name string
+	raw  func(d client.ServerDynamicData) interface{}
+	agg  bson.M
+}
+
+func avgOf(field string) bson.M { return bson.M{"$avg": "$" + field} }
+func maxOf(field string) bson.M { return bson.M{"$max": "$" + field} }
+
+func loadAvg(i int) bson.M {
+	return bson.M{"$avg": bson.M{"$arrayElemAt": bson.A{"$load", i}}}
+}
+
+// 累计流量取时间段内的最大值，其余取平均值
+var exportColumns = []exportColumn{
+	{"timestamp", func(d client.ServerDynamicData) interface{} { return d.Timestamp }, nil},
+	{"id", func(d client.ServerDynamicData) interface{} { return d.ID }, nil},
+	{"load1", func(d client.ServerDynamicData) interface{} { return d.Load[0] }, loadAvg(0)},
+	{"load5", func(d client.ServerDynamicData) interface{} { return d.Load[1] }, loadAvg(1)},
+	{"load15", func(d client.ServerDynamicData) interface{} { return d.Load[2] }, loadAvg(2)},
+	{"cpuUsage", func(d client.ServerDynamicData) interface{} { return d.CPUUsage }, avgOf("cpuUsage")},
+	{"memoryUsed", func(d client.ServerDynamicData) interface{} { return d.MemoryUsed }, avgOf("memoryUsed")},
+	{"diskUsed", func(d client.ServerDynamicData) interface{} { return d.DiskUsed }, avgOf("diskUsed")},
+	{"networkDownload", func(d client.ServerDynamicData) interface{} { return d.NetworkDownload }, avgOf("networkDownload")},
+	{"networkUpload", func(d client.ServerDynamicData) interface{} { return d.NetworkUpload }, avgOf("networkUpload")},
+	{"trafficDownload", func(d client.ServerDynamicData) interface{} { return d.TrafficDownload }, maxOf("trafficDownload")},
+	{"trafficUpload", func(d client.ServerDynamicData) interface{} { return d.TrafficUpload }, maxOf("trafficUpload")},
+	{"tcpCount", func(d client.ServerDynamicData) interface{} { return d.TCPCount }, avgOf("tcpCount")},
+	{"udpCount", func(d client.ServerDynamicData) interface{} { return d.UDPCount }, avgOf("udpCount")},
+	{"processCount", func(d client.ServerDynamicData) interface{} { return d.ProcessCount }, avgOf("processCount")},
+	{"threadCount", func(d client.ServerDynamicData) interface{} { return d.ThreadCount }, avgOf("threadCount")},
+}
+
+// samplesColumn 为汇总导出时每个时间段内的样本数
+var samplesColumn = exportColumn{name: "samples", agg: bson.M{"$sum": 1}}
+
+// exportFlushRows 为每写出多少行刷新一次响应
+const exportFlushRows = 1000
+
+type exportRq struct {
+	nodes   []string
+	from    time.Time
+	to      time.Time
+	format  string
+	columns []exportColumn
+	rollup  time.Duration
+}
+
+// Export 以 CSV 或 NDJSON 流式导出节点的历史数据，参数:
+// nodes 逗号分隔的节点 ID (默认全部)，from/to 时间范围 (RFC3339 或 Unix 秒，默认最近 24 小时)，
+// format 为 csv 或 ndjson，columns 逗号分隔的列名，rollup 汇总时间段 (如 5m、1h、1d，默认导出原始数据)
+func Export(c *gin.Context) {
+	rq, err := parseExportRq(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if len(rq.nodes) == 0 {
+		rq.nodes, err = exportNodeIDs(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list nodes"})
+			return
+		}
+	}
+
+	ext := "csv"
+	contentType := "text/csv; charset=utf-8"
+	if rq.format == "ndjson" {
+		ext = "ndjson"
+		contentType = "application/x-ndjson"
+	}
+	filename := fmt.Sprintf("xprobe-%s-%s.%s", rq.from.UTC().Format("20060102T150405Z"), rq.to.UTC().Format("20060102T150405Z"), ext)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	w := newExportWriter(c, rq.format, rq.columns)
+	w.header()
+	for _, node := range rq.nodes {
+		if rq.rollup > 0 {
+			err = exportRollup(ctx, w, node, rq)
+		} else {
+			err = exportRaw(ctx, w, node, rq)
+		}
+		if err != nil {
+			// 响应头已经发出，在末尾写入错误标记，让客户端知道导出不完整
+			util.Errorf("Export of node %s failed: %v", node, err)
+			w.fail(fmt.Sprintf("export of node %s failed: %v", node, err))
+			break
+		}
+	}
+	w.flush()
+}
+
+func parseExportRq(c *gin.Context) (exportRq, error) {
+	rq := exportRq{
+		to:     time.Now(),
+		format: c.DefaultQuery("format", "csv"),
+	}
+	if rq.format != "csv" && rq.format != "ndjson" {
+		return rq, fmt.Errorf("format must be csv or ndjson")
+	}
+
+	for _, id := range strings.Split(c.Query("nodes"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			rq.nodes = append(rq.nodes, id)
+		}
+	}
+
+	var err error
+	if v := c.Query("to"); v != "" {
+		if rq.to, err = parseExportTime(v); err != nil {
+			return rq, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	rq.from = rq.to.Add(-24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		if rq.from, err = parseExportTime(v); err != nil {
+			return rq, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if !rq.from.Before(rq.to) {
+		return rq, fmt.Errorf("from must be before to")
+	}
+
+	if v := c.Query("rollup"); v != "" {
+		if rq.rollup, err = parseRollup(v); err != nil {
+			return rq, fmt.Errorf("invalid rollup: %v", err)
+		}
+	}
+
+	names := c.Query("columns")
+	if names == "" {
+		rq.columns = append(rq.columns, exportColumns...)
+		if rq.rollup > 0 {
+			rq.columns = append(rq.columns, samplesColumn)
+		}
+		return rq, nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		col, ok := findExportColumn(strings.TrimSpace(name), rq.rollup > 0)
+		if !ok {
+			return rq, fmt.Errorf("unknown column %q", name)
+		}
+		rq.columns = append(rq.columns, col)
+	}
+	return rq, nil
+}
+
+func findExportColumn(name string, rollup bool) (exportColumn, bool) {
+	if rollup && name == samplesColumn.name {
+		return samplesColumn, true
+	}
+	for _, col := range exportColumns {
+		if col.name == name {
+			return col, true
+		}
+	}
+	return exportColumn{}, false
+}
+
+func parseExportTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseRollup 解析汇总时间段，除 time.ParseDuration 的格式外还支持 d (天)
+func parseRollup(v string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(v)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("must be at least 1s")
+	}
+	return d, nil
+}
+
+func exportNodeIDs(ctx context.Context) ([]string, error) {
+	ids, err := db.VPS("static").Distinct(ctx, "id", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if s, ok := id.(string); ok {
+			nodes = append(nodes, s)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+func exportFilter(node string, rq exportRq) bson.M {
+	return bson.M{"id": node, "timestamp": bson.M{"$gte": rq.from, "$lt": rq.to}}
+}
+
+// exportRaw 按时间顺序逐条读取原始数据，每个节点单独查询以利用 {id, timestamp} 索引
+func exportRaw(ctx context.Context, w *exportWriter, node string, rq exportRq) error {
+	opts := options.Find().SetSort(bson.M{"timestamp": 1}).SetBatchSize(exportFlushRows)
+	cursor, err := db.VPS("dynamic").Find(ctx, exportFilter(node, rq), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	values := make([]interface{}, len(rq.columns))
+	for cursor.Next(ctx) {
+		var d client.ServerDynamicData
+		if err := cursor.Decode(&d); err != nil {
+			return err
+		}
+		for i, col := range rq.columns {
+			values[i] = col.raw(d)
+		}
+		if err := w.row(values); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// exportRollup 在 MongoDB 中按时间段汇总后输出
+func exportRollup(ctx context.Context, w *exportWriter, node string, rq exportRq) error {
+	ms := rq.rollup.Milliseconds()
+	ts := bson.M{"$toLong": "$timestamp"}
+	group := bson.M{
+		"_id": bson.M{"$toDate": bson.M{"$subtract": bson.A{ts, bson.M{"$mod": bson.A{ts, ms}}}}},
+	}
+	for _, col := range rq.columns {
+		if col.agg != nil {
+			group[col.name] = col.agg
+		}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: exportFilter(node, rq)}},
+		{{Key: "$group", Value: group}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := db.VPS("dynamic").Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	values := make([]interface{}, len(rq.columns))
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		for i, col := range rq.columns {
+			switch col.name {
+			case "timestamp":
+				values[i] = doc["_id"]
+			case "id":
+				values[i] = node
+			default:
+				values[i] = doc[col.name]
+			}
+		}
+		if err := w.row(values); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// exportWriter 把行写为 CSV 或 NDJSON，每 exportFlushRows 行刷新一次，响应使用 chunked 编码
+type exportWriter struct {
+	c       *gin.Context
+	format  string
+	columns []exportColumn
+	csv     *csv.Writer
+	rows    int
+	record  []string
+	line    bytes.Buffer
+}
+
+func newExportWriter(c *gin.Context, format string, columns []exportColumn) *exportWriter {
+	w := &exportWriter{c: c, format: format, columns: columns, record: make([]string, len(columns))}
+	if format == "csv" {
+		w.csv = csv.NewWriter(c.Writer)
+	}
+	return w
+}
+
+func (w *exportWriter) header() {
+	if w.csv == nil {
+		return
+	}
+	for i, col := range w.columns {
+		w.record[i] = col.name
+	}
+	w.csv.Write(w.record)
+}
+
+func (w *exportWriter) row(values []interface{}) error {
+	var err error
+	if w.csv != nil {
+		for i, v := range values {
+			w.record[i] = formatExportValue(v)
+		}
+		err = w.csv.Write(w.record)
+	} else {
+		err = w.ndjson(values)
+	}
+	if err != nil {
+		return err
+	}
+	w.rows++
+	if w.rows%exportFlushRows == 0 {
+		w.flush()
+	}
+	return w.c.Request.Context().Err()
+}
+
+// ndjson 按列的顺序输出 JSON 对象
+func (w *exportWriter) ndjson(values []interface{}) error {
+	w.line.Reset()
+	w.line.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			w.line.WriteByte(',')
+		}
+		key, _ := json.Marshal(w.columns[i].name)
+		w.line.Write(key)
+		w.line.WriteByte(':')
+		if t, ok := exportTime(v); ok {
+			v = t.UTC().Format(time.RFC3339Nano)
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.line.Write(value)
+	}
+	w.line.WriteString("}\n")
+	_, err := w.c.Writer.Write(w.line.Bytes())
+	return err
+}
+
+// fail 输出导出中断的标记: CSV 为以 # 开头的注释行，NDJSON 为只有 error 字段的对象
+func (w *exportWriter) fail(msg string) {
+	if w.csv != nil {
+		w.csv.Flush()
+		fmt.Fprintf(w.c.Writer, "# error: %s\n", strings.ReplaceAll(msg, "\n", " "))
+		return
+	}
+	line, _ := json.Marshal(gin.H{"error": msg})
+	w.c.Writer.Write(append(line, '\n'))
+}
+
+func (w *exportWriter) flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	w.c.Writer.Flush()
+}
+
+func exportTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case interface{ Time() time.Time }:
+		// 聚合结果中的日期为 primitive.DateTime
+		return t.Time(), true
+	}
+	return time.Time{}, false
+}
+
+func formatExportValue(v interface{}) string {
+	if t, ok := exportTime(v); ok {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case string:
+		return n
+	}
+	return fmt.Sprint(v)
+}
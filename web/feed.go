@@ -0,0 +1,189 @@
+package web
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"server/config"
+	"server/db"
+	"server/util"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// atomAuthor 为订阅级别的作者，RFC 4287 要求没有作者的条目从订阅继承
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// IncidentsRSS 以 RSS 2.0 格式输出状态页通知
+func IncidentsRSS(c *gin.Context) {
+	title, base, incidents, ok := feedData(c)
+	if !ok {
+		return
+	}
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:         title,
+		Link:          base + "/",
+		Description:   title + " incidents and maintenance",
+		LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+	}}
+	for _, in := range incidents {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       incidentFeedTitle(in),
+			Link:        base + "/",
+			GUID:        base + "/incidents/" + in.ID.Hex(),
+			PubDate:     in.UpdatedAt.UTC().Format(time.RFC1123Z),
+			Description: incidentFeedBody(in),
+		})
+	}
+	writeFeed(c, "application/rss+xml; charset=utf-8", feed)
+}
+
+// IncidentsAtom 以 Atom 格式输出状态页通知
+func IncidentsAtom(c *gin.Context) {
+	title, base, incidents, ok := feedData(c)
+	if !ok {
+		return
+	}
+	updated := time.Now()
+	if len(incidents) > 0 {
+		updated = incidents[0].UpdatedAt
+	}
+	feed := atomFeed{
+		Title:   title,
+		ID:      base + "/api/status/incidents.atom",
+		Link:    []atomLink{{Href: base + "/"}, {Href: base + "/api/status/incidents.atom", Rel: "self"}},
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: title},
+	}
+	for _, in := range incidents {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   incidentFeedTitle(in),
+			ID:      base + "/incidents/" + in.ID.Hex(),
+			Link:    atomLink{Href: base + "/"},
+			Updated: in.UpdatedAt.UTC().Format(time.RFC3339),
+			Content: atomContent{Type: "text", Body: incidentFeedBody(in)},
+		})
+	}
+	writeFeed(c, "application/atom+xml; charset=utf-8", feed)
+}
+
+func feedData(c *gin.Context) (string, string, []Incident, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	incidents, err := getPublicIncidents(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve incidents"})
+		return "", "", nil, false
+	}
+	return siteTitle(ctx), feedBase(c), incidents, true
+}
+
+// feedBase 返回订阅中链接的地址前缀，优先使用配置的 publicURL
+func feedBase(c *gin.Context) string {
+	if config.C.PublicURL != "" {
+		return strings.TrimSuffix(config.C.PublicURL, "/")
+	}
+	return util.Scheme(c) + "://" + c.Request.Host
+}
+
+// siteTitle 返回设置中的站点标题
+func siteTitle(ctx context.Context) string {
+	var setting Setting
+	if err := db.Prob("setting").FindOne(ctx, bson.M{}).Decode(&setting); err == nil && setting.About.SiteTitle != "" {
+		return setting.About.SiteTitle
+	}
+	return "XProb"
+}
+
+func incidentFeedTitle(in Incident) string {
+	prefix := "[" + strings.ReplaceAll(in.Status, "_", " ") + "] "
+	if in.Kind == "maintenance" {
+		prefix = "[maintenance " + strings.ReplaceAll(in.Status, "_", " ") + "] "
+	}
+	return prefix + in.Title
+}
+
+// incidentFeedBody 按时间倒序列出时间线上的进展
+func incidentFeedBody(in Incident) string {
+	var b strings.Builder
+	if in.StartsAt != nil && in.EndsAt != nil {
+		fmt.Fprintf(&b, "Scheduled: %s - %s\n", in.StartsAt.UTC().Format(time.RFC3339), in.EndsAt.UTC().Format(time.RFC3339))
+	}
+	for i := len(in.Updates) - 1; i >= 0; i-- {
+		u := in.Updates[i]
+		fmt.Fprintf(&b, "%s %s: %s\n", u.CreatedAt.UTC().Format(time.RFC3339), u.Status, u.Message)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func writeFeed(c *gin.Context, contentType string, feed interface{}) {
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render feed"})
+		return
+	}
+	// 没有配置 publicURL 时链接来自请求的 Host，不能让共享缓存把它提供给其他访问者
+	if config.C.PublicURL != "" {
+		c.Header("Cache-Control", "public, max-age=60")
+	} else {
+		c.Header("Cache-Control", "private, max-age=60")
+	}
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), out...))
+}
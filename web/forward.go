@@ -0,0 +1,13 @@
+package web
+
+import (
+	"net/http"
+	"server/forward"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ForwardStatus 返回各个转发目标的队列长度、延迟和发送统计
+func ForwardStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"sinks": forward.GetStatus()})
+}
@@ -0,0 +1,60 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"server/db"
+	"server/health"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Healthz 存活检查，进程能处理请求即返回成功
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz 就绪检查，检查启动状态、MongoDB 连接和后台任务
+func Readyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	switch {
+	case health.Stopping():
+		checks["server"] = "shutting down"
+		ready = false
+	case !health.Started():
+		checks["server"] = "starting"
+		ready = false
+	default:
+		checks["server"] = "ok"
+	}
+
+	if err := db.Ping(context.Background()); err != nil {
+		checks["mongo"] = err.Error()
+		ready = false
+	} else {
+		checks["mongo"] = "ok"
+	}
+
+	failed := health.CheckWorkers()
+	warming := health.WarmingWorkers()
+	workers := gin.H{}
+	for _, name := range health.WorkerNames() {
+		if msg, ok := failed[name]; ok {
+			workers[name] = msg
+			ready = false
+		} else if warming[name] {
+			workers[name] = "warming up"
+		} else {
+			workers[name] = "ok"
+		}
+	}
+	checks["workers"] = workers
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": ready, "checks": checks})
+}
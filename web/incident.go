@@ -0,0 +1,357 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"server/client"
+	"server/db"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Incident 为状态页上公开的故障或计划维护通知，保存在 prob.incidents 中
+type Incident struct {
+	ID primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	// Kind 为 incident 或 maintenance
+	Kind  string `json:"kind" bson:"kind"`
+	Title string `json:"title" bson:"title"`
+	// Impact 为 none、minor、major 或 critical
+	Impact string `json:"impact" bson:"impact"`
+	// Status 为最新一条进展的状态
+	Status string `json:"status" bson:"status"`
+	// Nodes 为受影响的节点 ID，Groups 为受影响的节点标签
+	Nodes  []string `json:"nodes" bson:"nodes"`
+	Groups []string `json:"groups" bson:"groups"`
+	// StartsAt、EndsAt 为计划维护的时间窗口
+	StartsAt   *time.Time       `json:"startsAt,omitempty" bson:"startsAt,omitempty"`
+	EndsAt     *time.Time       `json:"endsAt,omitempty" bson:"endsAt,omitempty"`
+	Updates    []IncidentUpdate `json:"updates" bson:"updates"`
+	ResolvedAt *time.Time       `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+	CreatedAt  time.Time        `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time        `json:"updatedAt" bson:"updatedAt"`
+}
+
+// IncidentUpdate 为时间线上的一条进展
+type IncidentUpdate struct {
+	Status    string    `json:"status" bson:"status"`
+	Message   string    `json:"message" bson:"message"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// 故障和维护各自的状态，最后一个为结束状态
+var incidentStatuses = map[string][]string{
+	"incident":    {"investigating", "identified", "monitoring", "resolved"},
+	"maintenance": {"scheduled", "in_progress", "completed"},
+}
+
+var incidentImpacts = map[string]bool{"none": true, "minor": true, "major": true, "critical": true}
+
+func validIncidentStatus(kind, status string) bool {
+	for _, s := range incidentStatuses[kind] {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func isFinalStatus(kind, status string) bool {
+	statuses := incidentStatuses[kind]
+	return len(statuses) > 0 && statuses[len(statuses)-1] == status
+}
+
+type IncidentRq struct {
+	Kind     string     `json:"kind"`
+	Title    string     `json:"title" binding:"required"`
+	Impact   string     `json:"impact"`
+	Status   string     `json:"status"`
+	Message  string     `json:"message"`
+	Nodes    []string   `json:"nodes"`
+	Groups   []string   `json:"groups"`
+	StartsAt *time.Time `json:"startsAt"`
+	EndsAt   *time.Time `json:"endsAt"`
+}
+
+// CreateIncident 创建故障或计划维护通知，message 作为时间线上的第一条进展
+func CreateIncident(c *gin.Context) {
+	var rq IncidentRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if rq.Kind == "" {
+		rq.Kind = "incident"
+	}
+	if _, ok := incidentStatuses[rq.Kind]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be incident or maintenance"})
+		return
+	}
+	if rq.Status == "" {
+		rq.Status = incidentStatuses[rq.Kind][0]
+	}
+	if rq.Impact == "" {
+		rq.Impact = "minor"
+	}
+	if msg := validateIncidentRq(rq); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	now := time.Now()
+	incident := Incident{
+		ID:        primitive.NewObjectID(),
+		Kind:      rq.Kind,
+		Title:     rq.Title,
+		Impact:    rq.Impact,
+		Status:    rq.Status,
+		Nodes:     nonNil(rq.Nodes),
+		Groups:    nonNil(rq.Groups),
+		StartsAt:  rq.StartsAt,
+		EndsAt:    rq.EndsAt,
+		Updates:   []IncidentUpdate{{Status: rq.Status, Message: rq.Message, CreatedAt: now}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if isFinalStatus(rq.Kind, rq.Status) {
+		incident.ResolvedAt = &now
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.Prob("incidents").InsertOne(ctx, incident); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create incident"})
+		return
+	}
+	c.JSON(http.StatusOK, incident)
+}
+
+func validateIncidentRq(rq IncidentRq) string {
+	if !validIncidentStatus(rq.Kind, rq.Status) {
+		return "invalid status for " + rq.Kind
+	}
+	if !incidentImpacts[rq.Impact] {
+		return "impact must be one of none, minor, major, critical"
+	}
+	if rq.Kind == "maintenance" && (rq.StartsAt == nil || rq.EndsAt == nil) {
+		return "startsAt and endsAt are required for maintenance"
+	}
+	if rq.StartsAt != nil && rq.EndsAt != nil && !rq.EndsAt.After(*rq.StartsAt) {
+		return "endsAt must be after startsAt"
+	}
+	return ""
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// UpdateIncident 修改通知的标题、影响范围和维护时间，不修改时间线
+func UpdateIncident(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid incident ID"})
+		return
+	}
+	var rq IncidentRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cc := db.Prob("incidents")
+	var incident Incident
+	if err := cc.FindOne(ctx, bson.M{"_id": id}).Decode(&incident); err != nil {
+		incidentLookupError(c, err)
+		return
+	}
+	rq.Kind, rq.Status = incident.Kind, incident.Status
+	if rq.Impact == "" {
+		rq.Impact = incident.Impact
+	}
+	if msg := validateIncidentRq(rq); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	incident.Title = rq.Title
+	incident.Impact = rq.Impact
+	incident.Nodes = nonNil(rq.Nodes)
+	incident.Groups = nonNil(rq.Groups)
+	incident.StartsAt = rq.StartsAt
+	incident.EndsAt = rq.EndsAt
+	incident.UpdatedAt = time.Now()
+	if _, err := cc.ReplaceOne(ctx, bson.M{"_id": id}, incident); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update incident"})
+		return
+	}
+	c.JSON(http.StatusOK, incident)
+}
+
+type IncidentUpdateRq struct {
+	Status  string `json:"status" binding:"required"`
+	Message string `json:"message" binding:"required"`
+}
+
+// AddIncidentUpdate 在时间线上追加一条进展，状态为 resolved 或 completed 时记录结束时间
+func AddIncidentUpdate(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid incident ID"})
+		return
+	}
+	var rq IncidentUpdateRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cc := db.Prob("incidents")
+	var incident Incident
+	if err := cc.FindOne(ctx, bson.M{"_id": id}).Decode(&incident); err != nil {
+		incidentLookupError(c, err)
+		return
+	}
+	if !validIncidentStatus(incident.Kind, rq.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status for " + incident.Kind})
+		return
+	}
+
+	now := time.Now()
+	update := IncidentUpdate{Status: rq.Status, Message: rq.Message, CreatedAt: now}
+	set := bson.M{"status": rq.Status, "updatedAt": now}
+	change := bson.M{"$set": set, "$push": bson.M{"updates": update}}
+	if isFinalStatus(incident.Kind, rq.Status) {
+		set["resolvedAt"] = now
+	} else {
+		// 重新打开已结束的通知
+		change["$unset"] = bson.M{"resolvedAt": ""}
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = cc.FindOneAndUpdate(ctx, bson.M{"_id": id}, change, opts).Decode(&incident)
+	if err != nil {
+		incidentLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, incident)
+}
+
+// DeleteIncident 删除通知
+func DeleteIncident(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid incident ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Prob("incidents").DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete incident"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Incident deleted successfully"})
+}
+
+func incidentLookupError(c *gin.Context, err error) {
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve incident"})
+}
+
+// publicIncidentDays 为公开接口返回已结束通知的天数
+const publicIncidentDays = 30
+
+// getPublicIncidents 返回未结束的通知以及最近 publicIncidentDays 天内结束的通知，按更新时间倒序
+func getPublicIncidents(ctx context.Context) ([]Incident, error) {
+	since := time.Now().AddDate(0, 0, -publicIncidentDays)
+	filter := bson.M{"$or": bson.A{
+		bson.M{"resolvedAt": bson.M{"$exists": false}},
+		bson.M{"resolvedAt": bson.M{"$gte": since}},
+	}}
+	cursor, err := db.Prob("incidents").Find(ctx, filter, options.Find().SetSort(bson.M{"updatedAt": -1}).SetLimit(100))
+	if err != nil {
+		return nil, err
+	}
+	incidents := []Incident{}
+	err = cursor.All(ctx, &incidents)
+	return incidents, err
+}
+
+// PublicIncidents 为状态页公开的故障和维护通知，active 为未结束的，scheduled 为尚未开始的维护
+func PublicIncidents(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	incidents, err := getPublicIncidents(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve incidents"})
+		return
+	}
+	known, err := getNodes(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve incidents"})
+		return
+	}
+
+	now := time.Now()
+	active, scheduled, past := []Incident{}, []Incident{}, []Incident{}
+	for _, in := range incidents {
+		// 公开的通知中只包含未隐藏节点的公开 ID
+		nodes := make([]string, 0, len(in.Nodes))
+		for _, id := range in.Nodes {
+			if !known[id].Hidden {
+				nodes = append(nodes, client.PublicID(id))
+			}
+		}
+		in.Nodes = nodes
+		switch {
+		case in.ResolvedAt != nil:
+			past = append(past, in)
+		case in.Kind == "maintenance" && in.StartsAt != nil && in.StartsAt.After(now):
+			scheduled = append(scheduled, in)
+		default:
+			active = append(active, in)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"active": active, "scheduled": scheduled, "past": past})
+}
+
+// ListIncidents 返回所有通知，供管理界面使用
+func ListIncidents(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.Prob("incidents").Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve incidents"})
+		return
+	}
+	incidents := []Incident{}
+	if err := cursor.All(ctx, &incidents); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve incidents"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"incidents": incidents})
+}
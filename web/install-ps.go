@@ -2,6 +2,7 @@ package web
 
 import (
 	"net/url"
+	"server/util"
 	"text/template"
 
 	"github.com/gin-gonic/gin"
@@ -9,10 +10,7 @@ import (
 
 func InstallPs(c *gin.Context) {
 	host := c.Request.Host
-	scheme := "http"
-	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
-		scheme = "https"
-	}
+	scheme := util.Scheme(c)
 	baseURL := url.URL{
 		Scheme: scheme,
 		Host:   host,
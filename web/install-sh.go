@@ -3,6 +3,7 @@ package web
 import (
 	"github.com/gin-gonic/gin"
 	"net/url"
+	"server/util"
 	"text/template"
 )
 
@@ -12,10 +13,7 @@ type ScriptData struct {
 
 func InstallSh(c *gin.Context) {
 	host := c.Request.Host
-	scheme := "http"
-	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
-		scheme = "https"
-	}
+	scheme := util.Scheme(c)
 	baseURL := url.URL{
 		Scheme: scheme,
 		Host:   host,
@@ -74,7 +74,7 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	userCollection := db2.MG.CC("prob", "user")
+	userCollection := db2.Prob("user")
 
 	if err := InitAdminUser(userCollection.Collection); err != nil {
 		c.JSON(500, gin.H{"error": "Failed to initialize admin user"})
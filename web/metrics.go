@@ -0,0 +1,167 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"runtime"
+	"server/client"
+	"server/config"
+	"server/db"
+	"server/metrics"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var processStart = time.Now()
+
+// nodeSample 为一个在线节点的数据
+type nodeSample struct {
+	labels []metrics.Label
+	s      client.ServerStaticData
+	d      client.ServerDynamicData
+}
+
+// nodeGauge 描述一个从节点数据导出的指标
+type nodeGauge struct {
+	name  string
+	help  string
+	typ   string
+	value func(n nodeSample) float64
+}
+
+var nodeGauges = []nodeGauge{
+	{"xprobe_node_load1", "1-minute load average.", "gauge", func(n nodeSample) float64 { return n.d.Load[0] }},
+	{"xprobe_node_load5", "5-minute load average.", "gauge", func(n nodeSample) float64 { return n.d.Load[1] }},
+	{"xprobe_node_load15", "15-minute load average.", "gauge", func(n nodeSample) float64 { return n.d.Load[2] }},
+	{"xprobe_node_cpu_usage_percent", "CPU usage in percent.", "gauge", func(n nodeSample) float64 { return n.d.CPUUsage }},
+	{"xprobe_node_memory_used_bytes", "Memory in use.", "gauge", func(n nodeSample) float64 { return float64(n.d.MemoryUsed) }},
+	{"xprobe_node_memory_total_bytes", "Total memory.", "gauge", func(n nodeSample) float64 { return float64(parseMemoryTotal(n.s.MemoryTotal)) }},
+	{"xprobe_node_swap_total_bytes", "Total swap.", "gauge", func(n nodeSample) float64 { return float64(parseSwapTotal(n.s.SwapTotal)) }},
+	{"xprobe_node_disk_used_bytes", "Disk space in use across all partitions.", "gauge", func(n nodeSample) float64 { return float64(n.d.DiskUsed) }},
+	{"xprobe_node_disk_total_bytes", "Disk space across all partitions.", "gauge", func(n nodeSample) float64 { return float64(parseDiskTotal(n.s.DiskTotal)) }},
+	{"xprobe_node_network_receive_bytes_per_second", "Current download rate.", "gauge", func(n nodeSample) float64 { return float64(n.d.NetworkDownload) }},
+	{"xprobe_node_network_transmit_bytes_per_second", "Current upload rate.", "gauge", func(n nodeSample) float64 { return float64(n.d.NetworkUpload) }},
+	{"xprobe_node_network_receive_bytes_total", "Bytes received since the node booted.", "counter", func(n nodeSample) float64 { return float64(n.d.TrafficDownload) }},
+	{"xprobe_node_network_transmit_bytes_total", "Bytes sent since the node booted.", "counter", func(n nodeSample) float64 { return float64(n.d.TrafficUpload) }},
+	{"xprobe_node_tcp_connections", "Open TCP connections.", "gauge", func(n nodeSample) float64 { return float64(n.d.TCPCount) }},
+	{"xprobe_node_udp_connections", "Open UDP sockets.", "gauge", func(n nodeSample) float64 { return float64(n.d.UDPCount) }},
+	{"xprobe_node_processes", "Number of processes.", "gauge", func(n nodeSample) float64 { return float64(n.d.ProcessCount) }},
+	{"xprobe_node_threads", "Number of threads.", "gauge", func(n nodeSample) float64 { return float64(n.d.ThreadCount) }},
+}
+
+// MetricsAuth 在配置了 bearerToken 时校验抓取请求
+func MetricsAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := config.C.Metrics.BearerToken
+		if token == "" {
+			c.Next()
+			return
+		}
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Metrics 以 Prometheus 文本格式导出所有节点的最新数据和服务端自身的指标。
+// 离线节点只导出 xprobe_node_up 为 0，不再导出其余指标，Prometheus 会把这些序列标记为 stale。
+// 没有配置 bearerToken 时 /metrics 是公开的，不导出隐藏的节点。
+func Metrics(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.VPS("static").Find(ctx, bson.M{})
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to load nodes: %v\n", err)
+		return
+	}
+	var statics []client.ServerStaticData
+	if err := cursor.All(ctx, &statics); err != nil {
+		c.String(http.StatusInternalServerError, "failed to load nodes: %v\n", err)
+		return
+	}
+	sort.Slice(statics, func(i, j int) bool { return statics[i].ID < statics[j].ID })
+
+	nodes, err := getNodes(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to load nodes: %v\n", err)
+		return
+	}
+	if config.C.Metrics.BearerToken == "" {
+		visible := statics[:0]
+		for _, s := range statics {
+			if !nodes[s.ID].Hidden {
+				visible = append(visible, s)
+			}
+		}
+		statics = visible
+	}
+	latest := client.LatestDynamic()
+	offlineAfter := config.C.Nodes.OfflineAfter.D()
+	now := time.Now()
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := metrics.NewWriter(c.Writer)
+
+	var online []nodeSample
+
+	w.Family("xprobe_node_up", "Whether the node reported within the offline threshold.", "gauge")
+	for _, s := range statics {
+		labels := nodeLabels(s, nodes[s.ID])
+		d, ok := latest[s.ID]
+		up := ok && now.Sub(d.Timestamp) <= offlineAfter
+		if up {
+			online = append(online, nodeSample{labels, s, d})
+			w.Sample("xprobe_node_up", labels, 1)
+		} else {
+			w.Sample("xprobe_node_up", labels, 0)
+		}
+	}
+
+	w.Family("xprobe_node_last_report_timestamp_seconds", "Unix time of the last dynamic report received by this server.", "gauge")
+	for _, s := range statics {
+		if d, ok := latest[s.ID]; ok {
+			w.Sample("xprobe_node_last_report_timestamp_seconds", nodeLabels(s, nodes[s.ID]), float64(d.Timestamp.UnixMilli())/1000)
+		}
+	}
+
+	for _, g := range nodeGauges {
+		w.Family(g.name, g.help, g.typ)
+		for _, n := range online {
+			w.Sample(g.name, n.labels, g.value(n))
+		}
+	}
+
+	w.Family("xprobe_nodes", "Number of known nodes.", "gauge")
+	w.Sample("xprobe_nodes", nil, float64(len(statics)))
+	w.Family("xprobe_nodes_online", "Number of nodes currently online.", "gauge")
+	w.Sample("xprobe_nodes_online", nil, float64(len(online)))
+
+	metrics.WriteRegistered(w)
+
+	w.Family("xprobe_process_start_time_seconds", "Start time of the server process.", "gauge")
+	w.Sample("xprobe_process_start_time_seconds", nil, float64(processStart.Unix()))
+	w.Family("xprobe_goroutines", "Number of goroutines.", "gauge")
+	w.Sample("xprobe_goroutines", nil, float64(runtime.NumGoroutine()))
+}
+
+// nodeLabels 返回节点序列的标签。节点 ID 同时是上报凭据，node 标签只使用公开 ID
+func nodeLabels(s client.ServerStaticData, n Node) []metrics.Label {
+	tags := append([]string(nil), n.Tags...)
+	sort.Strings(tags)
+	return []metrics.Label{
+		{Name: "node", Value: client.PublicID(s.ID)},
+		{Name: "hostname", Value: s.HostName},
+		{Name: "country", Value: s.CountryCode},
+		{Name: "tags", Value: strings.Join(tags, ",")},
+	}
+}
@@ -3,12 +3,18 @@ package web
 import (
 	"context"
 	"net/http"
+	"server/agentconf"
+	"server/anomaly"
+	"server/client"
+	"server/config"
 	"server/db"
+	"server/traffic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Node struct {
@@ -16,6 +22,17 @@ type Node struct {
 	Token     string    `bson:"token"`
 	CreatedAt time.Time `bson:"createdAt"`
 	Bound     bool      `bson:"bound"`
+	Tags      []string  `bson:"tags,omitempty"`
+	// Traffic 为节点的账单日、计费方式和流量配额
+	Traffic traffic.Settings `bson:"traffic,omitempty"`
+	// Anomaly 为节点的异常检测开关、灵敏度和指标
+	Anomaly anomaly.Settings `bson:"anomaly,omitempty"`
+	// Hidden 为 true 时节点不在公开的状态页、节点详情和徽章中显示，登录后仍可见
+	Hidden bool `bson:"hidden,omitempty"`
+	// AgentConfig 为下发给节点 agent 的配置，优先于分组的配置
+	AgentConfig agentconf.Settings `bson:"agentConfig,omitempty"`
+	// AgentConfigVersion 为 agent 上报的正在使用的配置版本
+	AgentConfigVersion string `bson:"agentConfigVersion,omitempty"`
 	// 其他节点信息字段
 }
 
@@ -31,7 +48,7 @@ func DeleteNode(c *gin.Context) {
 	}
 
 	// 获取MongoDB集合
-	collection := db.MG.CC("vps", "nodes")
+	collection := db.VPS("nodes")
 
 	// 执行删除操作
 	result, err := collection.DeleteOne(context.TODO(), bson.M{"_id": nodeID})
@@ -47,3 +64,247 @@ func DeleteNode(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Node deleted successfully"})
 }
+
+type NodeTagsRq struct {
+	ID   string   `json:"id" binding:"required"`
+	Tags []string `json:"tags"`
+}
+
+// SetNodeTags 设置节点标签，ID 为节点上报时使用的 ID
+func SetNodeTags(c *gin.Context) {
+	var rq NodeTagsRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Prob("node").UpdateOne(ctx, bson.M{"token": rq.ID}, bson.M{"$set": bson.M{"tags": rq.Tags}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	agentconf.SetTags(rq.ID, rq.Tags)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node tags updated successfully"})
+}
+
+type NodeTrafficRq struct {
+	ID string `json:"id" binding:"required"`
+	traffic.Settings
+}
+
+// SetNodeTraffic 设置节点的账单日、计费方式和流量配额，未设置的字段使用配置文件中的默认值
+func SetNodeTraffic(c *gin.Context) {
+	var rq NodeTrafficRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if rq.BillingDay < 0 || rq.BillingDay > 31 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "billingDay must be between 1 and 31"})
+		return
+	}
+	if rq.Mode != "" && !config.ValidTrafficMode(rq.Mode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be one of in, out, max, sum"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Prob("node").UpdateOne(ctx, bson.M{"token": rq.ID}, bson.M{"$set": bson.M{"traffic": rq.Settings}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+	traffic.SetSettings(rq.ID, rq.Settings)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node traffic settings updated successfully"})
+}
+
+type NodeAnomalyRq struct {
+	ID string `json:"id" binding:"required"`
+	anomaly.Settings
+}
+
+// SetNodeAnomaly 设置节点是否开启异常检测以及灵敏度和检测的指标，未设置的字段使用配置文件中的默认值
+func SetNodeAnomaly(c *gin.Context) {
+	var rq NodeAnomalyRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if rq.Sensitivity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sensitivity must be positive"})
+		return
+	}
+	for _, m := range rq.Metrics {
+		if !config.ValidAnomalyMetric(m) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown metric " + m})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Prob("node").UpdateOne(ctx, bson.M{"token": rq.ID}, bson.M{"$set": bson.M{"anomaly": rq.Settings}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+	anomaly.SetSettings(rq.ID, rq.Settings)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node anomaly detection settings updated successfully"})
+}
+
+type NodeAgentConfigRq struct {
+	ID string `json:"id" binding:"required"`
+	agentconf.Settings
+}
+
+// SetNodeAgentConfig 设置下发给节点 agent 的配置，未设置的字段使用分组或 agent 本地的配置
+func SetNodeAgentConfig(c *gin.Context) {
+	var rq NodeAgentConfigRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := rq.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Prob("node").UpdateOne(ctx, bson.M{"token": rq.ID}, bson.M{"$set": bson.M{"agentConfig": rq.Settings}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+	agentconf.SetNode(rq.ID, rq.Settings)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node agent config updated successfully", "version": agentconf.Version(rq.ID)})
+}
+
+type NodeVisibilityRq struct {
+	ID     string `json:"id" binding:"required"`
+	Hidden bool   `json:"hidden"`
+}
+
+// SetNodeVisibility 设置节点是否对未登录的访问者隐藏
+func SetNodeVisibility(c *gin.Context) {
+	var rq NodeVisibilityRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Prob("node").UpdateOne(ctx, bson.M{"token": rq.ID}, bson.M{"$set": bson.M{"hidden": rq.Hidden}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update node"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node visibility updated successfully"})
+}
+
+type NodeIDRq struct {
+	ID string `json:"id" binding:"required"`
+}
+
+// ResetNodeIdentity 删除节点固定的 agent 公钥，用于删除状态目录重新安装等 agent 身份变化的情况，
+// 节点下一次上报的公钥会重新固定
+func ResetNodeIdentity(c *gin.Context) {
+	var rq NodeIDRq
+	if err := c.ShouldBindJSON(&rq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	found, err := client.ResetPinnedKey(ctx, rq.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset node identity"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node identity reset successfully"})
+}
+
+// nodeHidden 表示节点是否对未登录的访问者隐藏，查询失败时按隐藏处理
+func nodeHidden(ctx context.Context, id string) bool {
+	var node Node
+	err := db.Prob("node").FindOne(ctx, bson.M{"token": id}).Decode(&node)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	return err != nil || node.Hidden
+}
+
+// resolveNodeID 把请求中的节点 ID 转换为上报 ID。未登录时只接受公开 ID (见 client.PublicID)，
+// 登录后也接受上报 ID
+func resolveNodeID(ctx context.Context, id string, authenticated bool) (string, bool) {
+	ids, err := getUniqueServerIDs(db.VPS("static").Collection)
+	if err != nil {
+		return "", false
+	}
+	for _, nodeID := range ids {
+		if (authenticated && nodeID == id) || client.PublicID(nodeID) == id {
+			return nodeID, true
+		}
+	}
+	return "", false
+}
+
+// getNodes 返回所有节点，以上报 ID 为键
+func getNodes(ctx context.Context) (map[string]Node, error) {
+	cursor, err := db.Prob("node").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	if err := cursor.All(ctx, &nodes); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]Node, len(nodes))
+	for _, n := range nodes {
+		ret[n.Token] = n
+	}
+	return ret, nil
+}
@@ -66,7 +66,7 @@ func SettingGet(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cc := db2.MG.CC("prob", "setting")
+	cc := db2.Prob("setting")
 	// 从数据库获取最新的设置
 	var setting Setting
 	err := cc.FindOne(ctx, bson.M{}).Decode(&setting)
@@ -112,7 +112,7 @@ func SettingSet(c *gin.Context) {
 	filter := bson.M{} // 空 filter 意味着更新或插入唯一的文档
 	update := bson.M{"$set": newSetting}
 
-	cc := db2.MG.CC("prob", "setting")
+	cc := db2.Prob("setting")
 
 	var updatedSetting Setting
 	err := cc.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedSetting)
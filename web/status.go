@@ -5,8 +5,9 @@ import (
 	"net/http"
 	"server/client"
 	"server/db"
-	"strconv"
-	"strings"
+	"server/traffic"
+	"server/uptime"
+	"server/util"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,6 +18,7 @@ import (
 
 type ServerData struct {
 	Id              string     `json:"id"`
+	PublicId        string     `json:"publicId"`
 	ServerName      string     `json:"serverName"`
 	AreaCode        string     `json:"areaCode"`
 	AreaFlagUrl     string     `json:"areaFlagUrl"`
@@ -47,6 +49,28 @@ type ServerData struct {
 	OnlineStatus    string     `json:"onlineStatus"`
 	Ipv4Supported   bool       `json:"ipv4Supported"`
 	Ipv6Supported   bool       `json:"ipv6Supported"`
+
+	// 流量配额为 0 表示不限，账单周期为 [TrafficCycleStart, TrafficCycleEnd)
+	TrafficQuota      int       `json:"trafficQuota"`
+	TrafficMode       string    `json:"trafficMode"`
+	TrafficCycleStart time.Time `json:"trafficCycleStart"`
+	TrafficCycleEnd   time.Time `json:"trafficCycleEnd"`
+
+	// Uptime 为最近 24 小时到 90 天的可用率和每日可用率
+	Uptime uptime.Report `json:"uptime"`
+	// Hidden 表示节点对未登录的访问者隐藏，只在登录后返回
+	Hidden bool `json:"hidden,omitempty"`
+	// CloneSuspected 表示节点可能是共用 agent 状态的克隆机器，只在登录后返回
+	CloneSuspected bool `json:"cloneSuspected,omitempty"`
+
+	// omit 为节点不提供的字段，编码时删除
+	omit []string
+}
+
+func (s ServerData) MarshalJSON() ([]byte, error) {
+	// 使用不带方法的类型，避免递归调用 MarshalJSON
+	type plain ServerData
+	return omitFields(plain(s), s.omit)
 }
 
 func getUniqueServerIDs(collection *mongo.Collection) ([]string, error) {
@@ -65,19 +89,30 @@ func getUniqueServerIDs(collection *mongo.Collection) ([]string, error) {
 	return serverIDs, nil
 }
 
-func getServerDataFromMongo() ([]ServerData, error) {
-	staticCollection := db.MG.CC("vps", "static")
-	dynamicCollection := db.MG.CC("vps", "dynamic")
+// getServerDataFromMongo 返回所有节点的状态，includeHidden 为 false 时跳过隐藏的节点，
+// Id 为节点的公开 ID (见 client.PublicID)，includeHidden 为 true 时为上报 ID
+func getServerDataFromMongo(includeHidden bool) ([]ServerData, error) {
+	staticCollection := db.VPS("static")
+	dynamicCollection := db.VPS("dynamic")
 
 	// 获取所有唯一的 server_id
 	serverIDs, err := getUniqueServerIDs(staticCollection.Collection)
 	if err != nil {
 		return nil, err
 	}
+	nodes, err := getNodes(context.TODO())
+	if err != nil {
+		return nil, err
+	}
 
 	var serverDataList []ServerData
 
 	for _, id := range serverIDs {
+		hidden := nodes[id].Hidden
+		if hidden && !includeHidden {
+			continue
+		}
+
 		// 获取最新的静态数据
 		var staticData client.ServerStaticData
 		err := staticCollection.FindOne(
@@ -99,104 +134,84 @@ func getServerDataFromMongo() ([]ServerData, error) {
 			continue // 如果没有找到动态数据，跳过这个服务器
 		}
 
-		serverData := ServerData{
-			Id:              id,
-			ServerName:      staticData.HostName,
-			AreaCode:        staticData.CountryCode,
-			OsName:          staticData.OSName,
-			Vendor:          staticData.VendorName,
-			CpuUsed:         int(dynamicData.CPUUsage),
-			CpuTotal:        100, // 假设CPU总量为100%
-			MemoryUsed:      int(dynamicData.MemoryUsed),
-			MemoryTotal:     parseMemoryTotal(staticData.MemoryTotal),
-			DiskUsed:        int(dynamicData.DiskUsed),
-			DiskTotal:       parseDiskTotal(staticData.DiskTotal),
-			SwapUsed:        0, // 需要添加到动态数据中
-			SwapTotal:       parseSwapTotal(staticData.SwapTotal),
-			NetDownload:     int(dynamicData.NetworkDownload),
-			NetUpload:       int(dynamicData.NetworkUpload),
-			TrafficDownload: int(dynamicData.TrafficDownload),
-			TrafficUpload:   int(dynamicData.TrafficUpload),
-			Load:            [3]float32{float32(dynamicData.Load[0]), float32(dynamicData.Load[1]), float32(dynamicData.Load[2])},
-			TcpCount:        dynamicData.TCPCount,
-			UdpCount:        dynamicData.UDPCount,
-			ProcessCount:    dynamicData.ProcessCount,
-			ThreadCount:     dynamicData.ThreadCount,
-			OnlineDuration:  int(time.Since(staticData.LastReportTime).Seconds()),
-			OnlineStatus:    "online", // 假设所有报告的服务器都在线
-			Ipv4Supported:   staticData.IPv4Supported,
-			Ipv6Supported:   staticData.IPv6Supported,
-			// 其他字段可以根据需要添加或修改
-		}
-
-		serverDataList = append(serverDataList, serverData)
+		serverDataList = append(serverDataList, newServerData(id, staticData, dynamicData, hidden, includeHidden))
 	}
 
 	return serverDataList, nil
 }
 
+// newServerData 由节点最新的静态数据和动态数据生成节点状态，authenticated 为 false 时 Id 为公开 ID
+func newServerData(id string, staticData client.ServerStaticData, dynamicData client.ServerDynamicData, hidden, authenticated bool) ServerData {
+	publicID := client.PublicID(id)
+	serverData := ServerData{
+		Id:              publicID,
+		PublicId:        publicID,
+		ServerName:      staticData.HostName,
+		AreaCode:        staticData.CountryCode,
+		OsName:          staticData.OSName,
+		Vendor:          staticData.VendorName,
+		CpuUsed:         int(dynamicData.CPUUsage),
+		CpuTotal:        100, // 假设CPU总量为100%
+		MemoryUsed:      int(dynamicData.MemoryUsed),
+		MemoryTotal:     parseMemoryTotal(staticData.MemoryTotal),
+		DiskUsed:        int(dynamicData.DiskUsed),
+		DiskTotal:       parseDiskTotal(staticData.DiskTotal),
+		SwapUsed:        0, // 需要添加到动态数据中
+		SwapTotal:       parseSwapTotal(staticData.SwapTotal),
+		NetDownload:     int(dynamicData.NetworkDownload),
+		NetUpload:       int(dynamicData.NetworkUpload),
+		TrafficDownload: int(dynamicData.TrafficDownload),
+		TrafficUpload:   int(dynamicData.TrafficUpload),
+		Load:            [3]float32{float32(dynamicData.Load[0]), float32(dynamicData.Load[1]), float32(dynamicData.Load[2])},
+		TcpCount:        dynamicData.TCPCount,
+		UdpCount:        dynamicData.UDPCount,
+		ProcessCount:    dynamicData.ProcessCount,
+		ThreadCount:     dynamicData.ThreadCount,
+		OnlineDuration:  int(time.Since(staticData.LastReportTime).Seconds()),
+		OnlineStatus:    "online",
+		Ipv4Supported:   staticData.IPv4Supported,
+		Ipv6Supported:   staticData.IPv6Supported,
+		// 其他字段可以根据需要添加或修改
+	}
+
+	// 本周期用量按节点的计费方式计算，累计流量为入站和出站之和
+	usage, _ := traffic.Get(id, time.Now())
+	serverData.MonthlyTraffic = int(usage.Used)
+	serverData.TotalTraffic = int(usage.TotalIn + usage.TotalOut)
+	serverData.TrafficQuota = int(usage.Quota)
+	serverData.TrafficMode = usage.Mode
+	serverData.TrafficCycleStart = usage.CycleStart
+	serverData.TrafficCycleEnd = usage.CycleEnd
+
+	now := time.Now()
+	if !uptime.Online(id, now) {
+		serverData.OnlineStatus = "offline"
+	}
+	serverData.Uptime = uptime.Get(id, now, false)
+	serverData.Hidden = hidden
+	if authenticated {
+		serverData.Id = id
+	}
+	serverData.CloneSuspected = authenticated && staticData.CloneSuspected
+	serverData.omit = unprovidedFields(staticData, statusFields)
+
+	return serverData
+}
+
 func parseMemoryTotal(memoryTotal string) int {
-	return parseSize(memoryTotal)
+	return util.ParseSize(memoryTotal)
 }
 
 func parseDiskTotal(diskTotal string) int {
-	return parseSize(diskTotal)
+	return util.ParseSize(diskTotal)
 }
 
 func parseSwapTotal(swapTotal string) int {
-	return parseSize(swapTotal)
-}
-
-func parseSize(size string) int {
-	size = strings.TrimSpace(size)
-	if size == "" {
-		return 0
-	}
-
-	// 将大小转换为小写以统一处理
-	size = strings.ToLower(size)
-
-	// 分离数字和单位
-	var numStr string
-	var unit string
-	for i, c := range size {
-		if c < '0' || c > '9' {
-			numStr = size[:i]
-			unit = size[i:]
-			break
-		}
-	}
-
-	// 如果没有找到单位，假设整个字符串都是数字
-	if unit == "" {
-		numStr = size
-	}
-
-	// 解析数字部分
-	num, err := strconv.ParseFloat(numStr, 64)
-	if err != nil {
-		return 0
-	}
-
-	// 根据单位转换为字节
-	switch unit {
-	case "b", "bytes":
-		return int(num)
-	case "k", "kb", "kib":
-		return int(num * 1024)
-	case "m", "mb", "mib":
-		return int(num * 1024 * 1024)
-	case "g", "gb", "gib":
-		return int(num * 1024 * 1024 * 1024)
-	case "t", "tb", "tib":
-		return int(num * 1024 * 1024 * 1024 * 1024)
-	default:
-		return int(num)
-	}
+	return util.ParseSize(swapTotal)
 }
 
 func Status(c *gin.Context) {
-	serverDataList, err := getServerDataFromMongo()
+	serverDataList, err := getServerDataFromMongo(util.Authenticated(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve server data"})
 		return
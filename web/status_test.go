@@ -0,0 +1,44 @@
+package web
+
+import (
+	"encoding/json"
+	"server/client"
+	"testing"
+)
+
+func TestServerDataOmitsUnprovidedFields(t *testing.T) {
+	static := client.ServerStaticData{
+		ID:    "node-1",
+		Agent: &client.AgentInfo{Capabilities: []string{"cpu", "memory", "disk", "network", "connections", "processes"}},
+	}
+	out, err := json.Marshal(newServerData("node-1", static, client.ServerDynamicData{ID: "node-1"}, false, false))
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if _, ok := m["load"]; ok {
+		t.Errorf("load present for a node without the load collector: %s", out)
+	}
+	for _, key := range []string{"cpuUsed", "memoryUsed", "tcpCount"} {
+		if _, ok := m[key]; !ok {
+			t.Errorf("%s missing: %s", key, out)
+		}
+	}
+
+	// 不知道节点能采集哪些数据时所有字段照常返回
+	static.Agent = nil
+	out, err = json.Marshal(newServerData("node-1", static, client.ServerDynamicData{ID: "node-1"}, false, false))
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	m = nil
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if _, ok := m["load"]; !ok {
+		t.Errorf("load missing for a node with unknown capabilities: %s", out)
+	}
+}
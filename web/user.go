@@ -22,7 +22,7 @@ func User(c *gin.Context) {
 	}
 
 	// 连接到用户集合
-	userCollection := db2.MG.CC("prob", "user")
+	userCollection := db2.Prob("user")
 
 	// 查找用户
 	var user DBUser
@@ -71,7 +71,7 @@ func Password(c *gin.Context) {
 		return
 	}
 
-	userCollection := db2.MG.CC("prob", "user")
+	userCollection := db2.Prob("user")
 
 	var user DBUser
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)